@@ -6,7 +6,7 @@ import (
 	"strconv"
 	"encoding/json"
 	"strings"
-	"time"
+	"sort"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 
 )
@@ -14,7 +14,76 @@ import (
 type SimpleChaincode struct {
 }
 
+// ArgSpec - one positional argument of a chaincode function
+type ArgSpec struct{
+	Name string
+	Type string									//argString or argInt
+	Required bool								//required arguments must be given and non-empty, optional ones may be left off or empty
+}
+
+// Handler - a chaincode function and the arguments it takes, checked before it runs
+type Handler struct{
+	Fn func(*SimpleChaincode, ChaincodeStubInterface, []string) ([]byte, error)
+	Args []ArgSpec
+	MoreArgs bool								//more arguments may follow the declared ones, the function checks those itself
+	Admin bool									//only admins may call it
+	FromJSON func(map[string]json.RawMessage) ([]string, error)	//positional arguments from the fields of a JSON object argument, when they are not just the declared ones
+	After func(ChaincodeStubInterface) error	//runs in the same transaction once the function has succeeded
+}
+
+var argString = "string"
+var argInt = "int"
+
+// ChaincodeStubInterface - the parts of *shim.ChaincodeStub the chaincode functions use, lets an in-memory stub stand in for tests
+type ChaincodeStubInterface interface {
+	GetState(key string) ([]byte, error)
+	PutState(key string, value []byte) error
+	DelState(key string) error
+	ReadCertAttribute(attributeName string) ([]byte, error)
+	TxTimestamp() (int64, error)
+}
+
+// peerStub - *shim.ChaincodeStub plus the helpers ChaincodeStubInterface expects on top of it
+type peerStub struct {
+	*shim.ChaincodeStub
+}
+
+// TxTimestamp - timestamp of the transaction in ms, the same on every peer unlike the local clock
+func (s peerStub) TxTimestamp() (int64, error) {
+	ts, err := s.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return ts.Seconds * 1000 + int64(ts.Nanos) / 1000000, nil
+}
+
+// deployStub - the stub init gets when the chaincode is deployed, so it knows it may name the first admin of a ledger
+// that already has items
+type deployStub struct {
+	ChaincodeStubInterface
+}
+
+var logLevels = []string{"error", "info", "debug"}	//levels init's log_level takes, each prints everything the ones before it do
+var logLevel = 1								//index into logLevels, info leaves out the chatty per-marble and per-trade detail
+var logLevelStr = "_loglevel"					//name for the key/value holding the level init set, so a restarted peer logs the same
+var logLevelLoaded = false						//whether logLevel has been read from the ledger since the chaincode started
+var reservedPrefix = "_"						//keys starting with this are the chaincode's own, write and delete refuse them
+var itemPrefix = "_item_"						//each item history is stored under this prefix + its id
 var itemIndexStr = "_itemindex"
+var schemaVersion = 2							//version written into every new item history entry, records without one are version 1
+var schemaVersionStr = "_schemaversion"			//name for the key/value holding the version every record has been migrated to
+var migrationStr = "_migration"					//name for the key/value holding how far an unfinished migrate has got
+var migrateBatchSize = 50						//records migrate looks at per call when no limit is given
+var adminIndexStr = "_admins"					//name for the key/value that will store a list of all admin users
+var callerAttr = "username"						//transaction certificate attribute holding the caller's user name
+
+// BrokenRecord - a stored value or item history entry that does not parse as JSON, found by scan_records and verify_state
+type BrokenRecord struct{
+	Key string `json:"key"`
+	Entry int `json:"entry"`						//position in the item's history, -1 when the whole value does not parse
+	Error string `json:"error"`
+	Repairable bool `json:"repairable"`			//true if the entry could be rebuilt from the old string format
+}
 
 type Item struct{
 	Id string `json:"id"`
@@ -30,54 +99,186 @@ type Item struct{
 	Warranty_validity string `json:"warranty_validity"`
 	Problem string `json:"problem"`
 	Fixes string `json:"fixes"`
+	Version int `json:"version,omitempty"`			//schema version the entry was written or migrated to, missing for version 1
 }
 
 
 // main. Given function. No changes
 
+// Migration - progress of migrate, kept on the ledger between calls until every record is at schemaVersion
+type Migration struct{
+	Version int `json:"version"`				//schema version being migrated to
+	Stage string `json:"stage"`					//records being migrated, "items", "done" once finished
+	Bookmark string `json:"bookmark"`			//id of the last item looked at in this stage, items are taken in id order
+	Migrated int `json:"migrated"`				//records upgraded so far
+	Broken []string `json:"broken,omitempty"`	//records that did not decode and were left for repair_records
+}
+
+// invokeFunctions - every function an invocation can call
+var invokeFunctions = map[string]Handler{
+	"init": {Fn: (*SimpleChaincode).init, Args: []ArgSpec{{"value", argInt, true}, {"admin", argString, false}, {"force", argString, false}, {"log_level", argString, false}}, Admin: true},		//initialize the chaincode state, used as reset
+	"delete": {Fn: (*SimpleChaincode).Delete, Args: []ArgSpec{{"id", argString, true}}, Admin: true},		//deletes an entity from its state
+	"write": {Fn: (*SimpleChaincode).Write, Args: []ArgSpec{{"name", argString, true}, {"value", argString, false}}, Admin: true},		//writes a value to the chaincode state
+	"add_admin": {Fn: (*SimpleChaincode).add_admin, Args: []ArgSpec{{"user", argString, true}}, Admin: true},		//let another user call admin functions
+	"remove_admin": {Fn: (*SimpleChaincode).remove_admin, Args: []ArgSpec{{"user", argString, true}}, Admin: true},		//stop a user calling admin functions
+	"init_item": {Fn: (*SimpleChaincode).init_item, Args: []ArgSpec{{"id", argString, true}, {"name", argString, true}, {"company", argString, true}, {"price", argString, false}, {"warranty", argString, false}, {"category", argString, false}}},		//register a new item with its maker
+	"first_sale": {Fn: (*SimpleChaincode).first_sale, Args: []ArgSpec{{"id", argString, true}, {"owner", argString, true}, {"bill_num", argString, true}, {"seller", argString, true}}},		//record an item's first sale to its owner
+	"repair_item": {Fn: (*SimpleChaincode).repair_item, Args: []ArgSpec{{"id", argString, true}, {"problem", argString, true}, {"fixes", argString, true}}},		//record a repair made to an item
+	"resale_item": {Fn: (*SimpleChaincode).resale_item, Args: []ArgSpec{{"id", argString, true}, {"owner", argString, true}, {"price", argString, true}}},		//record an item sold on to a new owner
+	"repair_records": {Fn: (*SimpleChaincode).repair_records, Admin: true},		//rewrite item history entries that do not parse
+	"migrate": {Fn: (*SimpleChaincode).migrate, Args: []ArgSpec{{"limit", argInt, false}}, Admin: true},		//upgrade item histories to the current schema version, a batch at a time
+	"migrate_keys": {Fn: (*SimpleChaincode).migrate_keys, Admin: true},		//move items stored under their bare id into their own keys
+}
+
+// queryFunctions - every function a query can call
+var queryFunctions = map[string]Handler{
+	"read": {Fn: (*SimpleChaincode).read, Args: []ArgSpec{{"name", argString, true}}},		//read a variable
+	"scan_records": {Fn: (*SimpleChaincode).scan_records},		//report item history entries that do not parse
+	"verify_state": {Fn: (*SimpleChaincode).verify_state},		//report every stored value that does not decode
+}
+
 func main() {
 	err := shim.Start(new(SimpleChaincode))
 	if err != nil {
-		fmt.Printf("Error starting Simple chaincode: %s", err)
+		logError("Error starting Simple chaincode: " + err.Error())
 	}
 }
 
 func (t *SimpleChaincode) Init(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
+	return t.deploy(peerStub{stub}, args)
+}
+
+// ============================================================================================================================
+// deploy - run init the way deploying the chaincode does, against any ChaincodeStubInterface
+// ============================================================================================================================
+func (t *SimpleChaincode) deploy(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	return t.call(deployStub{stub}, "init", invokeFunctions["init"], args)
+}
+
+// ============================================================================================================================
+// init - set up the ledger, one already set up keeps its items and has them migrated unless an admin forces a reset, shared by Init and the "init" invocation
+// ============================================================================================================================
+func (t *SimpleChaincode) init(stub ChaincodeStubInterface, args []string) ([]byte, error) {
 	var Aval int
 	var err error
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
-	}
-
 	// Initialize the chaincode
-	Aval, err = strconv.Atoi(args[0])
-	if err != nil {
-		return nil, errors.New("Expecting integer value for asset holding")
-	}
+	Aval, _ = strconv.Atoi(args[0])												//checkArgs made sure it is a number
 
 	// Write the state to the ledger
 	err = stub.PutState("abc", []byte(strconv.Itoa(Aval)))				//making a test var "abc", I find it handy to read/write to it right away to test the network
 	if err != nil {
 		return nil, err
 	}
-
-	var empty []string
-	jsonAsBytes, _ := json.Marshal(empty)								//marshal an emtpy array of strings to clear the index
-	err = stub.PutState(itemIndexStr, jsonAsBytes)
+	
+	force := false
+	if args[2] != "" {
+		force, err = strconv.ParseBool(args[2])
+		if err != nil {
+			return nil, errors.New("init's force argument must be true or false")
+		}
+	}
+	
+	if args[3] != "" {
+		level, err := parseLogLevel(args[3])
+		if err != nil {
+			return nil, err
+		}
+		err = stub.PutState(logLevelStr, []byte(logLevels[level]))
+		if err != nil {
+			return nil, err
+		}
+		logLevel, logLevelLoaded = level, true
+	}
+	
+	admins, err := getAdmins(stub)
 	if err != nil {
 		return nil, err
 	}
+	indexAsBytes, err := stub.GetState(itemIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get item index")
+	}
+	if len(indexAsBytes) != 0 && !force {								//already set up, keep the items and bring how they are stored up to date
+		_, err = t.migrate(stub, []string{""})								//the first batch, an admin calls migrate until it is done
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if len(indexAsBytes) != 0 {
+			if len(admins) == 0 {
+				return nil, errors.New("init only wipes existing items for an admin")
+			}
+			err = clearItems(stub)										//remove them rather than orphan them
+			if err != nil {
+				return nil, err
+			}
+		}
+		var empty []string
+		jsonAsBytes, _ := json.Marshal(empty)							//marshal an emtpy array of strings to clear the index
+		err = stub.PutState(itemIndexStr, jsonAsBytes)
+		if err != nil {
+			return nil, err
+		}
+		err = stub.PutState(schemaVersionStr, []byte(strconv.Itoa(schemaVersion)))	//nothing to migrate on an empty ledger
+		if err != nil {
+			return nil, err
+		}
+		err = stub.DelState(migrationStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	
+	_, deploying := stub.(deployStub)
+	if len(admins) == 0 && len(indexAsBytes) != 0 && !deploying {		//init runs for anyone until there is an admin, so only the deploy names one for existing items
+		if args[1] != "" {
+			return nil, errors.New("only the deploy can name the first admin of a ledger that already has items")
+		}
+	} else if len(admins) == 0 {
+		admin := args[1]
+		if admin == "" {
+			admin, err = getCaller(stub)
+			if err != nil {
+				return nil, errors.New("init needs an admin, pass one or call with a certificate carrying the " + callerAttr + " attribute")
+			}
+		}
+		err = putAdmins(stub, []string{strings.ToLower(admin)})
+		if err != nil {
+			return nil, err
+		}
+	}
 	
 	return nil, nil
+}
 
+// ============================================================================================================================
+// clearItems - delete the history of every item in the index
+// ============================================================================================================================
+func clearItems(stub ChaincodeStubInterface) error {
+	itemsAsBytes, err := stub.GetState(itemIndexStr)
+	if err != nil {
+		return errors.New("Failed to get item index")
+	}
+	var itemIndex []string
+	err = decodeJSON(itemIndexStr, itemsAsBytes, &itemIndex)
+	if err != nil {
+		return err
+	}
+	for _, id := range itemIndex{
+		err = stub.DelState(itemKey(id))
+		if err != nil {
+			return errors.New("Failed to delete item " + id)
+		}
+	}
+	return nil
 }
 
 // ============================================================================================================================
 // Run - Our entry point for Invocations - [LEGACY] obc-peer 4/25/2016
 // ============================================================================================================================
 func (t *SimpleChaincode) Run(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
-	fmt.Println("run is running " + function)
+	logInfo("run is running " + function)
 	return t.Invoke(stub, function, args)
 }
 
@@ -86,43 +287,206 @@ func (t *SimpleChaincode) Run(stub *shim.ChaincodeStub, function string, args []
 // Run - Our entry point
 // ============================================================================================================================
 func (t *SimpleChaincode) Invoke(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
-	fmt.Println("run is running " + function)
-
-	// Handle different functions
-	if function == "init" {													//initialize the chaincode state, used as reset
-		return t.Init(stub, "init", args)
-	} else if function == "delete" {										//deletes an entity from its state
-		return t.Delete(stub, args)
-	} else if function == "write" {											//writes a value to the chaincode state
-		return t.Write(stub, args)
-	} else if function == "init_item" {									//create a new marble
-		return t.init_item(stub, args)
-	}  else if function == "first_sale" {										//change owner of a marble
-		return t.first_sale(stub, args)
-	} else if function == "repair_item" {									//cancel an open trade order
-		return t.repair_item(stub, args)
-	} else if function == "resale_item" {									//cancel an open trade order
-		return t.resale_item(stub, args)
-	}
+	return t.invoke(peerStub{stub}, function, args)
+}
 
-	fmt.Println("run did not find func: " + function)						//error
+// ============================================================================================================================
+// invoke - dispatch an invocation against any ChaincodeStubInterface
+// ============================================================================================================================
+func (t *SimpleChaincode) invoke(stub ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	loadLogLevel(stub)
+	logInfo("invoke is running " + function)
 
-	return nil, errors.New("Received unknown function invocation")
+	handler, ok := invokeFunctions[function]
+	if !ok {
+		logError("invoke did not find func: " + function)						//error
+		return nil, errors.New("Received unknown function invocation")
+	}
+	return t.call(stub, function, handler, args)
 }
 
 // ============================================================================================================================
 // Query - Our entry point for Queries
 // ============================================================================================================================
 func (t *SimpleChaincode) Query(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
-	fmt.Println("query is running " + function)
+	return t.query(peerStub{stub}, function, args)
+}
 
-	// Handle different functions
-	if function == "read" {													//read a variable
-		return t.read(stub, args)
-	} 
-	fmt.Println("query did not find func: " + function)						//error
+// ============================================================================================================================
+// query - dispatch a query against any ChaincodeStubInterface
+// ============================================================================================================================
+func (t *SimpleChaincode) query(stub ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	loadLogLevel(stub)
+	logInfo("query is running " + function)
 
-	return nil, errors.New("Received unknown function query")
+	handler, ok := queryFunctions[function]
+	if !ok {
+		logError("query did not find func: " + function)						//error
+		return nil, errors.New("Received unknown function query")
+	}
+	return t.call(stub, function, handler, args)
+}
+
+// ============================================================================================================================
+// call - check and convert a function's arguments, given positionally or as one JSON object, and that the caller
+//   may call it, then run it
+// ============================================================================================================================
+func (t *SimpleChaincode) call(stub ChaincodeStubInterface, function string, handler Handler, args []string) ([]byte, error) {
+	args, err := argsFromJSON(function, handler, args)
+	if err == nil {
+		args, err = checkArgs(function, handler, args)
+	}
+	if err == nil && handler.Admin {
+		err = checkAdmin(stub, function)
+	}
+	if err != nil {
+		logError(err.Error())
+		return nil, err
+	}
+	res, err := handler.Fn(t, stub, args)
+	if err == nil && handler.After != nil {
+		err = handler.After(stub)
+	}
+	return res, err
+}
+
+// ============================================================================================================================
+// argsFromJSON - positional arguments from a single JSON object argument with a field per declared argument,
+//   e.g. {"name": "m1", "user": "bob"} for set_user. Any other args are positional and come back unchanged
+// ============================================================================================================================
+func argsFromJSON(function string, handler Handler, args []string) ([]string, error) {
+	if len(args) != 1 || !strings.HasPrefix(strings.TrimSpace(args[0]), "{") {
+		return args, nil
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal([]byte(args[0]), &fields) != nil {
+		return args, nil														//not an object after all, e.g. a name starting with {
+	}
+	
+	if handler.FromJSON != nil {
+		checkedFields, err := handler.FromJSON(fields)							//functions with a variable number of arguments name them their own way
+		if err != nil {
+			return nil, errors.New(function + " " + err.Error())
+		}
+		return checkedFields, nil
+	}
+	
+	positional := make([]string, len(handler.Args))
+	for i, spec := range handler.Args{
+		raw, ok := fields[spec.Name]
+		if !ok {
+			continue															//left empty, checkArgs reports it if it is required
+		}
+		delete(fields, spec.Name)
+		value, err := jsonArg(raw)
+		if err != nil {
+			return nil, errors.New(function + " field " + spec.Name + " " + err.Error())
+		}
+		positional[i] = value
+	}
+	for name := range fields{
+		return nil, errors.New(function + " has no argument named " + name)
+	}
+	return positional, nil
+}
+
+// ============================================================================================================================
+// jsonArg - a JSON string, number or bool field as a positional argument, null is left empty
+// ============================================================================================================================
+func jsonArg(raw json.RawMessage) (string, error) {
+	text := strings.TrimSpace(string(raw))
+	if text == "null" {
+		return "", nil
+	}
+	if text == "true" || text == "false" {
+		return text, nil
+	}
+	if strings.HasPrefix(text, "\"") {
+		var value string
+		err := json.Unmarshal(raw, &value)
+		return value, err
+	}
+	var number json.Number
+	if json.Unmarshal(raw, &number) != nil {
+		return "", errors.New("must be a string or a number")
+	}
+	return number.String(), nil
+}
+
+// ============================================================================================================================
+// checkArgs - check args against the function's declared arguments, optional arguments left off come back empty
+//   and ints come back in canonical form, so the function can index and convert them without checking again
+// ============================================================================================================================
+func checkArgs(function string, handler Handler, args []string) ([]string, error) {
+	if len(args) < requiredArgs(handler) || (len(args) > len(handler.Args) && !handler.MoreArgs) {
+		return nil, errors.New(function + " expects " + argUsage(handler))
+	}
+	
+	checked := make([]string, len(args))
+	copy(checked, args)
+	for i, spec := range handler.Args{
+		if i >= len(checked) {
+			checked = append(checked, "")
+			continue
+		}
+		if checked[i] == "" {
+			if spec.Required {
+				return nil, errors.New(function + " argument " + strconv.Itoa(i + 1) + " (" + spec.Name + ") must be a non-empty string")
+			}
+			continue
+		}
+		if spec.Type == argInt {
+			n, err := strconv.Atoi(strings.TrimSpace(checked[i]))
+			if err != nil {
+				return nil, errors.New(function + " argument " + strconv.Itoa(i + 1) + " (" + spec.Name + ") must be a numeric string")
+			}
+			checked[i] = strconv.Itoa(n)
+		}
+	}
+	return checked, nil
+}
+
+// ============================================================================================================================
+// requiredArgs - how many arguments a function must be given, required arguments come before optional ones
+// ============================================================================================================================
+func requiredArgs(handler Handler) int {
+	required := 0
+	for _, spec := range handler.Args{
+		if spec.Required {
+			required++
+		}
+	}
+	return required
+}
+
+// ============================================================================================================================
+// argUsage - what a function expects, e.g. "2 arguments: name, user" or "1 to 3 arguments: owner, [bookmark], [limit]"
+// ============================================================================================================================
+func argUsage(handler Handler) string {
+	required := requiredArgs(handler)
+	count := strconv.Itoa(required)
+	if handler.MoreArgs {
+		count = "at least " + count
+	} else if required < len(handler.Args) {
+		count += " to " + strconv.Itoa(len(handler.Args))
+	}
+	
+	var names []string
+	for _, spec := range handler.Args{
+		if spec.Required {
+			names = append(names, spec.Name)
+		} else {
+			names = append(names, "[" + spec.Name + "]")
+		}
+	}
+	if handler.MoreArgs {
+		names = append(names, "...")
+	}
+	usage := count + " arguments"
+	if len(names) > 0 {
+		usage += ": " + strings.Join(names, ", ")
+	}
+	return usage
 }
 
 
@@ -130,16 +494,15 @@ func (t *SimpleChaincode) Query(stub *shim.ChaincodeStub, function string, args
 // ============================================================================================================================
 // Read - read a variable from chaincode state
 // ============================================================================================================================
-func (t *SimpleChaincode) read(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+func (t *SimpleChaincode) read(stub ChaincodeStubInterface, args []string) ([]byte, error) {
 	var name, jsonResp string
 	var err error
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting name of the var to query")
-	}
-
 	name = args[0]
-	valAsbytes, err := stub.GetState(name)									//get the var from chaincode state
+	valAsbytes, err := stub.GetState(itemKey(name))							//an item by id
+	if err == nil && len(valAsbytes) == 0 {
+		valAsbytes, err = stub.GetState(name)								//else the var from chaincode state, e.g. an index or what write stored
+	}
 	if err != nil {
 		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
 		return nil, errors.New(jsonResp)
@@ -151,13 +514,14 @@ func (t *SimpleChaincode) read(stub *shim.ChaincodeStub, args []string) ([]byte,
 // ============================================================================================================================
 // Delete - remove a key/value pair from state
 // ============================================================================================================================
-func (t *SimpleChaincode) Delete(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
-	}
+func (t *SimpleChaincode) Delete(stub ChaincodeStubInterface, args []string) ([]byte, error) {
 	
 	name := args[0]
-	err := stub.DelState(name)													//remove the key from chaincode state
+	err := checkName(name)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.DelState(itemKey(name))										//remove the key from chaincode state
 	if err != nil {
 		return nil, errors.New("Failed to delete state")
 	}
@@ -168,39 +532,45 @@ func (t *SimpleChaincode) Delete(stub *shim.ChaincodeStub, args []string) ([]byt
 		return nil, errors.New("Failed to get item index")
 	}
 	var itemIndex []string
-	json.Unmarshal(itemsAsBytes, &itemIndex)								//un stringify it aka JSON.parse()
+	err = decodeJSON(itemIndexStr, itemsAsBytes, &itemIndex)
+	if err != nil {
+		return nil, err
+	}
 	
 	//remove item from index
 	for i,val := range itemIndex{
-		fmt.Println(strconv.Itoa(i) + " - looking at " + val + " for " + name)
+		logDebug(strconv.Itoa(i) + " - looking at " + val + " for " + name)
 		if val == name{															//find the correct item
-			fmt.Println("found item")
+			logDebug("found item")
 			itemIndex = append(itemIndex[:i], itemIndex[i+1:]...)			//remove it
 			for x:= range itemIndex{											//debug prints...
-				fmt.Println(string(x) + " - " + itemIndex[x])
+				logDebug(strconv.Itoa(x) + " - " + itemIndex[x])
 			}
 			break
 		}
 	}
 	jsonAsBytes, _ := json.Marshal(itemIndex)									//save new index
 	err = stub.PutState(itemIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
 	return nil, nil
 }
 
 // ============================================================================================================================
 // Write - write variable into chaincode state
 // ============================================================================================================================
-func (t *SimpleChaincode) Write(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+func (t *SimpleChaincode) Write(stub ChaincodeStubInterface, args []string) ([]byte, error) {
 	var name, value string // Entities
 	var err error
-	fmt.Println("running write()")
-
-	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2. name of the variable and value to set")
-	}
+	logDebug("running write()")
 
 	name = args[0]															//rename for funsies
 	value = args[1]
+	err = checkName(name)													//the chaincode's own keys are off limits
+	if err != nil {
+		return nil, err
+	}
 	err = stub.PutState(name, []byte(value))								//write the variable into the chaincode state
 	if err != nil {
 		return nil, err
@@ -208,74 +578,312 @@ func (t *SimpleChaincode) Write(stub *shim.ChaincodeStub, args []string) ([]byte
 	return nil, nil
 }
 
+// ============================================================================================================================
+// Migrate Keys - one shot move of every item stored under its bare id into its own key, a second run does nothing
+// ============================================================================================================================
+func (t *SimpleChaincode) migrate_keys(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	logDebug("- start migrate keys")
+	indexAsBytes, err := stub.GetState(itemIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get item index")
+	}
+	var index []string
+	err = decodeJSON(itemIndexStr, indexAsBytes, &index)
+	if err != nil {
+		return nil, err
+	}
+	
+	for _, id := range index{
+		moved, err := moveKey(stub, id, itemKey(id))
+		if err != nil {
+			return nil, err
+		}
+		if moved {
+			logInfo("! migrated item " + id)
+		}
+	}
+	logDebug("- end migrate keys")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Migrate - upgrade records to schemaVersion, looking at up to limit of them. A ledger too big for one transaction
+//   takes several calls, each carrying on from where the last stopped. Returns the progress, stage "done" once finished
+// ============================================================================================================================
+func (t *SimpleChaincode) migrate(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0
+	// *"limit"*
+	limit := migrateBatchSize
+	if args[0] != "" {
+		limit, _ = strconv.Atoi(args[0])
+		if limit <= 0 {
+			return nil, errors.New("limit must be a positive numeric string")
+		}
+	}
+	logDebug("- start migrate")
+	progress, err := getMigration(stub)
+	if err != nil {
+		return nil, err
+	}
+	
+	for limit > 0 && progress.Stage != "done" {
+		var n int
+		switch progress.Stage {
+		case "items":
+			n, err = migrateItems(stub, &progress, limit)
+		default:
+			return nil, errors.New("Unknown migration stage " + progress.Stage)
+		}
+		if err != nil {
+			return nil, err
+		}
+		limit -= n
+	}
+	
+	if progress.Stage == "done" {
+		err = stub.PutState(schemaVersionStr, []byte(strconv.Itoa(progress.Version)))
+		if err == nil {
+			err = stub.DelState(migrationStr)											//nothing left to resume
+		}
+	} else {
+		jsonAsBytes, _ := json.Marshal(progress)
+		err = stub.PutState(migrationStr, jsonAsBytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logDebug("- end migrate, stage " + progress.Stage)
+	return json.Marshal(progress)
+}
+
+// ============================================================================================================================
+// getMigration - the progress of an unfinished migrate, or a fresh start unless the ledger is already at schemaVersion
+// ============================================================================================================================
+func getMigration(stub ChaincodeStubInterface) (Migration, error) {
+	progress := Migration{Version: schemaVersion, Stage: "items"}
+	progressAsBytes, err := stub.GetState(migrationStr)
+	if err != nil {
+		return progress, errors.New("Failed to get migration")
+	}
+	if len(progressAsBytes) == 0 {
+		versionAsBytes, err := stub.GetState(schemaVersionStr)
+		if err != nil {
+			return progress, errors.New("Failed to get schema version")
+		}
+		version, _ := strconv.Atoi(string(versionAsBytes))
+		if version >= schemaVersion {
+			progress.Stage = "done"												//already migrated, nothing to walk
+		}
+		return progress, nil
+	}
+	err = decodeJSON(migrationStr, progressAsBytes, &progress)
+	return progress, err
+}
+
+// ============================================================================================================================
+// sortedIndex - the names or ids in an index, sorted
+// ============================================================================================================================
+func sortedIndex(stub ChaincodeStubInterface, indexStr string) ([]string, error) {
+	indexAsBytes, err := stub.GetState(indexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get " + indexStr)
+	}
+	var index []string
+	err = decodeJSON(indexStr, indexAsBytes, &index)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(index)
+	return index, nil
+}
+
+// ============================================================================================================================
+// migrateItems - upgrade the history of up to limit items after the bookmark, done once all are.
+//   Returns how many it looked at
+// ============================================================================================================================
+func migrateItems(stub ChaincodeStubInterface, progress *Migration, limit int) (int, error) {
+	ids, err := sortedIndex(stub, itemIndexStr)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, id := range ids{
+		if id <= progress.Bookmark {
+			continue
+		}
+		if n >= limit {
+			return n, nil
+		}
+		n++
+		_, err = moveKey(stub, id, itemKey(id))										//still under its bare id from before items had their own keys
+		if err != nil {
+			return n, err
+		}
+		itemAsBytes, err := stub.GetState(itemKey(id))
+		if err != nil {
+			return n, errors.New("Failed to get item " + id)
+		}
+		var itemHistory []string
+		if json.Unmarshal(itemAsBytes, &itemHistory) != nil {
+			progress.Broken = append(progress.Broken, id)
+			progress.Bookmark = id
+			continue
+		}
+		upgraded := false
+		for i, str := range itemHistory{
+			var res Item
+			if json.Unmarshal([]byte(str), &res) != nil {
+				continue															//left for repair_records
+			}
+			if upgradeItem(&res) {
+				itemString, _ := json.Marshal(res)
+				itemHistory[i] = string(itemString)
+				upgraded = true
+			}
+		}
+		if upgraded {
+			jsonAsBytes, _ := json.Marshal(itemHistory)
+			err = stub.PutState(itemKey(id), jsonAsBytes)
+			if err != nil {
+				return n, errors.New("Failed to rewrite item " + id)
+			}
+			progress.Migrated++
+		}
+		progress.Bookmark = id
+	}
+	progress.Stage, progress.Bookmark = "done", ""
+	return n, nil
+}
+
+// ============================================================================================================================
+// upgradeItem - bring an item history entry up to schemaVersion, false if it already was
+// ============================================================================================================================
+func upgradeItem(item *Item) bool {
+	if item.Version >= schemaVersion {
+		return false
+	}
+	item.Id = strings.ToLower(item.Id)												//1 to 2 - ids were not always lowercased
+	item.Version = schemaVersion
+	return true
+}
+
+// ============================================================================================================================
+// Add Admin - let another user call admin functions
+// ============================================================================================================================
+func (t *SimpleChaincode) add_admin(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// "bob"
+	user := strings.ToLower(args[0])
+	admins, err := getAdmins(stub)
+	if err != nil {
+		return nil, err
+	}
+	if containsName(admins, user) {
+		return nil, nil														//already one
+	}
+	err = putAdmins(stub, append(admins, user))
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Remove Admin - stop a user calling admin functions, the last admin can not be removed
+// ============================================================================================================================
+func (t *SimpleChaincode) remove_admin(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// "bob"
+	user := strings.ToLower(args[0])
+	admins, err := getAdmins(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !containsName(admins, user) {
+		return nil, errors.New(user + " is not an admin")
+	}
+	if len(admins) == 1 {
+		return nil, errors.New("Can not remove the last admin " + user)
+	}
+	err = putAdmins(stub, removeName(admins, user))
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
 // ============================================================================================================================
 // Init item and store into chaincode state
 // Used by manufacturers
 // ============================================================================================================================
-func (t *SimpleChaincode) init_item(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+func (t *SimpleChaincode) init_item(stub ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
 
 	//   0       1       2          3          4      5
 	// id,    name     company    price    warranty  category
-	if len(args) <= 3 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 4")
-	}
 
-	fmt.Println("- start init marble")
-	if len(args[0]) <= 0 {
-		return nil, errors.New("1st argument must be a non-empty string")
-	}
-	if len(args[1]) <= 0 {
-		return nil, errors.New("2nd argument must be a non-empty string")
-	}
-	if len(args[2]) <= 0 {
-		return nil, errors.New("3rd argument must be a non-empty string")
+	logDebug("- start init marble")
+	err = checkName(args[0])
+	if err != nil {
+		return nil, err
 	}
 
 	id := strings.ToLower(args[0]) //string
 	name := strings.ToLower(args[1]) //string
 	company := strings.ToLower(args[2]) // string
 	price := strings.ToLower(args[3])
-	date := time.Now().UnixNano() / (int64(time.Millisecond)/int64(time.Nanosecond)) //unix epoch int64
+	date, err := itemDate(stub)										//unix epoch in ms, from the transaction
+	if err != nil {
+		return nil, err
+	}
 	warranty := strings.ToLower(args[4])
 	trans_type := "manufacture"
 	category:=strings.ToLower(args[5])
 		//check if marble already exists
-	marbleAsBytes, err := stub.GetState(id)
+	marbleAsBytes, err := stub.GetState(itemKey(id))
 	if err != nil {
 		return nil, errors.New("Failed to get marble name")
 	}
-	res := Item{}
-	json.Unmarshal(marbleAsBytes, &res)
-	if res.Id == id{
-		fmt.Println("This marble arleady exists: " + name)
-		fmt.Println(res);
+	var existing []string													//an item is stored as its history
+	err = decodeJSON(itemKey(id), marbleAsBytes, &existing)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		logError("This marble arleady exists: " + name)
 		return nil, errors.New("This marble arleady exists")				//all stop a marble by this name exists
 	}
 	
-	str := `{"id": "` + id + `", "name": "` + name + `", "owner": "` + `", "price": "` + price + `", "category": "` + category +`", "date": "` + strconv.FormatInt(date, 10) + `", "warranty_validity": "` + warranty + `", "company": "` + company + `", "seller": "` + `", "bill_num": "` + `", "type": "`+ trans_type + `", "problem": "` + `", "fixes": "`  +`"}`
-	// str := `{"name": "` + name + `", "color": "` + color + `", "size": ` + strconv.Itoa(size) + `, "user": "` + user + `"}`
+	item := Item{Id: id, Name: name, Price: price, Category: category, Date: date, Warranty_validity: warranty, Company: company, Type: trans_type, Version: schemaVersion}
+	itemString, _ := json.Marshal(item)
 	
 	var itemList []string      //new list which stores all the transitions for a particular item
 	itemListAsBytes,_ := json.Marshal(itemList)
-	err = stub.PutState(id, itemListAsBytes)
+	err = stub.PutState(itemKey(id), itemListAsBytes)
+	if err != nil {
+		return nil, err
+	}
 
-	getItems, err := stub.GetState(id)
+	getItems, err := stub.GetState(itemKey(id))
 	if err!=nil {
 		return nil, errors.New("Failed to get marble")
 	}	
 
 	var itemNew []string
-	json.Unmarshal(getItems, &itemNew)
+	err = decodeJSON(itemKey(id), getItems, &itemNew)
+	if err != nil {
+		return nil, err
+	}
 
 	// append newly created item as first element in its list
 
-
 	// maybe byte[]
-	itemNew = append(itemNew, str)
+	itemNew = append(itemNew, string(itemString))
 	newItemAsBytes, _ := json.Marshal(itemNew)
-	err = stub.PutState(id, newItemAsBytes)
-
+	err = stub.PutState(itemKey(id), newItemAsBytes)
+	if err != nil {
+		return nil, err
+	}
 
 	// err = stub.PutState(id, []byte(str))								//store item with id as key
 	// if err != nil {
@@ -288,48 +896,63 @@ func (t *SimpleChaincode) init_item(stub *shim.ChaincodeStub, args []string) ([]
 		return nil, errors.New("Failed to get marble index")
 	}
 	var itemIndex []string
-	json.Unmarshal(itemAsBytes, &itemIndex)							//un stringify it aka JSON.parse()
+	err = decodeJSON(itemIndexStr, itemAsBytes, &itemIndex)
+	if err != nil {
+		return nil, err
+	}
 	
 	//append
 	itemIndex = append(itemIndex, id)								//add item name to index list
-	fmt.Println("! item index: ", itemIndex)
+	logDebug("! item index: ", itemIndex)
 	jsonAsBytes, _ := json.Marshal(itemIndex)
 	err = stub.PutState(itemIndexStr, jsonAsBytes)						//store name of item
+	if err != nil {
+		return nil, err
+	}
 
-	fmt.Println("- end init marble")
+	logDebug("- end init marble")
 	return nil, nil
 }
 //============================================================================================================================
 //First sale
 //============================================================================================================================
-func (t *SimpleChaincode) first_sale(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+func (t *SimpleChaincode) first_sale(stub ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
 	
 	//   0       1         2           3      
 	// id       owner    bill_num    seller
-	if len(args) < 3 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2")
-	}
 	
-	fmt.Println("- start set user")
-	fmt.Println(args[0] + " - " + args[1])
-	itemAsBytes, err := stub.GetState(args[0])
+	logDebug("- start set user")
+	logDebug(args[0] + " - " + args[1])
+	itemAsBytes, err := stub.GetState(itemKey(args[0]))
 	if err != nil {
 		return nil, errors.New("Failed to get thing")
 	}
 
 	var itemHistory []string
-	json.Unmarshal(itemAsBytes, &itemHistory)
+	err = decodeJSON(itemKey(args[0]), itemAsBytes, &itemHistory)
+	if err != nil {
+		return nil, err
+	}
+	if len(itemHistory) == 0 {
+		return nil, errors.New("Did not find item " + args[0])
+	}
 
 	str := itemHistory[0]
 	res := Item{}
-	json.Unmarshal([]byte(str), &res)
+	err = decodeJSON(itemKey(args[0]), []byte(str), &res)
+	if err != nil {
+		return nil, err
+	}
 	newItem := res
+	newItem.Version = schemaVersion
 	
 	newItem.Owner = args[1]
 	newItem.Bill_num = args[2]
-	purchase_date := time.Now().UnixNano() / (int64(time.Millisecond)/int64(time.Nanosecond))
-	newItem.Date = strconv.FormatInt(purchase_date, 10)
+	newItem.Date, err = itemDate(stub)
+	if err != nil {
+		return nil, err
+	}
 	newItem.Seller = args[3]
 	trans_type := "first_sale"
 	newItem.Type = trans_type
@@ -338,7 +961,10 @@ func (t *SimpleChaincode) first_sale(stub *shim.ChaincodeStub, args []string) ([
 	newItemString, err := json.Marshal(newItem)
 	itemHistory = append(itemHistory, string(newItemString))
 	jsonAsBytes, _ := json.Marshal(itemHistory)
-	err = stub.PutState(args[0], jsonAsBytes)
+	err = stub.PutState(itemKey(args[0]), jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
 
 	// res := Item{}
 	// json.Unmarshal(itemAsBytes, &res)										//un stringify it aka JSON.parse()
@@ -353,39 +979,48 @@ func (t *SimpleChaincode) first_sale(stub *shim.ChaincodeStub, args []string) ([
 	// 	return nil, err
 	// }
 	
-	fmt.Println("- end set user")
+	logDebug("- end set user")
 	return nil, nil
 }
 //============================================================================================================================
 //Set User Permission on Marble
 //============================================================================================================================
-func (t *SimpleChaincode) resale_item(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+func (t *SimpleChaincode) resale_item(stub ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
 	
 	//   0       1           2 
 	// id       newOwner   newPrice
-	if len(args) < 3 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2")
-	}
 	
-	fmt.Println("- start set user")
-	fmt.Println(args[0] + " - " + args[1])
-	itemAsBytes, err := stub.GetState(args[0])
+	logDebug("- start set user")
+	logDebug(args[0] + " - " + args[1])
+	itemAsBytes, err := stub.GetState(itemKey(args[0]))
 	if err != nil {
 		return nil, errors.New("Failed to get thing")
 	}
 
 	var itemHistory []string
-	json.Unmarshal(itemAsBytes, &itemHistory)
+	err = decodeJSON(itemKey(args[0]), itemAsBytes, &itemHistory)
+	if err != nil {
+		return nil, err
+	}
+	if len(itemHistory) == 0 {
+		return nil, errors.New("Did not find item " + args[0])
+	}
 
 	str := itemHistory[0]
 	res := Item{}
-	json.Unmarshal([]byte(str), &res)
+	err = decodeJSON(itemKey(args[0]), []byte(str), &res)
+	if err != nil {
+		return nil, err
+	}
 	newItem := res
+	newItem.Version = schemaVersion
 	newItem.Owner = args[1]
 	newItem.Price = args[2]
-	purchase_date := time.Now().UnixNano() / (int64(time.Millisecond)/int64(time.Nanosecond))
-	newItem.Date = strconv.FormatInt(purchase_date, 10)
+	newItem.Date, err = itemDate(stub)
+	if err != nil {
+		return nil, err
+	}
 	trans_type := "resale_item"
 	newItem.Type = trans_type
 
@@ -393,7 +1028,10 @@ func (t *SimpleChaincode) resale_item(stub *shim.ChaincodeStub, args []string) (
 	newItemString, err := json.Marshal(newItem)
 	itemHistory = append(itemHistory, string(newItemString))
 	jsonAsBytes, _ := json.Marshal(itemHistory)
-	err = stub.PutState(args[0], jsonAsBytes)
+	err = stub.PutState(itemKey(args[0]), jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
 
 	// res := Item{}
 	// json.Unmarshal(itemAsBytes, &res)										//un stringify it aka JSON.parse()
@@ -408,37 +1046,45 @@ func (t *SimpleChaincode) resale_item(stub *shim.ChaincodeStub, args []string) (
 	// 	return nil, err
 	// }
 	
-	fmt.Println("- end set user")
+	logDebug("- end set user")
 	return nil, nil
 }
 
-func (t *SimpleChaincode) repair_item(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+func (t *SimpleChaincode) repair_item(stub ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
 	//   0     1        2
 	//  id   problem  fixes
 
-	if len(args) < 3 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2")
-	}
-	
-	fmt.Println("- start set user")
-	fmt.Println(args[0] + " - " + args[1])
-	itemAsBytes, err := stub.GetState(args[0])
+	logDebug("- start set user")
+	logDebug(args[0] + " - " + args[1])
+	itemAsBytes, err := stub.GetState(itemKey(args[0]))
 	if err != nil {
 		return nil, errors.New("Failed to get thing")
 	}
 
 	var itemHistory []string
-	json.Unmarshal(itemAsBytes, &itemHistory)
+	err = decodeJSON(itemKey(args[0]), itemAsBytes, &itemHistory)
+	if err != nil {
+		return nil, err
+	}
+	if len(itemHistory) == 0 {
+		return nil, errors.New("Did not find item " + args[0])
+	}
 
 	str := itemHistory[0]
 	res := Item{}
-	json.Unmarshal([]byte(str), &res)
+	err = decodeJSON(itemKey(args[0]), []byte(str), &res)
+	if err != nil {
+		return nil, err
+	}
 	newItem := res
+	newItem.Version = schemaVersion
 	newItem.Problem = args[1]
 	newItem.Fixes = args[2]
-	repair_date := time.Now().UnixNano() / (int64(time.Millisecond)/int64(time.Nanosecond))
-	newItem.Date = strconv.FormatInt(repair_date, 10)
+	newItem.Date, err = itemDate(stub)
+	if err != nil {
+		return nil, err
+	}
 	trans_type := "repair_item"
 	newItem.Type = trans_type
 
@@ -446,9 +1092,378 @@ func (t *SimpleChaincode) repair_item(stub *shim.ChaincodeStub, args []string) (
 	newItemString, err := json.Marshal(newItem)
 	itemHistory = append(itemHistory, string(newItemString))
 	jsonAsBytes, _ := json.Marshal(itemHistory)
-	err = stub.PutState(args[0], jsonAsBytes)
+	err = stub.PutState(itemKey(args[0]), jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
 
 	return nil,nil
 
+}
+
+// ============================================================================================================================
+// Scan Records - report every item history entry that does not parse
+// ============================================================================================================================
+func (t *SimpleChaincode) scan_records(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	broken, _, err := brokenItems(stub)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(broken)
+}
+
+// ============================================================================================================================
+// Repair Records - rewrite every broken history entry that can be rebuilt, returns what scan_records would have reported
+// ============================================================================================================================
+func (t *SimpleChaincode) repair_records(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	logDebug("- start repair records")
+	broken, repaired, err := brokenItems(stub)
+	if err != nil {
+		return nil, err
+	}
+	for id, itemHistory := range repaired{
+		jsonAsBytes, _ := json.Marshal(itemHistory)
+		err = stub.PutState(itemKey(id), jsonAsBytes)
+		if err != nil {
+			return nil, errors.New("Failed to rewrite item " + id)
+		}
+		logInfo("! repaired item " + id)
+	}
+	logDebug("- end repair records")
+	return json.Marshal(broken)
+}
+
+// ============================================================================================================================
+// brokenItems - every item history entry that does not parse, plus the history of each item with entries that could be rebuilt
+// ============================================================================================================================
+func brokenItems(stub ChaincodeStubInterface) ([]BrokenRecord, map[string][]string, error) {
+	itemsAsBytes, err := stub.GetState(itemIndexStr)
+	if err != nil {
+		return nil, nil, errors.New("Failed to get item index")
+	}
+	var itemIndex []string
+	err = decodeJSON(itemIndexStr, itemsAsBytes, &itemIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+	
+	broken := []BrokenRecord{}
+	repaired := make(map[string][]string)
+	for _, id := range itemIndex{
+		itemAsBytes, err := stub.GetState(itemKey(id))
+		if err != nil {
+			return nil, nil, errors.New("Failed to get item " + id)
+		}
+		if len(itemAsBytes) == 0 {
+			continue															//deleted, nothing to parse
+		}
+		var itemHistory []string
+		err = json.Unmarshal(itemAsBytes, &itemHistory)
+		if err != nil {
+			broken = append(broken, BrokenRecord{Key: id, Entry: -1, Error: err.Error()})
+			continue
+		}
+		fixed := false
+		for i, str := range itemHistory{
+			var res Item
+			err = json.Unmarshal([]byte(str), &res)
+			if err == nil {
+				continue
+			}
+			item, ok := parseLegacyItem(str)
+			broken = append(broken, BrokenRecord{Key: id, Entry: i, Error: err.Error(), Repairable: ok})
+			if ok {
+				itemString, _ := json.Marshal(item)
+				itemHistory[i] = string(itemString)
+				fixed = true
+			}
+		}
+		if fixed {
+			repaired[id] = itemHistory
+		}
+	}
+	return broken, repaired, nil
+}
+
+// ============================================================================================================================
+// parseLegacyItem - read a history entry written by the old init_item, which built the JSON by hand
+// ============================================================================================================================
+func parseLegacyItem(str string) (Item, bool) {
+	fields, ok := splitLegacy(str, []string{`{"id": "`, `", "name": "`, `", "owner": "`, `", "price": "`, `", "category": "`, `", "date": "`, `", "warranty_validity": "`, `", "company": "`, `", "seller": "`, `", "bill_num": "`, `", "type": "`, `", "problem": "`, `", "fixes": "`, `"}`})
+	if !ok {
+		return Item{}, false
+	}
+	return Item{Id: fields[0], Name: fields[1], Owner: fields[2], Price: fields[3], Category: fields[4], Date: fields[5], Warranty_validity: fields[6],
+		Company: fields[7], Seller: fields[8], Bill_num: fields[9], Type: fields[10], Problem: fields[11], Fixes: fields[12]}, true
+}
+
+// ============================================================================================================================
+// splitLegacy - the fields between seps in a record built by concatenating strings, as records were before
+//   they were marshalled, seps[0] must start it and the last sep end it
+// ============================================================================================================================
+func splitLegacy(str string, seps []string) ([]string, bool) {
+	first := seps[0]
+	last := seps[len(seps) - 1]
+	if len(str) < len(first) + len(last) || !strings.HasPrefix(str, first) || !strings.HasSuffix(str, last) {
+		return nil, false
+	}
+	rest := str[len(first):len(str) - len(last)]
+	var fields []string
+	for _, sep := range seps[1:len(seps) - 1]{
+		i := strings.Index(rest, sep)
+		if i < 0 {
+			return nil, false
+		}
+		fields = append(fields, rest[:i])
+		rest = rest[i + len(sep):]
+	}
+	return append(fields, rest), true
+}
+
+// ============================================================================================================================
+// Verify State - walk the item index and every item history, and report every value that does not decode
+// ============================================================================================================================
+func (t *SimpleChaincode) verify_state(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	problems := []BrokenRecord{}
+	var admins []string
+	problems, _, err := checkState(stub, adminIndexStr, &admins, problems)
+	if err != nil {
+		return nil, err
+	}
+	var itemIndex []string
+	problems, ok, err := checkState(stub, itemIndexStr, &itemIndex, problems)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		broken, _, err := brokenItems(stub)											//histories and their entries, with whether repair_records can fix them
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, broken...)
+	}
+	return json.Marshal(problems)
+}
+
+// ============================================================================================================================
+// checkState - decode the value under key into v, adding a BrokenRecord to problems when it does not decode
+// ============================================================================================================================
+func checkState(stub ChaincodeStubInterface, key string, v interface{}, problems []BrokenRecord) ([]BrokenRecord, bool, error) {
+	valueAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return problems, false, errors.New("Failed to get " + key)
+	}
+	err = decodeJSON(key, valueAsBytes, v)
+	if err != nil {
+		return append(problems, BrokenRecord{Key: key, Entry: -1, Error: err.Error()}), false, nil
+	}
+	return problems, true, nil
+}
+
+// ============================================================================================================================
+// decodeJSON - unmarshal the value stored under key into v, an empty value leaves v untouched
+//   anything that does not decode is an error naming the key, so a corrupt value is never mistaken for an empty one
+// ============================================================================================================================
+func decodeJSON(key string, valueAsBytes []byte, v interface{}) error {
+	if len(valueAsBytes) == 0 {
+		return nil
+	}
+	err := json.Unmarshal(valueAsBytes, v)
+	if err != nil {
+		return errors.New("Failed to decode " + key + ": " + err.Error())
+	}
+	return nil
+}
 
-}
\ No newline at end of file
+// ============================================================================================================================
+// logError, logInfo, logDebug - print a line like fmt.Println, if the log level is at least error, info or debug
+// ============================================================================================================================
+func logError(a ...interface{}) {
+	logAt(0, a...)
+}
+
+func logInfo(a ...interface{}) {
+	logAt(1, a...)
+}
+
+func logDebug(a ...interface{}) {
+	logAt(2, a...)
+}
+
+func logAt(level int, a ...interface{}) {
+	if level <= logLevel {
+		fmt.Println(append([]interface{}{"[" + logLevels[level] + "]"}, a...)...)
+	}
+}
+
+// ============================================================================================================================
+// parseLogLevel - the index in logLevels of a level name
+// ============================================================================================================================
+func parseLogLevel(name string) (int, error) {
+	for i, level := range logLevels{
+		if level == strings.ToLower(name) {
+			return i, nil
+		}
+	}
+	return 0, errors.New("log_level must be one of " + strings.Join(logLevels, ", "))
+}
+
+// ============================================================================================================================
+// loadLogLevel - pick up the level init stored, once after the chaincode starts
+// ============================================================================================================================
+func loadLogLevel(stub ChaincodeStubInterface) {
+	if logLevelLoaded {
+		return
+	}
+	logLevelLoaded = true
+	levelAsBytes, err := stub.GetState(logLevelStr)
+	if err != nil || len(levelAsBytes) == 0 {
+		return
+	}
+	level, err := parseLogLevel(string(levelAsBytes))
+	if err == nil {
+		logLevel = level
+	}
+}
+
+// ============================================================================================================================
+// getCaller - the user making this call, read from an attribute of the transaction certificate
+// ============================================================================================================================
+func getCaller(stub ChaincodeStubInterface) (string, error) {
+	userAsBytes, err := stub.ReadCertAttribute(callerAttr)
+	if err != nil || len(userAsBytes) == 0 {
+		return "", errors.New("Failed to read the " + callerAttr + " attribute of the caller's certificate")
+	}
+	return strings.ToLower(string(userAsBytes)), nil
+}
+
+// ============================================================================================================================
+// checkName - error if a user chosen name or key is in the reserved namespace of the chaincode's own keys
+// ============================================================================================================================
+func checkName(name string) error {
+	if strings.HasPrefix(name, reservedPrefix) {
+		return errors.New(name + " is reserved, names and keys can not start with " + reservedPrefix)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Item Key - the key a item history is stored under, kept apart from the keys write can reach
+// ============================================================================================================================
+func itemKey(id string) string {
+	return itemPrefix + id
+}
+
+// ============================================================================================================================
+// moveKey - move a value still stored under its old key to key, does nothing once it has moved
+// ============================================================================================================================
+func moveKey(stub ChaincodeStubInterface, oldKey string, key string) (bool, error) {
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return false, errors.New("Failed to get " + key)
+	}
+	if len(existing) != 0 {
+		return false, nil
+	}
+	valueAsBytes, err := stub.GetState(oldKey)
+	if err != nil {
+		return false, errors.New("Failed to get " + oldKey)
+	}
+	if len(valueAsBytes) == 0 {
+		return false, nil
+	}
+	err = stub.PutState(key, valueAsBytes)
+	if err != nil {
+		return false, err
+	}
+	err = stub.DelState(oldKey)
+	if err != nil {
+		return false, errors.New("Failed to delete " + oldKey)
+	}
+	return true, nil
+}
+
+// ============================================================================================================================
+// containsName - true if name is in names
+// ============================================================================================================================
+func containsName(names []string, name string) bool {
+	for _, n := range names{
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// removeName - names without name
+// ============================================================================================================================
+func removeName(names []string, name string) []string {
+	var kept []string
+	for _, n := range names{
+		if n != name {
+			kept = append(kept, n)
+		}
+	}
+	return kept
+}
+
+// ============================================================================================================================
+// getAdmins - the users allowed to call admin functions, set up by the first init
+// ============================================================================================================================
+func getAdmins(stub ChaincodeStubInterface) ([]string, error) {
+	adminsAsBytes, err := stub.GetState(adminIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get admins")
+	}
+	var admins []string
+	err = decodeJSON(adminIndexStr, adminsAsBytes, &admins)
+	if err != nil {
+		return nil, err
+	}
+	return admins, nil
+}
+
+// ============================================================================================================================
+// putAdmins - store the users allowed to call admin functions
+// ============================================================================================================================
+func putAdmins(stub ChaincodeStubInterface, admins []string) error {
+	jsonAsBytes, _ := json.Marshal(admins)
+	return stub.PutState(adminIndexStr, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// checkAdmin - error unless the caller is an admin. Until the first init stores an admin there are none and only init
+//   may run
+// ============================================================================================================================
+func checkAdmin(stub ChaincodeStubInterface, function string) error {
+	admins, err := getAdmins(stub)
+	if err != nil {
+		return err
+	}
+	if len(admins) == 0 {
+		if function == "init" {
+			return nil
+		}
+		return errors.New(function + " is restricted to admins and there are none yet, init sets up the first")
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return err
+	}
+	if !containsName(admins, caller) {
+		return errors.New(function + " is restricted to admins, " + caller + " is not one")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// itemDate - the date for a new item history entry, taken from the transaction so every peer writes the same history
+// ============================================================================================================================
+func itemDate(stub ChaincodeStubInterface) (string, error) {
+	date, err := stub.TxTimestamp()
+	if err != nil {
+		return "", errors.New("Failed to get transaction timestamp")
+	}
+	return strconv.FormatInt(date, 10), nil
+}
@@ -0,0 +1,407 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ibm-blockchain/marbles-chaincode/memstub"
+)
+
+var testAdmin = "boss"							//admin set up by newLedger's init
+
+// ============================================================================================================================
+// testLedger - the chaincode on an in-memory ledger, each invoke is its own transaction and rolls back when it fails
+// ============================================================================================================================
+type testLedger struct {
+	t *testing.T
+	stub *memstub.MemStub
+	cc *SimpleChaincode
+}
+
+// ============================================================================================================================
+// newLedger - a fresh ledger after the deploy init, with testAdmin as its only admin
+// ============================================================================================================================
+func newLedger(t *testing.T) *testLedger {
+	l := &testLedger{t: t, stub: memstub.NewMemStub(), cc: new(SimpleChaincode)}
+	l.as(testAdmin).mustInvoke("init", "1", testAdmin)
+	return l
+}
+
+// ============================================================================================================================
+// as - make the following calls as user
+// ============================================================================================================================
+func (l *testLedger) as(user string) *testLedger {
+	l.stub.SetCertAttribute(callerAttr, user)
+	return l
+}
+
+// ============================================================================================================================
+// invoke - run function as one transaction, like the peer does
+// ============================================================================================================================
+func (l *testLedger) invoke(function string, args ...string) ([]byte, error) {
+	return l.stub.Invoke(func() ([]byte, error) {
+		return l.cc.invoke(l.stub, function, args)
+	})
+}
+
+// ============================================================================================================================
+// mustInvoke - invoke and fail the test on error
+// ============================================================================================================================
+func (l *testLedger) mustInvoke(function string, args ...string) []byte {
+	l.t.Helper()
+	res, err := l.invoke(function, args...)
+	if err != nil {
+		l.t.Fatalf("%s %v: %v", function, args, err)
+	}
+	return res
+}
+
+// ============================================================================================================================
+// mustFail - invoke and fail the test unless it errors with a message containing want
+// ============================================================================================================================
+func (l *testLedger) mustFail(want string, function string, args ...string) error {
+	l.t.Helper()
+	_, err := l.invoke(function, args...)
+	if err == nil {
+		l.t.Fatalf("%s %v should have failed", function, args)
+	}
+	if !strings.Contains(err.Error(), want) {
+		l.t.Fatalf("%s %v failed with %q, want %q", function, args, err, want)
+	}
+	return err
+}
+
+// ============================================================================================================================
+// query - run a query and fail the test on error
+// ============================================================================================================================
+func (l *testLedger) query(function string, args ...string) string {
+	l.t.Helper()
+	res, err := l.cc.query(l.stub, function, args)
+	if err != nil {
+		l.t.Fatalf("%s %v: %v", function, args, err)
+	}
+	return string(res)
+}
+
+// ============================================================================================================================
+// history - an item's history as stored, oldest entry first
+// ============================================================================================================================
+func (l *testLedger) history(id string) []Item {
+	l.t.Helper()
+	var entries []string
+	var history []Item
+	err := json.Unmarshal([]byte(l.state(itemKey(id))), &entries)
+	if err != nil {
+		l.t.Fatalf("history of %s: %v", id, err)
+	}
+	for _, entry := range entries {
+		var item Item
+		err = json.Unmarshal([]byte(entry), &item)
+		if err != nil {
+			l.t.Fatalf("history entry of %s: %v", id, err)
+		}
+		history = append(history, item)
+	}
+	return history
+}
+
+// ============================================================================================================================
+// state - the raw value of a key, empty when it is missing
+// ============================================================================================================================
+func (l *testLedger) state(key string) string {
+	valAsbytes, _ := l.stub.GetState(key)
+	return string(valAsbytes)
+}
+
+// ============================================================================================================================
+// TestItemHistory - every sale and repair appends to the item's history
+// ============================================================================================================================
+func TestItemHistory(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_item", "i1", "tv", "sony", "100", "2y", "electronics")
+	l.mustInvoke("first_sale", "i1", "bob", "b1", "shop")
+	l.mustInvoke("repair_item", "i1", "broken screen", "new screen")
+	l.mustInvoke("resale_item", "i1", "alice", "50")
+
+	history := l.history("i1")
+	if len(history) != 4 {
+		t.Fatalf("i1 has %d history entries, want 4", len(history))
+	}
+	for i, want := range []string{"manufacture", "first_sale", "repair_item", "resale_item"} {
+		if history[i].Type != want {
+			t.Fatalf("entry %d of i1 is a %s, want %s", i, history[i].Type, want)
+		}
+	}
+	if history[1].Owner != "bob" || history[3].Owner != "alice" || history[3].Price != "50" {
+		t.Fatalf("history of i1 = %+v", history)
+	}
+	if res := l.query("read", "_itemindex"); res != `["i1"]` {
+		t.Fatalf("_itemindex = %s", res)
+	}
+	l.mustFail("unknown function", "no_such_function")
+}
+
+// ============================================================================================================================
+// TestFailedInvokeLeavesNoTrace - an invoke that errors changes nothing
+// ============================================================================================================================
+func TestFailedInvokeLeavesNoTrace(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_item", "i1", "tv", "sony", "100", "2y", "electronics")
+	before := l.stub.Keys()
+
+	l.mustFail("Did not find item", "first_sale", "i2", "bob", "b1", "shop")
+	l.mustFail("This marble arleady exists", "init_item", "i1", "radio", "sony", "10", "1y", "electronics")
+	if after := l.stub.Keys(); strings.Join(after, ",") != strings.Join(before, ",") {
+		t.Fatalf("keys went from %v to %v", before, after)
+	}
+	if len(l.history("i1")) != 1 {
+		t.Fatal("failed calls changed the history of i1")
+	}
+}
+
+// ============================================================================================================================
+// failingStub - an in-memory ledger that refuses to write key, to see write errors come back out of the functions
+// ============================================================================================================================
+type failingStub struct {
+	*memstub.MemStub
+	key string
+}
+
+func (s failingStub) PutState(key string, value []byte) error {
+	if key == s.key {
+		return errors.New("refused to write " + key)
+	}
+	return s.MemStub.PutState(key, value)
+}
+
+func (s failingStub) DelState(key string) error {
+	if key == s.key {
+		return errors.New("refused to delete " + key)
+	}
+	return s.MemStub.DelState(key)
+}
+
+// ============================================================================================================================
+// TestItemDates - history entries are dated from the transaction, so every peer writes the same history
+// ============================================================================================================================
+func TestItemDates(t *testing.T) {
+	l := newLedger(t)
+	l.stub.SetTxTimestamp(1500000000000)
+	l.mustInvoke("init_item", "i1", "tv", "sony", "100", "2y", "electronics")
+	l.mustInvoke("first_sale", "i1", "bob", "b1", "shop")
+
+	history := l.history("i1")
+	if history[0].Date != "1500000001000" || history[1].Date != "1500000002000" {
+		t.Fatalf("i1 is dated %s and %s, want the transaction timestamps", history[0].Date, history[1].Date)
+	}
+}
+
+// ============================================================================================================================
+// TestWriteErrors - a failed write fails the function instead of reporting success
+// ============================================================================================================================
+func TestWriteErrors(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_item", "i1", "tv", "sony", "100", "2y", "electronics")
+
+	calls := []struct{
+		function string
+		args []string
+		key string
+	}{
+		{"init_item", []string{"i2", "tv", "sony", "100", "2y", "electronics"}, itemKey("i2")},
+		{"init_item", []string{"i2", "tv", "sony", "100", "2y", "electronics"}, itemIndexStr},
+		{"first_sale", []string{"i1", "bob", "b1", "shop"}, itemKey("i1")},
+		{"resale_item", []string{"i1", "alice", "50"}, itemKey("i1")},
+		{"repair_item", []string{"i1", "broken", "fixed"}, itemKey("i1")},
+		{"delete", []string{"i1"}, itemKey("i1")},
+		{"delete", []string{"i1"}, itemIndexStr},
+	}
+	for _, call := range calls {
+		stub := failingStub{l.stub, call.key}
+		_, err := l.stub.Invoke(func() ([]byte, error) {
+			return l.cc.invoke(stub, call.function, call.args)
+		})
+		if err == nil {
+			t.Fatalf("%s succeeded with %s refused", call.function, call.key)
+		}
+	}
+	if len(l.history("i1")) != 1 {
+		t.Fatal("a failed call changed the history of i1")
+	}
+}
+
+// ============================================================================================================================
+// TestQuotedNames - fields with quotes are stored as valid JSON, and history entries the old hand built JSON broke are
+//   reported by scan_records and rebuilt by repair_records
+// ============================================================================================================================
+func TestQuotedNames(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_item", "i1", `the "best" tv`, `sony\japan`, "100", "2y", "electronics")
+	if history := l.history("i1"); history[0].Name != `the "best" tv` || history[0].Company != `sony\japan` {
+		t.Fatalf("history of i1 = %+v", history)
+	}
+
+	legacy := `{"id": "i2", "name": "12" tv", "owner": "", "price": "10", "category": "electronics", "date": "", "warranty_validity": "1y", "company": "acme", "seller": "", "bill_num": "", "type": "manufacture", "problem": "", "fixes": ""}`
+	entries, _ := json.Marshal([]string{legacy, "not json"})
+	l.stub.PutState(itemKey("i2"), entries)
+	ids, _ := json.Marshal([]string{"i1", "i2"})
+	l.stub.PutState(itemIndexStr, ids)
+
+	var broken []BrokenRecord
+	json.Unmarshal([]byte(l.query("scan_records")), &broken)
+	if len(broken) != 2 || broken[0].Entry != 0 || !broken[0].Repairable || broken[1].Entry != 1 || broken[1].Repairable {
+		t.Fatalf("scan_records = %+v", broken)
+	}
+	l.as(testAdmin).mustInvoke("repair_records")
+	var stored []string
+	json.Unmarshal([]byte(l.state(itemKey("i2"))), &stored)
+	var item Item
+	if len(stored) != 2 || json.Unmarshal([]byte(stored[0]), &item) != nil || item.Name != `12" tv` || stored[1] != "not json" {
+		t.Fatalf("history of i2 after repair_records = %q", stored)
+	}
+}
+
+// ============================================================================================================================
+// TestDecodeErrors - a corrupt item history aborts the invocation instead of being overwritten, and verify_state
+//   reports it
+// ============================================================================================================================
+func TestDecodeErrors(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_item", "i1", "tv", "sony", "100", "2y", "electronics")
+	if got := l.query("verify_state"); got != "[]" {
+		t.Fatalf("verify_state on a healthy ledger = %s", got)
+	}
+
+	l.stub.PutState(itemKey("i1"), []byte("[broken"))
+	l.mustFail("Failed to decode " + itemKey("i1"), "first_sale", "i1", "bob", "b1", "shop")
+	if got := l.state(itemKey("i1")); got != "[broken" {
+		t.Fatalf("a failed first_sale overwrote the corrupt history with %q", got)
+	}
+	var problems []BrokenRecord
+	json.Unmarshal([]byte(l.query("verify_state")), &problems)
+	if len(problems) != 1 || problems[0].Key != "i1" || problems[0].Entry != -1 {
+		t.Fatalf("verify_state = %+v", problems)
+	}
+}
+
+// ============================================================================================================================
+// TestJSONArgs - a single JSON object argument names the arguments, and works the same as the positional form
+// ============================================================================================================================
+func TestJSONArgs(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_item", `{"id": "i1", "name": "tv", "company": "sony", "price": 100, "warranty": "2y", "category": "electronics"}`)
+	l.mustInvoke("first_sale", `{"id": "i1", "owner": "bob", "bill_num": "b1", "seller": "shop"}`)
+	history := l.history("i1")
+	if len(history) != 2 || history[0].Price != "100" || history[1].Owner != "bob" || history[1].Bill_num != "b1" {
+		t.Fatalf("history of i1 = %+v", history)
+	}
+	l.mustFail("first_sale has no argument named buyer", "first_sale", `{"id": "i1", "buyer": "bob"}`)
+}
+
+// ============================================================================================================================
+// TestAdmins - init, write and delete are restricted to admins, who are managed with add_admin and remove_admin
+// ============================================================================================================================
+func TestAdmins(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_item", "i1", "tv", "sony", "100", "2y", "electronics")
+	for _, c := range [][]string{{"init", "1"}, {"write", "abc", "2"}, {"delete", "i1"}, {"add_admin", "eve"}} {
+		l.as("eve").mustFail("is restricted to admins, eve is not one", c[0], c[1:]...)
+	}
+	l.as(testAdmin).mustInvoke("add_admin", "amy")
+	l.as("amy").mustInvoke("remove_admin", testAdmin)
+	l.mustFail("Can not remove the last admin", "remove_admin", "amy")
+	l.mustInvoke("delete", "i1")
+	if got := l.state(itemKey("i1")); got != "" {
+		t.Fatalf("i1 is still stored after delete: %s", got)
+	}
+}
+
+// ============================================================================================================================
+// TestReservedKeys - write, delete and init_item refuse names in the reserved namespace
+// ============================================================================================================================
+func TestReservedKeys(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_item", "i1", "tv", "sony", "100", "2y", "electronics")
+	index := l.state(itemIndexStr)
+	for _, c := range [][]string{{"write", itemIndexStr, "[]"}, {"delete", itemIndexStr}, {"init_item", "_i2", "tv", "sony", "100", "2y", "electronics"}} {
+		l.mustFail("is reserved", c[0], c[1:]...)
+	}
+	if got := l.state(itemIndexStr); got != index {
+		t.Fatalf("_itemindex = %s, want %s", got, index)
+	}
+	l.mustInvoke("write", "i1", "plain value")
+	if history := l.history("i1"); len(history) != 1 || history[0].Name != "tv" {
+		t.Fatalf("write clobbered item i1: %+v", history)
+	}
+}
+
+// ============================================================================================================================
+// TestReinit - init on a populated ledger keeps the items, only an admin's forced init wipes them
+// ============================================================================================================================
+func TestReinit(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_item", "i1", "tv", "sony", "100", "2y", "electronics")
+	l.mustInvoke("init", "1")
+	if history := l.history("i1"); len(history) != 1 {
+		t.Fatalf("history of i1 after re-init = %+v", history)
+	}
+	l.as("eve").mustFail("is restricted to admins", "init", "1", "", "true")
+	l.as(testAdmin).mustInvoke("init", "1", "", "true")
+	if got := l.state(itemKey("i1")); got != "" {
+		t.Fatalf("i1 = %s after a forced init", got)
+	}
+	var index []string
+	if got := l.state(itemIndexStr); json.Unmarshal([]byte(got), &index) != nil || len(index) != 0 {
+		t.Fatalf("_itemindex = %s after a forced init", got)
+	}
+}
+
+// ============================================================================================================================
+// TestFirstAdmin - until there is an admin only init runs, and on a ledger that already has items only the deploy can
+//   name the first admin
+// ============================================================================================================================
+func TestFirstAdmin(t *testing.T) {
+	l := &testLedger{t: t, stub: memstub.NewMemStub(), cc: new(SimpleChaincode)}
+	l.as("eve").mustInvoke("init_item", "i1", "tv", "sony", "100", "2y", "electronics")	//written before admins existed
+	l.mustFail("write is restricted to admins and there are none yet", "write", "abc", "1")
+	l.mustFail("only the deploy can name the first admin", "init", "1", "eve")
+	l.mustInvoke("init", "1")
+	if got := l.state(adminIndexStr); got != "" {
+		t.Fatalf("init on a ledger with items set up the admins %s", got)
+	}
+
+	_, err := l.stub.Invoke(func() ([]byte, error) {
+		return l.cc.deploy(l.stub, []string{"1", testAdmin})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := l.state(adminIndexStr); got != `["` + testAdmin + `"]` {
+		t.Fatalf("admins after the deploy = %s", got)
+	}
+	if history := l.history("i1"); len(history) != 1 {
+		t.Fatalf("history of i1 after the deploy = %+v", history)
+	}
+}
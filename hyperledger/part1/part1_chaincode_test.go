@@ -0,0 +1,409 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ibm-blockchain/marbles-chaincode/memstub"
+)
+
+var testAdmin = "boss"							//admin set up by newLedger's init
+
+// ============================================================================================================================
+// testLedger - the chaincode on an in-memory ledger, each invoke is its own transaction and rolls back when it fails
+// ============================================================================================================================
+type testLedger struct {
+	t *testing.T
+	stub *memstub.MemStub
+	cc *SimpleChaincode
+}
+
+// ============================================================================================================================
+// newLedger - a fresh ledger after the deploy init, with testAdmin as its only admin
+// ============================================================================================================================
+func newLedger(t *testing.T) *testLedger {
+	l := newBareLedger(t)
+	l.as(testAdmin).mustInvoke("init", "1", testAdmin)
+	return l
+}
+
+// ============================================================================================================================
+// newBareLedger - an empty ledger that has not seen init, to lay out one written by an older version of the chaincode
+// ============================================================================================================================
+func newBareLedger(t *testing.T) *testLedger {
+	return &testLedger{t: t, stub: memstub.NewMemStub(), cc: new(SimpleChaincode)}
+}
+
+// ============================================================================================================================
+// as - make the following calls as user
+// ============================================================================================================================
+func (l *testLedger) as(user string) *testLedger {
+	l.stub.SetCertAttribute(callerAttr, user)
+	return l
+}
+
+// ============================================================================================================================
+// invoke - run function as one transaction, like the peer does
+// ============================================================================================================================
+func (l *testLedger) invoke(function string, args ...string) ([]byte, error) {
+	return l.stub.Invoke(func() ([]byte, error) {
+		return l.cc.invoke(l.stub, function, args)
+	})
+}
+
+// ============================================================================================================================
+// mustInvoke - invoke and fail the test on error
+// ============================================================================================================================
+func (l *testLedger) mustInvoke(function string, args ...string) []byte {
+	l.t.Helper()
+	res, err := l.invoke(function, args...)
+	if err != nil {
+		l.t.Fatalf("%s %v: %v", function, args, err)
+	}
+	return res
+}
+
+// ============================================================================================================================
+// mustFail - invoke and fail the test unless it errors with a message containing want
+// ============================================================================================================================
+func (l *testLedger) mustFail(want string, function string, args ...string) error {
+	l.t.Helper()
+	_, err := l.invoke(function, args...)
+	if err == nil {
+		l.t.Fatalf("%s %v should have failed", function, args)
+	}
+	if !strings.Contains(err.Error(), want) {
+		l.t.Fatalf("%s %v failed with %q, want %q", function, args, err, want)
+	}
+	return err
+}
+
+// ============================================================================================================================
+// query - run a query and fail the test on error
+// ============================================================================================================================
+func (l *testLedger) query(function string, args ...string) string {
+	l.t.Helper()
+	res, err := l.cc.query(l.stub, function, args)
+	if err != nil {
+		l.t.Fatalf("%s %v: %v", function, args, err)
+	}
+	return string(res)
+}
+
+// ============================================================================================================================
+// marble - a marble as stored, failing the test when it is missing
+// ============================================================================================================================
+func (l *testLedger) marble(name string) Marble {
+	l.t.Helper()
+	res, err := getMarble(l.stub, name)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	return res
+}
+
+// ============================================================================================================================
+// owner - fail the test unless marble name belongs to user
+// ============================================================================================================================
+func (l *testLedger) owner(name string, user string) {
+	l.t.Helper()
+	if got := l.marble(name).User; got != user {
+		l.t.Fatalf("%s belongs to %q, want %q", name, got, user)
+	}
+}
+
+// ============================================================================================================================
+// state - the raw value of a key, empty when it is missing
+// ============================================================================================================================
+func (l *testLedger) state(key string) string {
+	valAsbytes, _ := l.stub.GetState(key)
+	return string(valAsbytes)
+}
+
+// ============================================================================================================================
+// TestInitMarble - a new marble can be read back, and unknown functions are refused
+// ============================================================================================================================
+func TestInitMarble(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+
+	m := l.marble("m1")
+	if m.Color != "blue" || m.Size != 16 || m.User != "bob" {
+		t.Fatalf("m1 = %+v", m)
+	}
+	if res := l.query("read", "m1"); !strings.Contains(res, `"user":"bob"`) {
+		t.Fatalf("read m1 = %s", res)
+	}
+	if res := l.query("read", "_marbleindex"); res != `["m1"]` {
+		t.Fatalf("_marbleindex = %s", res)
+	}
+	l.mustFail("unknown function", "no_such_function")
+}
+
+// ============================================================================================================================
+// TestFailedInvokeLeavesNoTrace - an invoke that errors changes nothing
+// ============================================================================================================================
+func TestFailedInvokeLeavesNoTrace(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+	before := l.stub.Keys()
+
+	l.mustFail("init_marble expects 4 arguments", "init_marble", "m2", "blue")
+	l.as("carol").mustFail("carol", "set_user", "m1", "carol")
+	if after := l.stub.Keys(); strings.Join(after, ",") != strings.Join(before, ",") {
+		t.Fatalf("keys went from %v to %v", before, after)
+	}
+	l.owner("m1", "bob")
+}
+
+// ============================================================================================================================
+// TestInitMarbleRejectsExisting - init_marble can not take over a marble that already exists
+// ============================================================================================================================
+func TestInitMarbleRejectsExisting(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+
+	l.as("eve").mustFail("arleady exists", "init_marble", "m1", "red", "35", "eve")
+	l.owner("m1", "bob")
+	if res := l.query("read", "_marbleindex"); res != `["m1"]` {
+		t.Fatalf("_marbleindex = %s", res)
+	}
+	if history, _ := getHistory(l.stub, "m1"); len(history) != 1 {
+		t.Fatalf("history of m1 = %+v, want only its creation", history)
+	}
+
+	l.stub.PutState("old", []byte(`{"name":"old","color":"red","size":3,"user":"bob"}`))		//from before marbles had their own keys
+	l.stub.PutState(marbleIndexStr, []byte(`["m1","old"]`))
+	l.mustFail("arleady exists", "init_marble", "old", "red", "35", "eve")
+}
+
+// ============================================================================================================================
+// TestSetUserChecksOwner - only the owner of a marble can give it away
+// ============================================================================================================================
+func TestSetUserChecksOwner(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+
+	l.as("eve").mustFail("eve", "set_user", "m1", "eve")
+	l.owner("m1", "bob")
+	l.as("Bob").mustInvoke("set_user", "m1", "alice")
+	l.owner("m1", "alice")
+	l.as("bob").mustFail("bob", "set_user", "m1", "bob")
+	l.stub.SetCertAttribute(callerAttr, "")
+	l.mustFail("attribute", "set_user", "m1", "bob")
+}
+
+// ============================================================================================================================
+// TestSetUserMissingMarble - set_user on a marble that does not exist fails with a MarbleNotFoundError and writes nothing
+// ============================================================================================================================
+func TestSetUserMissingMarble(t *testing.T) {
+	l := newLedger(t)
+	before := l.stub.Keys()
+
+	err := l.as("bob").mustFail("does not exist", "set_user", "nope", "bob")
+	if notFound, ok := err.(*MarbleNotFoundError); !ok || notFound.Name != "nope" {
+		t.Fatalf("set_user failed with %#v, want a MarbleNotFoundError", err)
+	}
+	if after := l.stub.Keys(); strings.Join(after, ",") != strings.Join(before, ",") {
+		t.Fatalf("keys went from %v to %v", before, after)
+	}
+}
+
+// ============================================================================================================================
+// TestIndexes - the owner and color indexes follow marbles as they are created, handed over and deleted
+// ============================================================================================================================
+func TestIndexes(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+	l.mustInvoke("init_marble", "m2", "blue", "16", "alice")
+	if l.state(ownerKey("bob")) != `["m1"]` || l.state(colorSizeKey("blue", 16)) != `["m1","m2"]` || l.state(colorKey("blue")) != `["m1","m2"]` {
+		t.Fatalf("indexes after init_marble: %s %s %s", l.state(ownerKey("bob")), l.state(colorSizeKey("blue", 16)), l.state(colorKey("blue")))
+	}
+
+	l.as("bob").mustInvoke("set_user", "m1", "Alice")
+	if l.state(ownerKey("bob")) != `[]` || l.state(ownerKey("alice")) != `["m2","m1"]` {
+		t.Fatalf("owner indexes after set_user: bob %s alice %s", l.state(ownerKey("bob")), l.state(ownerKey("alice")))
+	}
+	l.as(testAdmin).mustInvoke("delete", "m2")
+	if l.state(ownerKey("alice")) != `["m1"]` || l.state(colorSizeKey("blue", 16)) != `["m1"]` {
+		t.Fatalf("indexes after delete: %s %s", l.state(ownerKey("alice")), l.state(colorSizeKey("blue", 16)))
+	}
+}
+
+// ============================================================================================================================
+// TestRebuildIndexes - rebuild_indexes empties stale keys and leaves out marbles that do not decode instead of failing
+// ============================================================================================================================
+func TestRebuildIndexes(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+	l.mustInvoke("init_marble", "m2", "red", "35", "alice")
+	l.stub.PutState(marbleKey("m1"), []byte(`{"name":"m1","color":"blue","size":16,"user":"carol","version":2}`))	//changed behind the indexes' back
+	l.stub.PutState(marbleKey("m2"), []byte(`{nope`))
+	l.stub.DelState(colorKey("blue"))
+
+	res := l.as(testAdmin).mustInvoke("rebuild_indexes")
+	if string(res) != `["m2"]` {
+		t.Fatalf("rebuild_indexes returned %s, want the broken m2", res)
+	}
+	if l.state(ownerKey("bob")) != `[]` || l.state(ownerKey("alice")) != `[]` {
+		t.Fatalf("stale owner keys: bob %s alice %s", l.state(ownerKey("bob")), l.state(ownerKey("alice")))
+	}
+	if l.state(ownerKey("carol")) != `["m1"]` || l.state(colorKey("blue")) != `["m1"]` || l.state(colorKey("red")) != `[]` {
+		t.Fatalf("rebuilt indexes: carol %s blue %s red %s", l.state(ownerKey("carol")), l.state(colorKey("blue")), l.state(colorKey("red")))
+	}
+	if res := l.query("marbles_by_owner", "carol"); !strings.Contains(res, `"name":"m1"`) {
+		t.Fatalf("marbles_by_owner carol = %s", res)
+	}
+}
+
+// ============================================================================================================================
+// TestMigrateRebuildsIndexes - migrate rebuilds the indexes after upgrading the marbles, queries look through every
+//   marble until it has
+// ============================================================================================================================
+func TestMigrateRebuildsIndexes(t *testing.T) {
+	l := newLedger(t)
+	for _, name := range []string{"a", "b", "c"} {
+		l.stub.PutState(marbleKey(name), []byte(`{"name":"` + name + `","color":"Blue","size":3,"user":"Bob"}`))
+	}
+	l.stub.PutState(marbleIndexStr, []byte(`["a","b","c"]`))
+	l.stub.DelState(schemaVersionStr)													//as if written before versions existed
+
+	if res := l.query("marbles_by_owner", "bob"); strings.Count(res, `"name"`) != 3 {
+		t.Fatalf("marbles_by_owner bob before migrate = %s", res)
+	}
+	l.as(testAdmin).mustInvoke("migrate", "2")
+	if res := l.query("marbles_by_color", "blue"); strings.Count(res, `"name"`) != 3 {
+		t.Fatalf("marbles_by_color blue part way through migrate = %s", res)
+	}
+	for i := 0; i < 5 && l.state(schemaVersionStr) == ""; i++ {
+		l.mustInvoke("migrate", "2")
+	}
+	if l.state(schemaVersionStr) == "" {
+		t.Fatal("migrate did not finish")
+	}
+	if l.state(ownerKey("bob")) != `["a","b","c"]` || l.state(colorSizeKey("blue", 3)) != `["a","b","c"]` {
+		t.Fatalf("indexes after migrate: %s %s", l.state(ownerKey("bob")), l.state(colorSizeKey("blue", 3)))
+	}
+}
+
+// ============================================================================================================================
+// TestMarbleQueries - marbles by owner, color and size come back a page at a time in name order
+// ============================================================================================================================
+func TestMarbleQueries(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "c", "blue", "16", "bob")
+	l.mustInvoke("init_marble", "a", "blue", "20", "bob")
+	l.mustInvoke("init_marble", "b", "blue", "35", "bob")
+	l.mustInvoke("init_marble", "d", "red", "16", "alice")
+
+	names := func(res string) string {
+		var marbles []Marble
+		err := json.Unmarshal([]byte(res), &marbles)
+		if err != nil {
+			t.Fatalf("%s: %v", res, err)
+		}
+		var found []string
+		for _, m := range marbles {
+			found = append(found, m.Name)
+		}
+		return strings.Join(found, ",")
+	}
+	if got := names(l.query("marbles_by_owner", "BOB")); got != "a,b,c" {
+		t.Fatalf("marbles_by_owner BOB = %s", got)
+	}
+	if got := names(l.query("marbles_by_owner", "bob", "a", "1")); got != "b" {
+		t.Fatalf("second page of bob's marbles = %s", got)
+	}
+	if got := names(l.query("marbles_by_color", "blue", "", "2")); got != "a,b" {
+		t.Fatalf("first 2 blue marbles = %s", got)
+	}
+	if got := names(l.query("marbles_matching", "blue", "16", "20")); got != "a,c" {
+		t.Fatalf("blue marbles of size 16 to 20 = %s", got)
+	}
+	if res := l.query("marbles_by_owner", "nobody"); res != "[]" {
+		t.Fatalf("marbles_by_owner nobody = %s", res)
+	}
+	if _, err := l.cc.query(l.stub, "marbles_by_owner", []string{"bob", "", "0"}); err == nil {
+		t.Fatal("a limit of 0 should be refused")
+	}
+}
+
+// ============================================================================================================================
+// TestEvents - creating, transferring and deleting a marble each set one event
+// ============================================================================================================================
+func TestEvents(t *testing.T) {
+	l := newLedger(t)
+	steps := []struct{
+		function string
+		args []string
+		name string
+		want MarbleEvent
+	}{
+		{"init_marble", []string{"m1", "blue", "16", "bob"}, "marble_created", MarbleEvent{Marble: "m1", NewOwner: "bob"}},
+		{"set_user", []string{"m1", "amy"}, "marble_transferred", MarbleEvent{Marble: "m1", OldOwner: "bob", NewOwner: "amy"}},
+		{"delete", []string{"m1"}, "marble_deleted", MarbleEvent{Marble: "m1", OldOwner: "amy"}},
+	}
+	for _, step := range steps {
+		l.stub.ClearEvents()
+		l.as(testAdmin)
+		if step.function == "set_user" {
+			l.as("bob")
+		}
+		l.mustInvoke(step.function, step.args...)
+		events := l.stub.Events()
+		if len(events) != 1 || events[0].Name != step.name {
+			t.Fatalf("%s set %v, want one %s", step.function, events, step.name)
+		}
+		var ev MarbleEvent
+		json.Unmarshal(events[0].Payload, &ev)
+		if ev.Marble != step.want.Marble || ev.OldOwner != step.want.OldOwner || ev.NewOwner != step.want.NewOwner {
+			t.Fatalf("%s event = %+v, want %+v", step.function, ev, step.want)
+		}
+	}
+}
+
+// ============================================================================================================================
+// TestMarbleHistory - creation and every set_user append an entry to the marble's history
+// ============================================================================================================================
+func TestMarbleHistory(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+	l.as("bob").mustInvoke("set_user", "m1", "amy")
+	l.as("amy").mustInvoke("set_user", "m1", "bob")
+
+	var history []Transfer
+	err := json.Unmarshal([]byte(l.query("marble_history", "m1")), &history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := []string{"bob", "amy", "bob"}
+	if len(history) != len(owners) || history[0].From != "" || history[0].Reason != "init_marble" {
+		t.Fatalf("history of m1 = %+v", history)
+	}
+	for i := range owners {
+		if history[i].To != owners[i] || (i > 0 && (history[i].From != owners[i - 1] || history[i].Reason != "set_user")) {
+			t.Fatalf("history of m1 entry %d = %+v", i, history[i])
+		}
+	}
+}
@@ -0,0 +1,1306 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ibm-blockchain/marbles-chaincode/memstub"
+)
+
+var testAdmin = "boss"							//admin set up by newLedger's init
+
+// ============================================================================================================================
+// testLedger - the chaincode on an in-memory ledger, each invoke is its own transaction and rolls back when it fails
+// ============================================================================================================================
+type testLedger struct {
+	t *testing.T
+	stub *memstub.MemStub
+	cc *SimpleChaincode
+}
+
+// ============================================================================================================================
+// newLedger - a fresh ledger after the deploy init, with testAdmin as its only admin
+// ============================================================================================================================
+func newLedger(t *testing.T) *testLedger {
+	l := newBareLedger(t)
+	l.as(testAdmin).mustInvoke("init", "1", testAdmin)
+	return l
+}
+
+// ============================================================================================================================
+// newBareLedger - an empty ledger that has not seen init, to lay out one written by an older version of the chaincode
+// ============================================================================================================================
+func newBareLedger(t *testing.T) *testLedger {
+	return &testLedger{t: t, stub: memstub.NewMemStub(), cc: new(SimpleChaincode)}
+}
+
+// ============================================================================================================================
+// as - make the following calls as user
+// ============================================================================================================================
+func (l *testLedger) as(user string) *testLedger {
+	l.stub.SetCertAttribute(callerAttr, user)
+	return l
+}
+
+// ============================================================================================================================
+// invoke - run function as one transaction, like the peer does
+// ============================================================================================================================
+func (l *testLedger) invoke(function string, args ...string) ([]byte, error) {
+	return l.stub.Invoke(func() ([]byte, error) {
+		return l.cc.invoke(l.stub, function, args)
+	})
+}
+
+// ============================================================================================================================
+// mustInvoke - invoke and fail the test on error
+// ============================================================================================================================
+func (l *testLedger) mustInvoke(function string, args ...string) []byte {
+	l.t.Helper()
+	res, err := l.invoke(function, args...)
+	if err != nil {
+		l.t.Fatalf("%s %v: %v", function, args, err)
+	}
+	return res
+}
+
+// ============================================================================================================================
+// mustFail - invoke and fail the test unless it errors with a message containing want
+// ============================================================================================================================
+func (l *testLedger) mustFail(want string, function string, args ...string) error {
+	l.t.Helper()
+	_, err := l.invoke(function, args...)
+	if err == nil {
+		l.t.Fatalf("%s %v should have failed", function, args)
+	}
+	if !strings.Contains(err.Error(), want) {
+		l.t.Fatalf("%s %v failed with %q, want %q", function, args, err, want)
+	}
+	return err
+}
+
+// ============================================================================================================================
+// query - run a query and fail the test on error
+// ============================================================================================================================
+func (l *testLedger) query(function string, args ...string) string {
+	l.t.Helper()
+	res, err := l.cc.query(l.stub, function, args)
+	if err != nil {
+		l.t.Fatalf("%s %v: %v", function, args, err)
+	}
+	return string(res)
+}
+
+// ============================================================================================================================
+// marble - a marble as stored, failing the test when it is missing
+// ============================================================================================================================
+func (l *testLedger) marble(name string) Marble {
+	l.t.Helper()
+	res, err := getMarble(l.stub, name)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	return res
+}
+
+// ============================================================================================================================
+// owner - fail the test unless marble name belongs to user
+// ============================================================================================================================
+func (l *testLedger) owner(name string, user string) {
+	l.t.Helper()
+	if got := l.marble(name).User; got != user {
+		l.t.Fatalf("%s belongs to %q, want %q", name, got, user)
+	}
+}
+
+// ============================================================================================================================
+// state - the raw value of a key, empty when it is missing
+// ============================================================================================================================
+func (l *testLedger) state(key string) string {
+	valAsbytes, _ := l.stub.GetState(key)
+	return string(valAsbytes)
+}
+
+// ============================================================================================================================
+// TestInitMarble - a new marble can be read back, and unknown functions are refused
+// ============================================================================================================================
+func TestInitMarble(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+
+	m := l.marble("m1")
+	if m.Color != "blue" || m.Size != 16 || m.User != "bob" {
+		t.Fatalf("m1 = %+v", m)
+	}
+	if res := l.query("read", "m1"); !strings.Contains(res, `"user":"bob"`) {
+		t.Fatalf("read m1 = %s", res)
+	}
+	if res := l.query("read", "_marbleindex"); res != `["m1"]` {
+		t.Fatalf("_marbleindex = %s", res)
+	}
+	l.mustFail("unknown function", "no_such_function")
+	if _, err := l.cc.query(l.stub, "no_such_function", nil); err == nil {
+		t.Fatal("unknown query should fail")
+	}
+}
+
+// ============================================================================================================================
+// TestFailedInvokeLeavesNoTrace - an invoke that errors part way changes nothing
+// ============================================================================================================================
+func TestFailedInvokeLeavesNoTrace(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+	before := l.stub.Keys()
+
+	l.mustFail("init_marble expects 4 arguments", "init_marble", "m2", "blue")
+	l.as("carol").mustFail("carol", "set_user", "m1", "carol")
+	if after := l.stub.Keys(); strings.Join(after, ",") != strings.Join(before, ",") {
+		t.Fatalf("keys went from %v to %v", before, after)
+	}
+	l.owner("m1", "bob")
+}
+
+// ============================================================================================================================
+// lastTrade - id of the newest open trade, failing the test when there is none
+// ============================================================================================================================
+func (l *testLedger) lastTrade() string {
+	l.t.Helper()
+	ids, err := getTradeIndex(l.stub)
+	if err != nil || len(ids) == 0 {
+		l.t.Fatalf("no open trades: %v", err)
+	}
+	return ids[len(ids) - 1]
+}
+
+// ============================================================================================================================
+// TestPerformTradeChecksBothLegs - a trade only settles when both legs check out, and then both marbles move
+// ============================================================================================================================
+func TestPerformTradeChecksBothLegs(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+	l.mustInvoke("init_marble", "m2", "red", "35", "alice")
+	l.mustInvoke("init_marble", "m3", "green", "35", "alice")
+	l.as("bob").mustInvoke("open_trade", "bob", "red", "35", "blue", "16")
+	id := l.lastTrade()
+
+	err := l.as("alice").mustFail("does not offer", "perform_trade", id, "alice", "m2", "bob", "yellow", "16")
+	if tradeErr, ok := err.(*TradeError); !ok || tradeErr.Leg != "opener" {
+		t.Fatalf("a bad opener leg failed with %#v, want an opener TradeError", err)
+	}
+	err = l.mustFail("does not meet trade requirements", "perform_trade", id, "alice", "m3", "bob", "blue", "16")
+	if tradeErr, ok := err.(*TradeError); !ok || tradeErr.Leg != "closer" {
+		t.Fatalf("a bad closer leg failed with %#v, want a closer TradeError", err)
+	}
+	l.owner("m1", "bob")
+	l.owner("m2", "alice")
+	if l.lastTrade() != id {
+		t.Fatal("a failed perform_trade closed the trade")
+	}
+
+	l.mustInvoke("perform_trade", id, "alice", "m2", "bob", "blue", "16")
+	l.owner("m1", "alice")
+	l.owner("m2", "bob")
+	if ids, _ := getTradeIndex(l.stub); len(ids) != 0 {
+		t.Fatalf("open trades after the swap = %v, want none", ids)
+	}
+	l.mustFail("", "perform_trade", id, "alice", "m3", "bob", "blue", "16")
+}
+
+// ============================================================================================================================
+// TestInitMarbleRejectsExisting - init_marble can not take over a marble that already exists
+// ============================================================================================================================
+func TestInitMarbleRejectsExisting(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+
+	l.as("eve").mustFail("arleady exists", "init_marble", "m1", "red", "35", "eve")
+	l.owner("m1", "bob")
+	if res := l.query("read", "_marbleindex"); res != `["m1"]` {
+		t.Fatalf("_marbleindex = %s", res)
+	}
+	if history, _ := getHistory(l.stub, "m1"); len(history) != 1 {
+		t.Fatalf("history of m1 = %+v, want only its creation", history)
+	}
+
+	l.stub.PutState("old", []byte(`{"name":"old","color":"red","size":3,"user":"bob"}`))		//from before marbles had their own keys
+	l.stub.PutState(marbleIndexStr, []byte(`["m1","old"]`))
+	l.mustFail("arleady exists", "init_marble", "old", "red", "35", "eve")
+}
+
+// ============================================================================================================================
+// TestSetUserChecksOwner - only the owner of a marble can give it away
+// ============================================================================================================================
+func TestSetUserChecksOwner(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+
+	l.as("eve").mustFail("eve", "set_user", "m1", "eve")
+	l.owner("m1", "bob")
+	l.as("Bob").mustInvoke("set_user", "m1", "alice")
+	l.owner("m1", "alice")
+	l.as("bob").mustFail("bob", "set_user", "m1", "bob")
+	l.stub.SetCertAttribute(callerAttr, "")
+	l.mustFail("attribute", "set_user", "m1", "bob")
+}
+
+// ============================================================================================================================
+// TestPerformTradeChecksCloser - only the closer can close a trade, and only with a marble they own
+// ============================================================================================================================
+func TestPerformTradeChecksCloser(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+	l.mustInvoke("init_marble", "m2", "red", "35", "alice")
+	l.as("eve").mustFail("eve cannot open a trade for bob", "open_trade", "bob", "red", "35", "blue", "16")
+	l.as("bob").mustInvoke("open_trade", "bob", "red", "35", "blue", "16")
+	id := l.lastTrade()
+
+	l.as("eve").mustFail("eve cannot close a trade for alice", "perform_trade", id, "alice", "m2", "bob", "blue", "16")
+	l.mustFail("eve does not own marble m2", "perform_trade", id, "eve", "m2", "bob", "blue", "16")
+	l.owner("m1", "bob")
+	l.owner("m2", "alice")
+}
+
+// ============================================================================================================================
+// TestSetUserMissingMarble - set_user on a marble that does not exist fails with a MarbleNotFoundError and writes nothing
+// ============================================================================================================================
+func TestSetUserMissingMarble(t *testing.T) {
+	l := newLedger(t)
+	before := l.stub.Keys()
+
+	err := l.as("bob").mustFail("does not exist", "set_user", "nope", "bob")
+	if notFound, ok := err.(*MarbleNotFoundError); !ok || notFound.Name != "nope" {
+		t.Fatalf("set_user failed with %#v, want a MarbleNotFoundError", err)
+	}
+	if after := l.stub.Keys(); strings.Join(after, ",") != strings.Join(before, ",") {
+		t.Fatalf("keys went from %v to %v", before, after)
+	}
+}
+
+// ============================================================================================================================
+// TestPerformTradeMissingMarble - closing a trade with a marble that does not exist fails with a MarbleNotFoundError
+// ============================================================================================================================
+func TestPerformTradeMissingMarble(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+	l.as("bob").mustInvoke("open_trade", "bob", "red", "35", "blue", "16")
+
+	err := l.as("alice").mustFail("does not exist", "perform_trade", l.lastTrade(), "alice", "nope", "bob", "blue", "16")
+	if _, ok := err.(*MarbleNotFoundError); !ok {
+		t.Fatalf("perform_trade failed with %#v, want a MarbleNotFoundError", err)
+	}
+	l.owner("m1", "bob")
+}
+
+// ============================================================================================================================
+// TestTradeIDs - a trade is named after the transaction that opened it, so trades opened in the same ms stay apart, and
+//   numbered from a counter on the ledger on a peer that gives no transaction id
+// ============================================================================================================================
+func TestTradeIDs(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		l.stub.SetTxTimestamp(1464739200000)										//the next transaction is one second after this
+		res := l.as("bob").mustInvoke("open_trade", "bob", "red", "35", "blue", "16")
+		ids = append(ids, l.lastTrade())
+		if string(res) != ids[i] {
+			t.Fatalf("open_trade returned %q for trade %s", res, ids[i])
+		}
+	}
+	if ids[0] == ids[1] {
+		t.Fatalf("two trades opened at the same time share the id %s", ids[0])
+	}
+	for _, id := range ids {
+		trade, err := getTrade(l.stub, id)
+		if err != nil || trade.Id != id || !strings.HasPrefix(id, "tx") {
+			t.Fatalf("trade %s = %+v, %v", id, trade, err)
+		}
+	}
+
+	l.stub.BeginTx()
+	l.stub.SetTxID("")
+	res, err := l.cc.invoke(l.stub, "open_trade", []string{"bob", "red", "35", "blue", "16"})
+	l.stub.CommitTx()
+	if err != nil || string(res) != "1" || l.lastTrade() != "1" || l.state(tradeCounterStr) != "1" {
+		t.Fatalf("trade opened without a transaction id got id %q, %v", res, err)
+	}
+}
+
+// ============================================================================================================================
+// TestTradeKeys - each open trade has its own key listed in the trade index, and goes away with the trade
+// ============================================================================================================================
+func TestTradeKeys(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+	l.as("bob").mustInvoke("open_trade", "bob", "red", "35", "blue", "16")
+	id := l.lastTrade()
+
+	if !strings.Contains(l.state(tradePrefix + id), `"user":"bob"`) {
+		t.Fatalf("%s = %s", tradePrefix + id, l.state(tradePrefix + id))
+	}
+	if l.state(openTradesStr) != "" {
+		t.Fatal("trades are still written to " + openTradesStr)
+	}
+	l.mustInvoke("remove_trade", id)
+	if l.state(tradePrefix + id) != "" || l.state(tradeIndexStr) != "[]" {
+		t.Fatalf("removed trade left %s and index %s", l.state(tradePrefix + id), l.state(tradeIndexStr))
+	}
+}
+
+// ============================================================================================================================
+// TestMigrateTrades - the old _opentrades blob is split into a key per trade, once
+// ============================================================================================================================
+func TestMigrateTrades(t *testing.T) {
+	l := newLedger(t)
+	legacy := `{"user":"bob","timestamp":5,"want":{"color":"red","size":35},"willing":[{"color":"blue","size":16}]}`
+	l.stub.PutState(openTradesStr, []byte(`{"open_trades":[` + legacy + `,` + legacy + `]}`))
+
+	l.as(testAdmin).mustInvoke("migrate_trades")
+	l.mustInvoke("migrate_trades")
+	if res := l.state(tradeIndexStr); res != `["5","5-1"]` {
+		t.Fatalf("%s = %s, want both trades named after their timestamp", tradeIndexStr, res)
+	}
+	if trade, err := getTrade(l.stub, "5-1"); err != nil || trade.User != "bob" {
+		t.Fatalf("trade 5-1 = %+v, %v", trade, err)
+	}
+	if l.state(openTradesStr) != "" {
+		t.Fatal(openTradesStr + " is still there after the migration")
+	}
+}
+
+// ============================================================================================================================
+// TestIndexes - the owner and color indexes follow marbles as they are created, handed over and deleted
+// ============================================================================================================================
+func TestIndexes(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+	l.mustInvoke("init_marble", "m2", "blue", "16", "alice")
+	if l.state(ownerKey("bob")) != `["m1"]` || l.state(colorSizeKey("blue", 16)) != `["m1","m2"]` || l.state(colorKey("blue")) != `["m1","m2"]` {
+		t.Fatalf("indexes after init_marble: %s %s %s", l.state(ownerKey("bob")), l.state(colorSizeKey("blue", 16)), l.state(colorKey("blue")))
+	}
+
+	l.as("bob").mustInvoke("set_user", "m1", "Alice")
+	if l.state(ownerKey("bob")) != `[]` || l.state(ownerKey("alice")) != `["m2","m1"]` {
+		t.Fatalf("owner indexes after set_user: bob %s alice %s", l.state(ownerKey("bob")), l.state(ownerKey("alice")))
+	}
+	l.as(testAdmin).mustInvoke("delete", "m2")
+	if l.state(ownerKey("alice")) != `["m1"]` || l.state(colorSizeKey("blue", 16)) != `["m1"]` {
+		t.Fatalf("indexes after delete: %s %s", l.state(ownerKey("alice")), l.state(colorSizeKey("blue", 16)))
+	}
+}
+
+// ============================================================================================================================
+// TestRebuildIndexes - rebuild_indexes empties stale keys and leaves out marbles that do not decode instead of failing
+// ============================================================================================================================
+func TestRebuildIndexes(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+	l.mustInvoke("init_marble", "m2", "red", "35", "alice")
+	l.stub.PutState(marbleKey("m1"), []byte(`{"name":"m1","color":"blue","size":16,"user":"carol","version":2}`))	//changed behind the indexes' back
+	l.stub.PutState(marbleKey("m2"), []byte(`{nope`))
+	l.stub.DelState(colorKey("blue"))
+
+	res := l.as(testAdmin).mustInvoke("rebuild_indexes")
+	if string(res) != `["m2"]` {
+		t.Fatalf("rebuild_indexes returned %s, want the broken m2", res)
+	}
+	if l.state(ownerKey("bob")) != `[]` || l.state(ownerKey("alice")) != `[]` {
+		t.Fatalf("stale owner keys: bob %s alice %s", l.state(ownerKey("bob")), l.state(ownerKey("alice")))
+	}
+	if l.state(ownerKey("carol")) != `["m1"]` || l.state(colorKey("blue")) != `["m1"]` || l.state(colorKey("red")) != `[]` {
+		t.Fatalf("rebuilt indexes: carol %s blue %s red %s", l.state(ownerKey("carol")), l.state(colorKey("blue")), l.state(colorKey("red")))
+	}
+	if res := l.query("marbles_by_owner", "carol"); !strings.Contains(res, `"name":"m1"`) {
+		t.Fatalf("marbles_by_owner carol = %s", res)
+	}
+}
+
+// ============================================================================================================================
+// TestMigrateRebuildsIndexes - migrate rebuilds the indexes after upgrading the marbles, queries look through every
+//   marble until it has
+// ============================================================================================================================
+func TestMigrateRebuildsIndexes(t *testing.T) {
+	l := newLedger(t)
+	for _, name := range []string{"a", "b", "c"} {
+		l.stub.PutState(marbleKey(name), []byte(`{"name":"` + name + `","color":"Blue","size":3,"user":"Bob"}`))
+	}
+	l.stub.PutState(marbleIndexStr, []byte(`["a","b","c"]`))
+	l.stub.DelState(schemaVersionStr)													//as if written before versions existed
+
+	if res := l.query("marbles_by_owner", "bob"); strings.Count(res, `"name"`) != 3 {
+		t.Fatalf("marbles_by_owner bob before migrate = %s", res)
+	}
+	l.as(testAdmin).mustInvoke("migrate", "2")
+	if res := l.query("marbles_by_color", "blue"); strings.Count(res, `"name"`) != 3 {
+		t.Fatalf("marbles_by_color blue part way through migrate = %s", res)
+	}
+	for i := 0; i < 5 && l.state(schemaVersionStr) == ""; i++ {
+		l.mustInvoke("migrate", "2")
+	}
+	if l.state(schemaVersionStr) == "" {
+		t.Fatal("migrate did not finish")
+	}
+	if l.state(ownerKey("bob")) != `["a","b","c"]` || l.state(colorSizeKey("blue", 3)) != `["a","b","c"]` {
+		t.Fatalf("indexes after migrate: %s %s", l.state(ownerKey("bob")), l.state(colorSizeKey("blue", 3)))
+	}
+}
+
+// ============================================================================================================================
+// TestReinitRebuildsIndexes - init on a ledger from before the indexes indexes its marbles, so trades on them survive.
+//   The ledger has no admins, so anyone may run it but it names none
+// ============================================================================================================================
+func TestReinitRebuildsIndexes(t *testing.T) {
+	l := newBareLedger(t)
+	l.stub.PutState("m1", []byte(`{"name":"m1","color":"blue","size":16,"user":"bob"}`))
+	l.stub.PutState("m2", []byte(`{"name":"m2","color":"red","size":35,"user":"alice"}`))
+	l.stub.PutState(marbleIndexStr, []byte(`["m1","m2"]`))
+	l.stub.PutState(openTradesStr, []byte(`{"open_trades":[{"user":"bob","timestamp":5,"want":{"color":"red","size":35},"willing":[{"color":"blue","size":16}]}]}`))
+
+	l.as("eve").mustInvoke("init", "1")
+	if got := l.state(adminIndexStr); got != "" {
+		t.Fatalf("init on a ledger with marbles set up the admins %s", got)
+	}
+	if res := l.query("marbles_by_owner", "alice"); !strings.Contains(res, `"name":"m2"`) {
+		t.Fatalf("marbles_by_owner alice after init = %s", res)
+	}
+	l.as("alice").mustInvoke("set_user", "m2", "carol")
+	if _, err := getTrade(l.stub, "5"); err != nil {
+		t.Fatal("bob still owns what his trade offers, it should have survived: ", err)
+	}
+}
+
+// ============================================================================================================================
+// TestMarbleQueries - marbles by owner, color and size come back a page at a time in name order
+// ============================================================================================================================
+func TestMarbleQueries(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "c", "blue", "16", "bob")
+	l.mustInvoke("init_marble", "a", "blue", "20", "bob")
+	l.mustInvoke("init_marble", "b", "blue", "35", "bob")
+	l.mustInvoke("init_marble", "d", "red", "16", "alice")
+
+	names := func(res string) string {
+		var marbles []Marble
+		err := json.Unmarshal([]byte(res), &marbles)
+		if err != nil {
+			t.Fatalf("%s: %v", res, err)
+		}
+		var found []string
+		for _, m := range marbles {
+			found = append(found, m.Name)
+		}
+		return strings.Join(found, ",")
+	}
+	if got := names(l.query("marbles_by_owner", "BOB")); got != "a,b,c" {
+		t.Fatalf("marbles_by_owner BOB = %s", got)
+	}
+	if got := names(l.query("marbles_by_owner", "bob", "a", "1")); got != "b" {
+		t.Fatalf("second page of bob's marbles = %s", got)
+	}
+	if got := names(l.query("marbles_by_color", "blue", "", "2")); got != "a,b" {
+		t.Fatalf("first 2 blue marbles = %s", got)
+	}
+	if got := names(l.query("marbles_matching", "blue", "16", "20")); got != "a,c" {
+		t.Fatalf("blue marbles of size 16 to 20 = %s", got)
+	}
+	if res := l.query("marbles_by_owner", "nobody"); res != "[]" {
+		t.Fatalf("marbles_by_owner nobody = %s", res)
+	}
+	if _, err := l.cc.query(l.stub, "marbles_by_owner", []string{"bob", "", "0"}); err == nil {
+		t.Fatal("a limit of 0 should be refused")
+	}
+}
+
+// ============================================================================================================================
+// trades - the ids of a JSON array of trades, in order
+// ============================================================================================================================
+func (l *testLedger) trades(res string) string {
+	l.t.Helper()
+	var trades []AnOpenTrade
+	err := json.Unmarshal([]byte(res), &trades)
+	if err != nil {
+		l.t.Fatalf("%s: %v", res, err)
+	}
+	var ids []string
+	for _, trade := range trades {
+		ids = append(ids, trade.Id)
+	}
+	return strings.Join(ids, ",")
+}
+
+// ============================================================================================================================
+// TestListTrades - open trades filtered by user, want and willing, oldest first a page at a time
+// ============================================================================================================================
+func TestListTrades(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "c", "blue", "16", "bob")
+	l.mustInvoke("init_marble", "d", "red", "16", "alice")
+	l.as("bob").mustInvoke("open_trade", "bob", "red", "16", "blue", "16")
+	bobs := l.lastTrade()
+	l.as("alice").mustInvoke("open_trade", "alice", "blue", "16", "red", "16")
+	alices := l.lastTrade()
+
+	if got := l.trades(l.query("list_trades")); got != bobs + "," + alices {
+		t.Fatalf("list_trades = %s", got)
+	}
+	if got := l.trades(l.query("list_trades", "BOB")); got != bobs {
+		t.Fatalf("bob's trades = %s", got)
+	}
+	if got := l.trades(l.query("list_trades", "", "", "", "red")); got != alices {
+		t.Fatalf("trades willing to give red = %s", got)
+	}
+	if got := l.trades(l.query("list_trades", "", "blue", "16")); got != alices {
+		t.Fatalf("trades wanting blue 16 = %s", got)
+	}
+	if got := l.trades(l.query("list_trades", "", "", "16", "", "1", "1")); got != alices {
+		t.Fatalf("second page of one = %s", got)
+	}
+	if _, err := l.cc.query(l.stub, "list_trades", []string{"", "", "", "", "-1"}); err == nil {
+		t.Fatal("a negative offset should be refused")
+	}
+}
+
+// ============================================================================================================================
+// TestMatchTrades - match_trades fills pairs and longer cycles of trades that line up
+// ============================================================================================================================
+func TestMatchTrades(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "a1", "blue", "1", "a")
+	l.mustInvoke("init_marble", "b1", "red", "1", "b")
+	l.mustInvoke("init_marble", "c1", "green", "1", "c")
+	l.mustInvoke("init_marble", "d1", "pink", "1", "d")
+	l.mustInvoke("init_marble", "e1", "gold", "1", "e")
+	l.mustInvoke("init_marble", "f1", "white", "1", "f")
+	l.as("a").mustInvoke("open_trade", "a", "green", "1", "blue", "1")				//a -> b -> c -> a
+	l.as("b").mustInvoke("open_trade", "b", "blue", "1", "red", "1")
+	l.as("c").mustInvoke("open_trade", "c", "red", "1", "green", "1")
+	l.as("d").mustInvoke("open_trade", "d", "gold", "1", "pink", "1")				//d <-> e
+	l.as("e").mustInvoke("open_trade", "e", "pink", "1", "gold", "1")
+	l.as("f").mustInvoke("open_trade", "f", "black", "1", "white", "1")			//nobody has what f wants
+	lonely := l.lastTrade()
+
+	var filled [][]string
+	err := json.Unmarshal(l.mustInvoke("match_trades"), &filled)
+	if err != nil || len(filled) != 2 || len(filled[0]) != 2 || len(filled[1]) != 3 {
+		t.Fatalf("match_trades filled %v, %v, want the pair then the cycle of 3", filled, err)
+	}
+	l.owner("a1", "b")
+	l.owner("b1", "c")
+	l.owner("c1", "a")
+	l.owner("d1", "e")
+	l.owner("e1", "d")
+	l.owner("f1", "f")
+	if ids, _ := getTradeIndex(l.stub); len(ids) != 1 || ids[0] != lonely {
+		t.Fatalf("open trades after matching = %v, want only %s", ids, lonely)
+	}
+	if res := l.mustInvoke("match_trades"); string(res) != "[]" {
+		t.Fatalf("a second match_trades filled %s", res)
+	}
+}
+
+// ============================================================================================================================
+// TestBundleTrades - a bundle trade swaps every marble on both sides at once, and only for marbles that fit exactly
+// ============================================================================================================================
+func TestBundleTrades(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "a1", "blue", "16", "a")
+	l.mustInvoke("init_marble", "a2", "blue", "16", "a")
+	l.mustInvoke("init_marble", "a3", "red", "35", "a")
+	l.mustInvoke("init_marble", "b1", "green", "5", "b")
+	l.mustInvoke("init_marble", "b2", "green", "5", "b")
+
+	l.as("b").mustFail("does not own enough", "open_bundle_trade", "b", "3", "blue", "16", "blue", "16", "red", "35", "green", "5", "green", "5", "green", "5")
+	l.mustInvoke("open_bundle_trade", "b", "3", "blue", "16", "blue", "16", "red", "35", "green", "5", "green", "5")
+	id := l.lastTrade()
+
+	l.as("a").mustFail("", "perform_trade", id, "a", "a1", "a1", "a3")				//the same marble twice
+	l.mustFail("", "perform_trade", id, "a", "a1", "a2")							//one short
+	l.owner("a1", "a")
+	l.owner("b1", "b")
+	l.mustInvoke("perform_trade", id, "a", "a3", "a1", "a2")
+	for _, name := range []string{"a1", "a2", "a3"} {
+		l.owner(name, "b")
+	}
+	l.owner("b1", "a")
+	l.owner("b2", "a")
+	if ids, _ := getTradeIndex(l.stub); len(ids) != 0 {
+		t.Fatalf("open trades after the bundle = %v", ids)
+	}
+
+	l.as("b").mustInvoke("open_bundle_trade", "b", "1", "green", "5", "blue", "16", "blue", "16")
+	l.mustInvoke("set_user", "a1", "z")												//b can no longer give two blue 16s
+	if ids, _ := getTradeIndex(l.stub); len(ids) != 0 {
+		t.Fatalf("a bundle b can no longer give is still open: %v", ids)
+	}
+}
+
+// ============================================================================================================================
+// TestTradeExpiry - a trade with a ttl records when it expires, can't be closed after that and is removed by expire_trades
+// ============================================================================================================================
+func TestTradeExpiry(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "a1", "blue", "16", "a")
+	l.mustInvoke("init_marble", "b1", "red", "35", "b")
+	l.mustInvoke("init_marble", "b2", "red", "35", "b")
+
+	l.as("b").mustFail("time to live", "open_trade", "b", "blue", "16", "red", "35", "-5")
+	l.mustInvoke("open_trade", "b", "blue", "16", "red", "35")
+	forever := l.lastTrade()
+	l.mustInvoke("open_trade", "b", "blue", "16", "red", "35", "60")
+	soon := l.lastTrade()
+	trade, err := getTrade(l.stub, soon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade.Expires != trade.Timestamp + 60000 {
+		t.Fatalf("trade opened at %d with a 60s ttl expires at %d", trade.Timestamp, trade.Expires)
+	}
+	if res := l.state(tradeKey(forever)); strings.Contains(res, "expires") {
+		t.Fatalf("a trade without a ttl was stored with an expiry: %s", res)
+	}
+
+	if got := l.mustInvoke("expire_trades"); string(got) != "[]" {
+		t.Fatalf("expire_trades before the expiry = %s", got)
+	}
+	l.stub.SetTxTimestamp(trade.Expires - 1000)										//the next transaction lands right on the expiry
+	l.as("a").mustFail("has expired", "perform_trade", soon, "a", "a1", "b", "red", "35")
+	l.owner("a1", "a")
+
+	if got := l.mustInvoke("expire_trades"); string(got) != `["` + soon + `"]` {
+		t.Fatalf("expire_trades = %s, want [%q]", got, soon)
+	}
+	if ids, _ := getTradeIndex(l.stub); len(ids) != 1 || ids[0] != forever {
+		t.Fatalf("open trades after expire_trades = %v, want [%s]", ids, forever)
+	}
+	l.mustInvoke("perform_trade", forever, "a", "a1", "b", "red", "35")
+	l.owner("a1", "b")
+}
+
+// ============================================================================================================================
+// TestEscrow - an escrow trade locks the offered marble until the trade is closed or removed, and only its opener or an
+//   admin may remove it
+// ============================================================================================================================
+func TestEscrow(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "a1", "blue", "16", "a")
+	l.mustInvoke("init_marble", "b1", "red", "35", "b")
+	l.mustInvoke("init_marble", "b2", "red", "35", "b")
+
+	l.as("b").mustInvoke("open_escrow_trade", "b", "blue", "16", "red", "35")
+	first := l.lastTrade()
+	locked := "b1"
+	if l.marble("b1").Locked == "" {
+		locked = "b2"
+	}
+	if got := l.marble(locked).Locked; got != first {
+		t.Fatalf("%s is locked by %q, want %q", locked, got, first)
+	}
+	l.mustFail("locked in escrow", "set_user", locked, "c")
+	l.as(testAdmin).mustFail("locked in escrow", "delete", locked)
+
+	l.as("eve").mustFail("cannot remove trade", "remove_trade", first)
+	l.as("B").mustInvoke("remove_trade", first)
+	if got := l.marble(locked).Locked; got != "" {
+		t.Fatalf("%s is still locked by %q after remove_trade", locked, got)
+	}
+	l.as("b").mustInvoke("set_user", locked, "b")
+
+	l.mustInvoke("open_escrow_trade", "b", "blue", "16", "red", "35")
+	second := l.lastTrade()
+	l.as(testAdmin).mustInvoke("remove_trade", second)
+	if ids, _ := getTradeIndex(l.stub); len(ids) != 0 {
+		t.Fatalf("open trades after an admin removed the last one = %v", ids)
+	}
+
+	l.as("b").mustInvoke("open_escrow_trade", "b", "blue", "16", "red", "35")
+	third := l.lastTrade()
+	l.as("a").mustInvoke("perform_trade", third, "a", "a1", "b", "red", "35")
+	l.owner("a1", "b")
+	for _, name := range []string{"b1", "b2"} {
+		if got := l.marble(name).Locked; got != "" {
+			t.Fatalf("%s is still locked by %q after the trade closed", name, got)
+		}
+	}
+}
+
+// ============================================================================================================================
+// lastEvent - name and payload of the event the last committed transaction set
+// ============================================================================================================================
+func (l *testLedger) lastEvent() (string, MarbleEvent) {
+	l.t.Helper()
+	events := l.stub.Events()
+	if len(events) == 0 {
+		l.t.Fatal("no events were set")
+	}
+	var ev MarbleEvent
+	err := json.Unmarshal(events[len(events) - 1].Payload, &ev)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	return events[len(events) - 1].Name, ev
+}
+
+// ============================================================================================================================
+// TestEventMerge - a transaction raising different events sets the last one, still carrying the transfers and pruned
+//   trades of the ones before it
+// ============================================================================================================================
+func TestEventMerge(t *testing.T) {
+	pending := &eventStub{}
+	pending.add("trades_matched", MarbleEvent{Transfers: []MarbleEvent{{Marble: "a1", NewOwner: "c"}}})
+	pending.add("trades_pruned", MarbleEvent{Trades: []string{"t1"}})
+	pending.add("marble_deleted", MarbleEvent{Marble: "b1", Transfers: []MarbleEvent{{Marble: "c1", NewOwner: "a"}}})
+	if pending.name != "marble_deleted" || pending.ev.Marble != "b1" {
+		t.Fatalf("merged event = %s %+v", pending.name, pending.ev)
+	}
+	if len(pending.ev.Transfers) != 2 || pending.ev.Transfers[0].Marble != "a1" || pending.ev.Transfers[1].Marble != "c1" {
+		t.Fatalf("merged event has transfers %+v", pending.ev.Transfers)
+	}
+	if len(pending.ev.Trades) != 1 || pending.ev.Trades[0] != "t1" {
+		t.Fatalf("merged event has pruned trades %v", pending.ev.Trades)
+	}
+}
+
+// ============================================================================================================================
+// TestEvents - every transaction sets one event, carrying the trades its clean up pruned
+// ============================================================================================================================
+func TestEvents(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "a1", "blue", "16", "a")
+	if name, ev := l.lastEvent(); name != "marble_created" || ev.Marble != "a1" || ev.NewOwner != "a" {
+		t.Fatalf("init_marble set %s %+v", name, ev)
+	}
+	l.mustInvoke("init_marble", "b1", "red", "35", "b")
+	l.mustInvoke("init_marble", "c1", "green", "5", "c")
+
+	l.as("b").mustInvoke("open_trade", "b", "blue", "16", "red", "35")
+	offered := l.lastTrade()
+	if name, ev := l.lastEvent(); name != "trade_opened" || ev.Trade != offered {
+		t.Fatalf("open_trade set %s %+v", name, ev)
+	}
+	l.stub.ClearEvents()
+	l.mustInvoke("set_user", "b1", "z")												//b can no longer offer red 35
+	if n := len(l.stub.Events()); n != 1 {
+		t.Fatalf("set_user set %d events, want 1", n)
+	}
+	name, ev := l.lastEvent()
+	if name != "marble_transferred" || ev.Marble != "b1" || ev.OldOwner != "b" || ev.NewOwner != "z" {
+		t.Fatalf("set_user set %s %+v", name, ev)
+	}
+	if len(ev.Trades) != 1 || ev.Trades[0] != offered {
+		t.Fatalf("set_user event lists pruned trades %v, want [%s]", ev.Trades, offered)
+	}
+
+	l.as("a").mustInvoke("open_trade", "a", "green", "5", "blue", "16")
+	l.as("c").mustInvoke("open_trade", "c", "blue", "16", "green", "5")
+	l.stub.ClearEvents()
+	l.mustInvoke("match_trades")
+	name, ev = l.lastEvent()
+	if name != "trades_matched" || len(ev.Transfers) != 2 {
+		t.Fatalf("match_trades set %s %+v", name, ev)
+	}
+	for _, moved := range ev.Transfers {
+		if l.marble(moved.Marble).User != moved.NewOwner || moved.Trade == "" {
+			t.Fatalf("match_trades event has transfer %+v", moved)
+		}
+	}
+
+	l.stub.ClearEvents()
+	l.as("a").mustFail("", "set_user", "a1", "b")									//c owns it now
+	if n := len(l.stub.Events()); n != 0 {
+		t.Fatalf("a failed set_user set %d events", n)
+	}
+}
+
+// ============================================================================================================================
+// history - a marble's ownership history as marble_history returns it
+// ============================================================================================================================
+func (l *testLedger) history(name string) []Transfer {
+	l.t.Helper()
+	var history []Transfer
+	err := json.Unmarshal([]byte(l.query("marble_history", name)), &history)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	return history
+}
+
+// ============================================================================================================================
+// TestMarbleHistory - creation, set_user and trades each append an entry, stamped with their transaction's time
+// ============================================================================================================================
+func TestMarbleHistory(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "a1", "blue", "16", "a")
+	created, _ := l.stub.TxTimestamp()
+	l.mustInvoke("init_marble", "b1", "red", "35", "b")
+	l.as("a").mustInvoke("set_user", "a1", "c")
+	l.as("c").mustInvoke("open_trade", "c", "red", "35", "blue", "16")
+	id := l.lastTrade()
+	l.as("b").mustInvoke("perform_trade", id, "b", "b1", "c", "blue", "16")
+
+	history := l.history("a1")
+	want := []Transfer{{"", "a", "init_marble", 0}, {"a", "c", "set_user", 0}, {"c", "b", id, 0}}
+	if len(history) != len(want) {
+		t.Fatalf("history of a1 = %+v", history)
+	}
+	for i := range want {
+		if history[i].From != want[i].From || history[i].To != want[i].To || history[i].Reason != want[i].Reason {
+			t.Fatalf("history of a1 entry %d = %+v, want %+v", i, history[i], want[i])
+		}
+		if i > 0 && history[i].Timestamp <= history[i - 1].Timestamp {
+			t.Fatalf("history of a1 is not in transaction order: %+v", history)
+		}
+	}
+	if history[0].Timestamp != created {
+		t.Fatalf("a1 was created at %d, history says %d", created, history[0].Timestamp)
+	}
+	if got := l.history("b1"); len(got) != 2 || got[1].To != "c" || got[1].Reason != id {
+		t.Fatalf("history of b1 = %+v", got)
+	}
+	if got := l.query("marble_history", "nope"); got != "[]" {
+		t.Fatalf("history of a marble that never existed = %s", got)
+	}
+
+	l.as(testAdmin).mustInvoke("delete", "a1")										//the history outlives the marble
+	l.mustInvoke("init_marble", "a1", "green", "5", "d")
+	if got := l.history("a1"); len(got) != 4 || got[3].To != "d" {
+		t.Fatalf("history of a reused name = %+v", got)
+	}
+}
+
+// ============================================================================================================================
+// TestQuotedNames - names with quotes and backslashes are stored as valid JSON, and records the old hand built JSON
+//   broke are reported by scan_records and rebuilt by repair_records
+// ============================================================================================================================
+func TestQuotedNames(t *testing.T) {
+	l := newLedger(t)
+	name := `say "hi" \o/`
+	l.mustInvoke("init_marble", name, "blue", "16", "bob")
+	var res Marble
+	err := json.Unmarshal([]byte(l.query("read", name)), &res)
+	if err != nil || res.Name != name {
+		t.Fatalf("read %q = %+v, %v", name, res, err)
+	}
+
+	legacy := `{"name": "o"ld", "color": "red", "size": 35, "user": "amy"}`			//what the old init_marble wrote for o"ld
+	l.stub.PutState(marbleKey(`o"ld`), []byte(legacy))
+	l.stub.PutState(marbleKey("junk"), []byte("not json"))
+	names, _ := json.Marshal([]string{name, `o"ld`, "junk"})
+	l.stub.PutState(marbleIndexStr, names)
+
+	var broken []BrokenRecord
+	json.Unmarshal([]byte(l.query("scan_records")), &broken)
+	if len(broken) != 2 || broken[0].Key != `o"ld` || !broken[0].Repairable || broken[1].Key != "junk" || broken[1].Repairable {
+		t.Fatalf("scan_records = %+v", broken)
+	}
+	l.as(testAdmin).mustInvoke("repair_records")
+	if got := l.marble(`o"ld`); got.Color != "red" || got.Size != 35 || got.User != "amy" {
+		t.Fatalf("repaired marble = %+v", got)
+	}
+	if got := l.state(marbleKey("junk")); got != "not json" {
+		t.Fatalf("repair_records touched a record it can not rebuild: %q", got)
+	}
+	json.Unmarshal([]byte(l.query("scan_records")), &broken)
+	if len(broken) != 1 || broken[0].Key != "junk" {
+		t.Fatalf("scan_records after repair_records = %+v", broken)
+	}
+}
+
+// ============================================================================================================================
+// TestDecodeErrors - a corrupt index or trade aborts the invocation with an error naming the key instead of being
+//   overwritten, and verify_state reports every value that does not decode
+// ============================================================================================================================
+func TestDecodeErrors(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+	l.as("bob").mustInvoke("open_trade", "bob", "red", "35", "blue", "16")
+	id := l.lastTrade()
+	if got := l.query("verify_state"); got != "[]" {
+		t.Fatalf("verify_state on a healthy ledger = %s", got)
+	}
+
+	l.stub.PutState(marbleIndexStr, []byte("[broken"))
+	l.stub.PutState(tradeKey(id), []byte("{broken"))
+	l.stub.PutState(historyKey("m1"), []byte("broken"))
+	l.mustFail("Failed to decode " + marbleIndexStr, "init_marble", "m2", "red", "35", "amy")
+	if got := l.state(marbleIndexStr); got != "[broken" {
+		t.Fatalf("a failed init_marble overwrote the corrupt index with %q", got)
+	}
+	l.mustFail("Failed to decode " + tradeKey(id), "remove_trade", id)
+
+	var problems []BrokenRecord
+	json.Unmarshal([]byte(l.query("verify_state")), &problems)
+	found := make(map[string]bool)
+	for _, problem := range problems {
+		found[problem.Key] = true
+	}
+	for _, key := range []string{marbleIndexStr, tradeKey(id)} {
+		if !found[key] {
+			t.Fatalf("verify_state did not report %s: %+v", key, problems)
+		}
+	}
+
+	l.stub.PutState(marbleIndexStr, []byte(`["m1"]`))								//with the index back the history is walked too
+	json.Unmarshal([]byte(l.query("verify_state")), &problems)
+	found = make(map[string]bool)
+	for _, problem := range problems {
+		found[problem.Key] = true
+	}
+	if !found[historyKey("m1")] || !found[tradeKey(id)] || found[marbleIndexStr] {
+		t.Fatalf("verify_state = %+v", problems)
+	}
+}
+
+// ============================================================================================================================
+// TestArgErrors - every function's arguments are checked against its declared ones, with the same messages everywhere
+// ============================================================================================================================
+func TestArgErrors(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "a1", "blue", "16", "a")
+	l.mustInvoke("init_marble", "b1", "red", "35", "b")
+	l.as("b").mustInvoke("open_trade", "b", "blue", "16", "red", "35")
+	id := l.lastTrade()
+
+	cases := []struct{
+		function string
+		args []string
+		want string
+	}{
+		{"init_marble", []string{"m", "blue", "big", "a"}, "init_marble argument 3 (size) must be a numeric string"},
+		{"init_marble", []string{"m", "blue", "16"}, "init_marble expects 4 arguments: name, color, size, user"},
+		{"open_trade", []string{"b", "blue", "16", "red"}, "open_trade expects at least 5 arguments"},
+		{"open_trade", []string{"b", "blue", "x", "red", "35"}, "open_trade argument 3 (want_size) must be a numeric string"},
+		{"open_bundle_trade", []string{"b", "1", "blue", "16"}, "open_bundle_trade expects at least 6 arguments"},
+		{"open_bundle_trade", []string{"b", "0", "blue", "16", "red", "35"}, "want_count must be a positive numeric string"},
+		{"perform_trade", []string{id, "a"}, "perform_trade expects at least 3 arguments"},
+		{"perform_trade", []string{id, "a", "a1", "b", "red"}, "perform_trade expects 6 arguments: id, closer, closer_marble, opener, color, size"},
+		{"perform_trade", []string{id, "a", "a1", "b", "red", "big"}, "perform_trade argument 6 (size) must be a numeric string"},
+		{"set_user", []string{"a1", ""}, "set_user argument 2 (user) must be a non-empty string"},
+	}
+	for _, c := range cases {
+		caller := c.args[0]
+		if c.function == "perform_trade" {
+			caller = c.args[1]
+		}
+		l.as(caller).mustFail(c.want, c.function, c.args...)
+	}
+	for _, c := range []struct{ function string; args []string; want string }{
+		{"marbles_matching", []string{"blue", "1", "x"}, "marbles_matching argument 3 (max_size) must be a numeric string"},
+		{"marbles_by_owner", []string{"a", "", "0"}, "limit must be a positive numeric string"},
+		{"list_trades", []string{"", "", "x"}, "list_trades argument 3 (want_size) must be a numeric string"},
+		{"list_trades", []string{"", "", "", "", "-1"}, "offset must be a non-negative numeric string"},
+	} {
+		_, err := l.cc.query(l.stub, c.function, c.args)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Fatalf("%s %v = %v, want %q", c.function, c.args, err, c.want)
+		}
+	}
+	l.owner("a1", "a")
+}
+
+// ============================================================================================================================
+// TestJSONArgs - a single JSON object argument names the arguments, and works the same as the positional form
+// ============================================================================================================================
+func TestJSONArgs(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", `{"name": "a1", "color": "blue", "size": 16, "user": "a"}`)
+	l.mustInvoke("init_marble", `{"name": "b1", "color": "red", "size": "35", "user": "b"}`)
+	l.mustInvoke("init_marble", "{not json", "green", "5", "c")						//positional, even when it looks like JSON
+	if got := l.marble("a1"); got.Color != "blue" || got.Size != 16 || got.User != "a" {
+		t.Fatalf("a1 = %+v", got)
+	}
+	l.owner("{not json", "c")
+
+	l.as("b").mustInvoke("open_trade", `{"user": "b", "want": {"color": "blue", "size": 16}, "willing": [{"color": "red", "size": 35}], "ttl": 60}`)
+	id := l.lastTrade()
+	if trade, _ := getTrade(l.stub, id); trade.Want.Size != 16 || len(trade.Willing) != 1 || trade.Expires == 0 {
+		t.Fatalf("trade opened from JSON = %+v", trade)
+	}
+	l.as("a").mustInvoke("perform_trade", `{"id": "` + id + `", "closer": {"user": "a", "name": "a1"}, "opener": {"user": "b", "color": "red", "size": 35}}`)
+	l.owner("a1", "b")
+	l.owner("b1", "a")
+
+	l.as("b").mustInvoke("set_user", `{"name": "a1", "user": "c"}`)
+	l.owner("a1", "c")
+	l.mustFail("set_user has no argument named owner", "set_user", `{"name": "a1", "owner": "b"}`)
+	l.as("c").mustFail("set_user argument 2 (user) must be a non-empty string", "set_user", `{"name": "a1"}`)
+	l.mustFail("open_trade has no argument named price", "open_trade", `{"user": "c", "price": 1}`)
+
+	if got := l.query("marbles_by_owner", `{"owner": "b", "limit": 10}`); got != l.query("marbles_by_owner", "b", "", "10") {
+		t.Fatalf("marbles_by_owner from JSON = %s", got)
+	}
+}
+
+// ============================================================================================================================
+// TestAdmins - init, write and delete are restricted to admins, who are managed with add_admin and remove_admin
+// ============================================================================================================================
+func TestAdmins(t *testing.T) {
+	l := newBareLedger(t)
+	l.as("Root").mustFail("add_admin is restricted to admins and there are none yet", "add_admin", "root")
+	l.mustInvoke("init", "1")												//the deploy init makes its caller the admin
+	if got := l.state(adminIndexStr); got != `["root"]` {
+		t.Fatalf("admins after the deploy init = %s", got)
+	}
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+
+	for _, c := range [][]string{{"init", "1"}, {"write", "abc", "2"}, {"delete", "m1"}, {"add_admin", "eve"}, {"remove_admin", "root"}} {
+		l.as("eve").mustFail("is restricted to admins, eve is not one", c[0], c[1:]...)
+	}
+	l.marble("m1")
+
+	l.as("root").mustInvoke("add_admin", "Amy")
+	l.as("amy").mustInvoke("write", "abc", "2")
+	l.mustInvoke("remove_admin", "root")
+	l.as("root").mustFail("is restricted to admins", "write", "abc", "3")
+	l.as("amy").mustFail("not an admin", "remove_admin", "root")
+	l.mustFail("Can not remove the last admin", "remove_admin", "amy")
+	l.mustInvoke("delete", "m1")
+	if got := l.state(marbleKey("m1")); got != "" {
+		t.Fatalf("m1 is still stored after delete: %s", got)
+	}
+}
+
+// ============================================================================================================================
+// TestReservedKeys - write, delete and init_marble refuse names in the reserved namespace, and a marble can share its
+//   name with a key write stored without either overwriting the other
+// ============================================================================================================================
+func TestReservedKeys(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+	index := l.state(marbleIndexStr)
+
+	for _, c := range [][]string{{"write", marbleIndexStr, "[]"}, {"write", tradeIndexStr, "[]"}, {"delete", marbleIndexStr}, {"delete", adminIndexStr}, {"init_marble", "_m2", "red", "35", "bob"}} {
+		l.mustFail("is reserved", c[0], c[1:]...)
+	}
+	if got := l.state(marbleIndexStr); got != index {
+		t.Fatalf("_marbleindex = %s, want %s", got, index)
+	}
+
+	l.mustInvoke("write", "m1", "plain value")
+	if got := l.state("m1"); got != "plain value" {
+		t.Fatalf("write m1 stored %q", got)
+	}
+	if got := l.marble("m1"); got.Color != "blue" || got.User != "bob" {
+		t.Fatalf("write clobbered marble m1: %+v", got)
+	}
+	var res Marble
+	if json.Unmarshal([]byte(l.query("read", "m1")), &res) != nil || res.Name != "m1" {
+		t.Fatalf("read m1 = %s, want the marble", l.query("read", "m1"))
+	}
+}
+
+// ============================================================================================================================
+// TestReinit - init on a populated ledger keeps the marbles and trades, only an admin's forced init wipes them
+// ============================================================================================================================
+func TestReinit(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+	l.as("bob").mustInvoke("open_trade", "bob", "red", "35", "blue", "16")
+	id := l.lastTrade()
+
+	l.as(testAdmin).mustInvoke("init", "1")
+	l.owner("m1", "bob")
+	if _, err := getTrade(l.stub, id); err != nil {
+		t.Fatal("re-init dropped an open trade: ", err)
+	}
+	l.mustFail("force argument must be true or false", "init", "1", "", "yes")
+	l.as("bob").mustFail("is restricted to admins", "init", "1", "", "true")
+	l.owner("m1", "bob")
+
+	l.as(testAdmin).mustInvoke("init", "1", "", "true")
+	for _, key := range []string{marbleKey("m1"), tradeKey(id), ownerKey("bob")} {
+		if got := l.state(key); got != "" && got != "[]" {
+			t.Fatalf("%s = %s after a forced init", key, got)
+		}
+	}
+	var index []string
+	if got := l.state(marbleIndexStr); json.Unmarshal([]byte(got), &index) != nil || len(index) != 0 {
+		t.Fatalf("_marbleindex = %s after a forced init", got)
+	}
+	if got := l.state(adminIndexStr); got != `["` + testAdmin + `"]` {
+		t.Fatalf("a forced init changed the admins to %s", got)
+	}
+}
+
+// ============================================================================================================================
+// TestForcedInitNeedsAdmin - a ledger from before admins existed is not wiped, and as init runs for anyone until there is
+//   an admin only the deploy can name one for marbles that are already there
+// ============================================================================================================================
+func TestForcedInitNeedsAdmin(t *testing.T) {
+	l := newBareLedger(t)
+	l.stub.PutState(marbleKey("m1"), []byte(`{"name":"m1","color":"blue","size":16,"user":"bob"}`))
+	l.stub.PutState(marbleIndexStr, []byte(`["m1"]`))
+	l.as("eve").mustFail("init only wipes existing marbles for an admin", "init", "1", "", "true")
+	l.mustFail("only the deploy can name the first admin", "init", "1", "eve")
+	l.mustFail("there are none yet", "write", "abc", "1")
+	l.owner("m1", "bob")
+	if got := l.state(adminIndexStr); got != "" {
+		t.Fatalf("admins = %s", got)
+	}
+
+	_, err := l.stub.Invoke(func() ([]byte, error) {
+		return l.cc.deploy(l.stub, []string{"1", testAdmin})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.owner("m1", "bob")
+	l.as(testAdmin).mustInvoke("init", "1", "", "true")
+	if got := l.state(marbleKey("m1")); got != "" {
+		t.Fatalf("m1 = %s after the admin's forced init", got)
+	}
+}
+
+// ============================================================================================================================
+// TestLowercaseOwners - owners, openers and the colors a trade wants and offers are stored lowercased whatever case
+//   they were given in
+// ============================================================================================================================
+func TestLowercaseOwners(t *testing.T) {
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "a1", "blue", "16", "Amy")
+	l.mustInvoke("init_marble", "b1", "red", "35", "bob")
+	l.owner("a1", "amy")
+	l.as("amy").mustInvoke("set_user", "a1", "Carol")
+	l.owner("a1", "carol")
+
+	l.as("bob").mustInvoke("open_trade", "BOB", "Blue", "16", "RED", "35")
+	id := l.lastTrade()
+	if trade, _ := getTrade(l.stub, id); trade.User != "bob" || trade.Want.Color != "blue" || trade.Willing[0].Color != "red" {
+		t.Fatalf("trade opened for BOB wanting Blue for RED is stored as %+v", trade)
+	}
+	l.as("carol").mustInvoke("perform_trade", id, "CAROL", "a1", "bob", "red", "35")
+	l.owner("a1", "bob")
+	l.owner("b1", "carol")
+}
+
+// ============================================================================================================================
+// TestMaintenanceIsAdminOnly - the migrations and repairs may only be run by an admin
+// ============================================================================================================================
+func TestMaintenanceIsAdminOnly(t *testing.T) {
+	l := newLedger(t)
+	for _, function := range []string{"migrate", "migrate_keys", "migrate_trades", "rebuild_indexes", "repair_records"} {
+		l.as("eve").mustFail("is restricted to admins", function)
+		l.as(testAdmin).mustInvoke(function)
+	}
+}
+
+// ============================================================================================================================
+// TestReinitMigratesInBatches - re-init runs one batch of migrate, the queries stay right until an admin finishes it
+// ============================================================================================================================
+func TestReinitMigratesInBatches(t *testing.T) {
+	defer func(size int) { migrateBatchSize = size }(migrateBatchSize)
+	migrateBatchSize = 1
+
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+	l.mustInvoke("init_marble", "m2", "red", "35", "bob")
+	l.mustInvoke("init_marble", "m3", "red", "16", "amy")
+	l.stub.PutState(ownerKey("bob"), []byte(`["m3"]`))								//an index gone wrong
+
+	l.mustInvoke("init", "1")
+	var progress Migration
+	json.Unmarshal([]byte(l.state(migrationStr)), &progress)
+	if progress.Stage != "indexes" || progress.Bookmark != "m1" {
+		t.Fatalf("progress after re-init = %+v, want the indexes one marble in", progress)
+	}
+	owned := func(user string) string {
+		var marbles []Marble
+		json.Unmarshal([]byte(l.query("marbles_by_owner", user)), &marbles)
+		var names []string
+		for _, m := range marbles {
+			names = append(names, m.Name)
+		}
+		return strings.Join(names, ",")
+	}
+	if got := owned("bob"); got != "m1,m2" {
+		t.Fatalf("marbles_by_owner bob mid-migration = %s", got)
+	}
+	for i := 0; i < 10 && progress.Stage != "done"; i++ {
+		json.Unmarshal(l.mustInvoke("migrate"), &progress)
+	}
+	if progress.Stage != "done" || l.state(migrationStr) != "" {
+		t.Fatalf("migrate did not finish: %+v", progress)
+	}
+	if got := l.state(ownerKey("bob")); got != `["m1","m2"]` {
+		t.Fatalf("owner index of bob after migrate = %s", got)
+	}
+	if got := owned("amy"); got != "m3" {
+		t.Fatalf("marbles_by_owner amy = %s", got)
+	}
+}
+
+// ============================================================================================================================
+// output - what f prints to stdout
+// ============================================================================================================================
+func output(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	f()
+	os.Stdout = stdout
+	w.Close()
+	var buf bytes.Buffer
+	io.Copy(&buf, r)
+	return buf.String()
+}
+
+// ============================================================================================================================
+// TestLogLevel - init sets the level and stores it for peers that start later, debug detail only shows at debug, and
+//   nothing is written to the ledger for debugging
+// ============================================================================================================================
+func TestLogLevel(t *testing.T) {
+	defer func(level int, loaded bool) { logLevel, logLevelLoaded = level, loaded }(logLevel, logLevelLoaded)
+
+	l := newLedger(t)
+	l.mustInvoke("init_marble", "m1", "blue", "16", "bob")
+	l.mustFail("log_level must be one of error, info, debug", "init", "1", "", "", "loud")
+	quiet := output(t, func() {
+		l.as("bob").mustInvoke("open_trade", "bob", "red", "35", "blue", "16")
+	})
+	if strings.Contains(quiet, "[debug]") || !strings.Contains(quiet, "[info]") {
+		t.Fatalf("open_trade at info printed:\n%s", quiet)
+	}
+
+	l.as(testAdmin).mustInvoke("init", "1", "", "", "DEBUG")
+	if got := l.state(logLevelStr); got != "debug" {
+		t.Fatalf("_loglevel = %q", got)
+	}
+	logLevel, logLevelLoaded = 1, false												//a peer starting up
+	chatty := output(t, func() {
+		l.as("bob").mustInvoke("open_trade", "bob", "green", "5", "blue", "16")
+	})
+	if !strings.Contains(chatty, "[debug]") {
+		t.Fatalf("open_trade after a restart at debug printed:\n%s", chatty)
+	}
+	for _, key := range l.stub.Keys() {
+		if strings.HasPrefix(key, "_debug") {
+			t.Fatalf("debug data written to the ledger under %s", key)
+		}
+	}
+}
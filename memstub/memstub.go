@@ -0,0 +1,268 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// Package memstub is an in-memory stand-in for the peer's ChaincodeStub. Every chaincode in this
+// repo talks to the ledger through its own ChaincodeStubInterface, which *MemStub satisfies, so the
+// chaincode functions can be driven from go test without a running peer.
+package memstub
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+)
+
+// startTimestamp - 2016-06-01 00:00:00 UTC in ms, transaction timestamps count up from here so runs are reproducible
+const startTimestamp = 1464739200000
+
+// Event - a chaincode event raised through SetEvent
+type Event struct {
+	Name string
+	Payload []byte
+}
+
+// MemStub - map backed world state with a single level of transactions
+type MemStub struct {
+	state map[string][]byte						//committed world state
+	writes map[string][]byte					//pending writes of the open transaction, nil value means deleted
+	inTx bool
+	txID string									//id of the current transaction
+	txCount int
+	txTimestamp int64							//timestamp of the current transaction in ms
+	attributes map[string][]byte				//transaction certificate attributes of the caller
+	events []Event								//events of committed transactions, oldest first
+	txEvent *Event								//last event raised by the open transaction
+}
+
+// ============================================================================================================================
+// NewMemStub - create an empty world state
+// ============================================================================================================================
+func NewMemStub() *MemStub {
+	return &MemStub{state: make(map[string][]byte), attributes: make(map[string][]byte), txTimestamp: startTimestamp}
+}
+
+// ============================================================================================================================
+// GetState - read a key, seeing the open transaction's own writes. A missing key returns nil, nil like the peer does
+// ============================================================================================================================
+func (s *MemStub) GetState(key string) ([]byte, error) {
+	if s.inTx {
+		if value, ok := s.writes[key]; ok {
+			return copyBytes(value), nil
+		}
+	}
+	return copyBytes(s.state[key]), nil
+}
+
+// ============================================================================================================================
+// PutState - write a key, straight to world state when no transaction is open
+// ============================================================================================================================
+func (s *MemStub) PutState(key string, value []byte) error {
+	if key == "" {
+		return errors.New("key must not be an empty string")
+	}
+	if value == nil {
+		value = []byte{}									//keep nil free for "deleted"
+	}
+	if s.inTx {
+		s.writes[key] = copyBytes(value)
+		return nil
+	}
+	s.state[key] = copyBytes(value)
+	return nil
+}
+
+// ============================================================================================================================
+// DelState - remove a key, straight from world state when no transaction is open
+// ============================================================================================================================
+func (s *MemStub) DelState(key string) error {
+	if s.inTx {
+		s.writes[key] = nil
+		return nil
+	}
+	delete(s.state, key)
+	return nil
+}
+
+// ============================================================================================================================
+// BeginTx - start buffering writes until CommitTx or RollbackTx
+// ============================================================================================================================
+func (s *MemStub) BeginTx() error {
+	if s.inTx {
+		return errors.New("a transaction is already open")
+	}
+	s.inTx = true
+	s.writes = make(map[string][]byte)
+	s.txEvent = nil
+	s.txCount++
+	s.txID = "tx" + strconv.Itoa(s.txCount)			//every transaction gets a fresh id, override with SetTxID
+	s.txTimestamp += 1000									//and a timestamp one second after the last one
+	return nil
+}
+
+// ============================================================================================================================
+// CommitTx - apply the buffered writes to world state
+// ============================================================================================================================
+func (s *MemStub) CommitTx() error {
+	if !s.inTx {
+		return errors.New("no transaction is open")
+	}
+	for key, value := range s.writes {
+		if value == nil {
+			delete(s.state, key)
+		} else {
+			s.state[key] = value
+		}
+	}
+	if s.txEvent != nil {
+		s.events = append(s.events, *s.txEvent)
+	}
+	s.inTx = false
+	s.writes = nil
+	s.txEvent = nil
+	return nil
+}
+
+// ============================================================================================================================
+// RollbackTx - throw away the buffered writes and events
+// ============================================================================================================================
+func (s *MemStub) RollbackTx() error {
+	if !s.inTx {
+		return errors.New("no transaction is open")
+	}
+	s.inTx = false
+	s.writes = nil
+	s.txEvent = nil
+	return nil
+}
+
+// ============================================================================================================================
+// Invoke - run fn as one transaction, committing on success and rolling back on error like the peer does for a failed tx
+// ============================================================================================================================
+func (s *MemStub) Invoke(fn func() ([]byte, error)) ([]byte, error) {
+	err := s.BeginTx()
+	if err != nil {
+		return nil, err
+	}
+	res, err := fn()
+	if err != nil {
+		s.RollbackTx()
+		return nil, err
+	}
+	return res, s.CommitTx()
+}
+
+// ============================================================================================================================
+// Keys - sorted list of every key in committed world state, handy for assertions
+// ============================================================================================================================
+func (s *MemStub) Keys() []string {
+	var keys []string
+	for key := range s.state {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ============================================================================================================================
+// SetCertAttribute - set an attribute on the caller's certificate, e.g. SetCertAttribute("username", "bob") to call as bob
+// ============================================================================================================================
+func (s *MemStub) SetCertAttribute(attributeName string, value string) {
+	s.attributes[attributeName] = []byte(value)
+}
+
+// ============================================================================================================================
+// ReadCertAttribute - read an attribute of the caller's certificate, errors when it was never set
+// ============================================================================================================================
+func (s *MemStub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	value, ok := s.attributes[attributeName]
+	if !ok {
+		return nil, errors.New("certificate has no attribute " + attributeName)
+	}
+	return copyBytes(value), nil
+}
+
+// ============================================================================================================================
+// GetTxID - id of the current transaction
+// ============================================================================================================================
+func (s *MemStub) GetTxID() string {
+	return s.txID
+}
+
+// ============================================================================================================================
+// SetTxID - force the id of the current transaction, e.g. to replay one
+// ============================================================================================================================
+func (s *MemStub) SetTxID(id string) {
+	s.txID = id
+}
+
+// ============================================================================================================================
+// TxTimestamp - timestamp of the current transaction in ms
+// ============================================================================================================================
+func (s *MemStub) TxTimestamp() (int64, error) {
+	return s.txTimestamp, nil
+}
+
+// ============================================================================================================================
+// SetTxTimestamp - force the timestamp of the current transaction, later transactions count up from it
+// ============================================================================================================================
+func (s *MemStub) SetTxTimestamp(ms int64) {
+	s.txTimestamp = ms
+}
+
+// ============================================================================================================================
+// SetEvent - record a chaincode event, kept with the open transaction until it commits
+//   like the peer only the last event set in a transaction is kept
+// ============================================================================================================================
+func (s *MemStub) SetEvent(name string, payload []byte) error {
+	if name == "" {
+		return errors.New("event name must not be an empty string")
+	}
+	ev := Event{Name: name, Payload: copyBytes(payload)}
+	if s.inTx {
+		s.txEvent = &ev
+		return nil
+	}
+	s.events = append(s.events, ev)
+	return nil
+}
+
+// ============================================================================================================================
+// Events - the event of every committed transaction that set one, oldest first
+// ============================================================================================================================
+func (s *MemStub) Events() []Event {
+	events := make([]Event, len(s.events))
+	copy(events, s.events)
+	return events
+}
+
+// ============================================================================================================================
+// ClearEvents - forget the recorded events, e.g. between steps of a test
+// ============================================================================================================================
+func (s *MemStub) ClearEvents() {
+	s.events = nil
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
@@ -0,0 +1,149 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+
+package memstub
+
+import (
+	"errors"
+	"testing"
+)
+
+// ============================================================================================================================
+// TestGetStateSeesOpenTx - a transaction reads its own writes and deletes, nobody sees them until it commits
+// ============================================================================================================================
+func TestGetStateSeesOpenTx(t *testing.T) {
+	s := NewMemStub()
+	s.PutState("a", []byte("1"))
+	s.PutState("b", []byte("2"))
+
+	s.BeginTx()
+	s.PutState("a", []byte("3"))
+	s.DelState("b")
+	s.PutState("c", []byte("4"))
+	if v, _ := s.GetState("a"); string(v) != "3" {
+		t.Fatalf("a = %q, want the open transaction's 3", v)
+	}
+	if v, _ := s.GetState("b"); v != nil {
+		t.Fatalf("b = %q, want it deleted by the open transaction", v)
+	}
+	if v, _ := s.GetState("c"); string(v) != "4" {
+		t.Fatalf("c = %q, want the open transaction's 4", v)
+	}
+	if keys := s.Keys(); len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Fatalf("committed keys = %v, want [a b] until the commit", keys)
+	}
+}
+
+// ============================================================================================================================
+// TestCommitTx - the buffered writes and deletes land in world state
+// ============================================================================================================================
+func TestCommitTx(t *testing.T) {
+	s := NewMemStub()
+	s.PutState("a", []byte("1"))
+	s.PutState("b", []byte("2"))
+
+	s.BeginTx()
+	s.PutState("a", []byte("3"))
+	s.DelState("b")
+	s.SetEvent("changing", []byte("a"))
+	s.SetEvent("changed", []byte("a"))											//replaces the first, as on the peer
+	if err := s.CommitTx(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.GetState("a"); string(v) != "3" {
+		t.Fatalf("a = %q, want 3", v)
+	}
+	if keys := s.Keys(); len(keys) != 1 || keys[0] != "a" {
+		t.Fatalf("keys = %v, want [a]", keys)
+	}
+	if events := s.Events(); len(events) != 1 || events[0].Name != "changed" {
+		t.Fatalf("events = %v, want the committed one", events)
+	}
+	if err := s.CommitTx(); err == nil {
+		t.Fatal("CommitTx without an open transaction should fail")
+	}
+}
+
+// ============================================================================================================================
+// TestRollbackTx - a failed Invoke leaves world state and events as they were
+// ============================================================================================================================
+func TestRollbackTx(t *testing.T) {
+	s := NewMemStub()
+	s.PutState("a", []byte("1"))
+
+	_, err := s.Invoke(func() ([]byte, error) {
+		s.PutState("a", []byte("2"))
+		s.PutState("b", []byte("3"))
+		s.SetEvent("changed", nil)
+		return nil, errors.New("failed")
+	})
+	if err == nil || err.Error() != "failed" {
+		t.Fatalf("Invoke returned %v, want the function's error", err)
+	}
+	if v, _ := s.GetState("a"); string(v) != "1" {
+		t.Fatalf("a = %q, want 1 after the rollback", v)
+	}
+	if v, _ := s.GetState("b"); v != nil {
+		t.Fatalf("b = %q, want nothing after the rollback", v)
+	}
+	if events := s.Events(); len(events) != 0 {
+		t.Fatalf("events = %v, want none after the rollback", events)
+	}
+	if err := s.BeginTx(); err != nil {
+		t.Fatal("a rolled back transaction should leave none open: ", err)
+	}
+}
+
+// ============================================================================================================================
+// TestTxIDAndTimestamp - each transaction gets a fresh id and a timestamp one second after the last
+// ============================================================================================================================
+func TestTxIDAndTimestamp(t *testing.T) {
+	s := NewMemStub()
+	var ids []string
+	var times []int64
+	for i := 0; i < 2; i++ {
+		s.Invoke(func() ([]byte, error) {
+			now, _ := s.TxTimestamp()
+			ids = append(ids, s.GetTxID())
+			times = append(times, now)
+			return nil, nil
+		})
+	}
+	if ids[0] != "tx1" || ids[1] != "tx2" {
+		t.Fatalf("ids = %v, want [tx1 tx2]", ids)
+	}
+	if times[0] != startTimestamp + 1000 || times[1] != times[0] + 1000 {
+		t.Fatalf("timestamps = %v, want one second apart from %d", times, startTimestamp + 1000)
+	}
+}
+
+// ============================================================================================================================
+// TestCertAttributes - attributes read back as set, a missing one is an error like on the peer
+// ============================================================================================================================
+func TestCertAttributes(t *testing.T) {
+	s := NewMemStub()
+	if _, err := s.ReadCertAttribute("username"); err == nil {
+		t.Fatal("reading an attribute that was never set should fail")
+	}
+	s.SetCertAttribute("username", "bob")
+	if v, err := s.ReadCertAttribute("username"); err != nil || string(v) != "bob" {
+		t.Fatalf("username = %q, %v, want bob", v, err)
+	}
+}
@@ -25,6 +25,13 @@ import (
 	"strconv"
 	"encoding/json"
 	"strings"
+	"sort"
+	"math/big"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
 
 	"github.com/openblockchain/obc-peer/openchain/chaincode/shim"
 )
@@ -33,14 +40,185 @@ import (
 type SimpleChaincode struct {
 }
 
+// ArgSpec - one positional argument of a chaincode function
+type ArgSpec struct{
+	Name string
+	Type string									//argString or argInt
+	Required bool								//required arguments must be given and non-empty, optional ones may be left off or empty
+}
+
+// Handler - a chaincode function and the arguments it takes, checked before it runs
+type Handler struct{
+	Fn func(*SimpleChaincode, ChaincodeStubInterface, []string) ([]byte, error)
+	Args []ArgSpec
+	MoreArgs bool								//more arguments may follow the declared ones, the function checks those itself
+	Admin bool									//only admins may call it
+	FromJSON func(map[string]json.RawMessage) ([]string, error)	//positional arguments from the fields of a JSON object argument, when they are not just the declared ones
+	After func(ChaincodeStubInterface) error	//runs in the same transaction once the function has succeeded
+}
+
+var argString = "string"
+var argInt = "int"
+
+// ChaincodeStubInterface - the parts of *shim.ChaincodeStub the chaincode functions use, lets an in-memory stub stand in for tests
+type ChaincodeStubInterface interface {
+	GetState(key string) ([]byte, error)
+	PutState(key string, value []byte) error
+	DelState(key string) error
+	ReadCertAttribute(attributeName string) ([]byte, error)
+	SetEvent(name string, payload []byte) error
+	TxTimestamp() (int64, error)							//in ms, 0 when the peer gives no transaction timestamp
+}
+
+// peerStub - *shim.ChaincodeStub plus the helpers ChaincodeStubInterface expects on top of it, only GetState, PutState and
+// DelState are taken from the obc-peer shim so the rest is filled in here
+type peerStub struct {
+	*shim.ChaincodeStub
+}
+
+// ReadCertAttribute - obc-peer certificates carry no attributes, the caller has to sign for themselves, see signedCaller
+func (s peerStub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	return nil, errors.New("obc-peer certificates have no " + attributeName + " attribute, end the call with a signed caller argument")
+}
+
+// SetEvent - obc-peer has no chaincode events, there is nobody to deliver them to
+func (s peerStub) SetEvent(name string, payload []byte) error {
+	return nil
+}
+
+// TxTimestamp - obc-peer does not tell the chaincode its transaction timestamp, and each peer's own clock would have them
+// disagree, so there is none
+func (s peerStub) TxTimestamp() (int64, error) {
+	return 0, nil
+}
+
+// callerStub - a stub whose caller is the user a signed caller argument was verified for
+type callerStub struct {
+	ChaincodeStubInterface
+	user string
+}
+
+// ReadCertAttribute - the verified user for the caller attribute, anything else is up to the stub underneath
+func (s callerStub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	if attributeName == callerAttr {
+		return []byte(s.user), nil
+	}
+	return s.ChaincodeStubInterface.ReadCertAttribute(attributeName)
+}
+
+var logLevels = []string{"error", "info", "debug"}	//levels init's log_level takes, each prints everything the ones before it do
+var logLevel = 1								//index into logLevels, info leaves out the chatty per-marble and per-trade detail
+var logLevelStr = "_loglevel"					//name for the key/value holding the level init set, so a restarted peer logs the same
+var logLevelLoaded = false						//whether logLevel has been read from the ledger since the chaincode started
+var reservedPrefix = "_"						//keys starting with this are the chaincode's own, write and delete refuse them
+var marblePrefix = "_marble_"					//each marble is stored under this prefix + its name
 var marbleIndexStr = "_marbleindex"				//name for the key/value that will store a list of all known marbles
+var adminIndexStr = "_admins"					//name for the key/value that will store a list of all admin users
 var openTradesStr = "_opentrades"				//name for the key/value that will store all open trades
+var ownerIndexPrefix = "_owner_"				//owner index, this prefix + user lists the marbles they own
+var colorSizeIndexPrefix = "_colorsize_"		//color/size index, this prefix + color_size lists the marbles that look like that
+var colorIndexPrefix = "_color_"				//color index, this prefix + color lists the marbles of that color
+var indexKeysStr = "_indexkeys"					//name for the key/value listing every owner, color and color/size index key, so they can be emptied for a rebuild
+var defaultPageSize = 25						//marbles per page of a query when no limit is given
+var maxPageSize = 100							//most marbles a query will return in one page
+var schemaVersion = 2							//version written into every new marble, records without one are version 1
+var schemaVersionStr = "_schemaversion"			//name for the key/value holding the version every record has been migrated to
+var migrationStr = "_migration"					//name for the key/value holding how far an unfinished migrate has got
+var migrateBatchSize = 50						//records migrate looks at per call when no limit is given
+var historyPrefix = "_history_"					//ownership history, this prefix + marble name lists every transfer of it
+var callerAttr = "username"						//transaction certificate attribute holding the caller's marble user name
+var callerKeyPrefix = "_callerkey_"				//key a user signs calls with, this prefix + user, for peers whose certificates have no callerAttr
+var signedCallerPrefix = "_caller:"				//an invoke whose last argument starts with this is signed by the caller it names
+
+// CallerKey - the public key a user signs calls with
+type CallerKey struct{
+	Key string `json:"key"`						//base64 of the PKIX encoded ECDSA public key
+	Nonce int64 `json:"nonce"`					//nonce of the last call the user signed, the next one has to be bigger
+}
+
+// SignedCaller - what follows signedCallerPrefix in a signed caller argument
+type SignedCaller struct{
+	User string `json:"user"`
+	Nonce int64 `json:"nonce"`
+	Signature string `json:"signature"`		//base64 of the ASN.1 ECDSA signature of the SHA-256 of callMessage
+}
 
 type Marble struct{
 	Name string `json:"name"`					//the fieldtags are needed to keep case from bouncing around
 	Color string `json:"color"`
 	Size int `json:"size"`
 	User string `json:"user"`
+	Version int `json:"version,omitempty"`			//schema version the record was written or migrated to, missing for version 1
+}
+
+// Transfer - one entry in a marble's ownership history
+type Transfer struct{
+	From string `json:"from"`						//previous owner, empty when the marble was created
+	To string `json:"to"`							//new owner
+	Reason string `json:"reason"`					//init_marble, set_user or the id of the trade that moved it
+	Timestamp int64 `json:"timestamp,omitempty"`		//utc timestamp of the transaction in ms, left out when the peer gives none
+}
+
+// BrokenRecord - a stored record that does not parse as JSON, found by scan_records and verify_state
+type BrokenRecord struct{
+	Key string `json:"key"`
+	Error string `json:"error"`
+	Repairable bool `json:"repairable"`			//true if the record could be rebuilt from the old string format
+}
+
+// MarbleNotFoundError - returned when a marble name has no record on the ledger
+type MarbleNotFoundError struct{
+	Name string
+}
+
+func (e *MarbleNotFoundError) Error() string {
+	return "marble " + e.Name + " does not exist"
+}
+
+// MarbleEvent - JSON payload of the chaincode events, fields that do not apply to an event are left out
+type MarbleEvent struct{
+	Marble string `json:"marble,omitempty"`			//name of the marble
+	OldOwner string `json:"old_owner,omitempty"`
+	NewOwner string `json:"new_owner,omitempty"`
+	Trade string `json:"trade,omitempty"`				//id of the trade
+	Transfers []MarbleEvent `json:"transfers,omitempty"`	//every marble a trade moved
+	Trades []string `json:"trades,omitempty"`			//ids of every trade pruned
+}
+
+// Migration - progress of migrate, kept on the ledger between calls until every record is at schemaVersion
+type Migration struct{
+	Version int `json:"version"`				//schema version being migrated to
+	Stage string `json:"stage"`					//records being migrated, "marbles" then "indexes", "done" once finished
+	Bookmark string `json:"bookmark"`			//name or id of the last record looked at in this stage, sorted like a page of marbles
+	Migrated int `json:"migrated"`				//records upgraded so far
+	Broken []string `json:"broken,omitempty"`	//records that did not decode and were left for repair_records
+}
+
+// invokeFunctions - every function an invocation can call
+var invokeFunctions = map[string]Handler{
+	"init": {Fn: (*SimpleChaincode).init, Args: []ArgSpec{{"value", argInt, true}, {"admin", argString, false}, {"force", argString, false}, {"log_level", argString, false}, {"admin_key", argString, false}}, Admin: true},		//initialize the chaincode state, used as reset
+	"delete": {Fn: (*SimpleChaincode).Delete, Args: []ArgSpec{{"name", argString, true}}, Admin: true},		//deletes an entity from its state
+	"write": {Fn: (*SimpleChaincode).Write, Args: []ArgSpec{{"name", argString, true}, {"value", argString, false}}, Admin: true},		//writes a value to the chaincode state
+	"add_admin": {Fn: (*SimpleChaincode).add_admin, Args: []ArgSpec{{"user", argString, true}}, Admin: true},		//let another user call admin functions
+	"remove_admin": {Fn: (*SimpleChaincode).remove_admin, Args: []ArgSpec{{"user", argString, true}}, Admin: true},		//stop a user calling admin functions
+	"set_caller_key": {Fn: (*SimpleChaincode).set_caller_key, Args: []ArgSpec{{"user", argString, true}, {"key", argString, true}}},		//register the key a user signs calls with
+	"init_marble": {Fn: (*SimpleChaincode).init_marble, Args: []ArgSpec{{"name", argString, true}, {"color", argString, true}, {"size", argInt, true}, {"user", argString, true}}},		//create a new marble
+	"migrate": {Fn: (*SimpleChaincode).migrate, Args: []ArgSpec{{"limit", argInt, false}}, Admin: true},		//upgrade records to the current schema version, a batch at a time
+	"migrate_keys": {Fn: (*SimpleChaincode).migrate_keys, Admin: true},		//move marbles stored under their bare name into their own keys
+	"rebuild_indexes": {Fn: (*SimpleChaincode).rebuild_indexes, Admin: true},		//regenerate owner, color and color/size indexes
+	"repair_records": {Fn: (*SimpleChaincode).repair_records, Admin: true},		//rewrite marble records that do not parse
+	"set_user": {Fn: (*SimpleChaincode).set_user, Args: []ArgSpec{{"name", argString, true}, {"user", argString, true}}},		//change owner of a marble
+}
+
+// queryFunctions - every function a query can call
+var queryFunctions = map[string]Handler{
+	"read": {Fn: (*SimpleChaincode).read, Args: []ArgSpec{{"name", argString, true}}},		//read a variable
+	"marbles_by_owner": {Fn: (*SimpleChaincode).marbles_by_owner, Args: []ArgSpec{{"owner", argString, true}, {"bookmark", argString, false}, {"limit", argInt, false}}},		//page of marbles owned by a user
+	"marbles_by_color": {Fn: (*SimpleChaincode).marbles_by_color, Args: []ArgSpec{{"color", argString, true}, {"bookmark", argString, false}, {"limit", argInt, false}}},		//page of marbles of a color
+	"marbles_matching": {Fn: (*SimpleChaincode).marbles_matching, Args: []ArgSpec{{"color", argString, true}, {"min_size", argInt, true}, {"max_size", argInt, true}, {"bookmark", argString, false}, {"limit", argInt, false}}},		//page of marbles of a color within a size range
+	"marble_history": {Fn: (*SimpleChaincode).marble_history, Args: []ArgSpec{{"name", argString, true}}},		//every owner a marble has had
+	"scan_records": {Fn: (*SimpleChaincode).scan_records},		//report marble records that do not parse
+	"verify_state": {Fn: (*SimpleChaincode).verify_state},		//report every stored value that does not decode
 }
 
 // ============================================================================================================================
@@ -49,26 +227,19 @@ type Marble struct{
 func main() {
 	err := shim.Start(new(SimpleChaincode))
 	if err != nil {
-		fmt.Printf("Error starting Simple chaincode: %s", err)
+		logError("Error starting Simple chaincode: " + err.Error())
 	}
 }
 
 // ============================================================================================================================
-// Init - reset all the things
+// Init - set up the ledger, one already set up keeps its marbles and has them migrated unless an admin forces a reset
 // ============================================================================================================================
-func (t *SimpleChaincode) init(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+func (t *SimpleChaincode) init(stub ChaincodeStubInterface, args []string) ([]byte, error) {
 	var Aval int
 	var err error
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
-	}
-
 	// Initialize the chaincode
-	Aval, err = strconv.Atoi(args[0])
-	if err != nil {
-		return nil, errors.New("Expecting integer value for asset holding")
-	}
+	Aval, _ = strconv.Atoi(args[0])												//checkArgs made sure it is a number
 
 	// Write the state to the ledger
 	err = stub.PutState("abc", []byte(strconv.Itoa(Aval)))				//making a test var "abc", I find it handy to read/write to it right away to test the network
@@ -76,67 +247,367 @@ func (t *SimpleChaincode) init(stub *shim.ChaincodeStub, args []string) ([]byte,
 		return nil, err
 	}
 	
-	var empty []string
-	jsonAsBytes, _ := json.Marshal(empty)								//marshal an emtpy array of strings to clear the index
-	err = stub.PutState(marbleIndexStr, jsonAsBytes)
+	force := false
+	if args[2] != "" {
+		force, err = strconv.ParseBool(args[2])
+		if err != nil {
+			return nil, errors.New("init's force argument must be true or false")
+		}
+	}
+	
+	if args[3] != "" {
+		level, err := parseLogLevel(args[3])
+		if err != nil {
+			return nil, err
+		}
+		err = stub.PutState(logLevelStr, []byte(logLevels[level]))
+		if err != nil {
+			return nil, err
+		}
+		logLevel, logLevelLoaded = level, true
+	}
+	
+	admins, err := getAdmins(stub)
 	if err != nil {
 		return nil, err
 	}
+	indexAsBytes, err := stub.GetState(marbleIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get marble index")
+	}
+	if len(indexAsBytes) != 0 && !force {								//already set up, keep the marbles and bring how they are stored up to date
+		err = restartIndexes(stub)											//the indexes may predate the marbles, or be missing altogether
+		if err != nil {
+			return nil, err
+		}
+		_, err = t.migrate(stub, []string{""})								//the first batch, an admin calls migrate until it is done
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if len(indexAsBytes) != 0 {
+			if len(admins) == 0 {
+				return nil, errors.New("init only wipes existing marbles for an admin")
+			}
+			err = clearMarbles(stub)										//remove them rather than orphan them
+			if err != nil {
+				return nil, err
+			}
+		}
+		var empty []string
+		jsonAsBytes, _ := json.Marshal(empty)							//marshal an emtpy array of strings to clear the index
+		err = stub.PutState(marbleIndexStr, jsonAsBytes)
+		if err != nil {
+			return nil, err
+		}
+		err = stub.PutState(schemaVersionStr, []byte(strconv.Itoa(schemaVersion)))	//nothing to migrate on an empty ledger
+		if err != nil {
+			return nil, err
+		}
+		err = stub.DelState(migrationStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	
+	if len(admins) == 0 && len(indexAsBytes) != 0 {						//init runs for anyone until there is an admin, so it only names one on an empty ledger
+		if args[1] != "" || args[4] != "" {
+			return nil, errors.New("the first admin can only be named on an empty ledger")
+		}
+	} else if len(admins) == 0 {
+		admin := args[1]
+		if admin == "" {
+			admin, err = getCaller(stub)
+			if err != nil {
+				return nil, errors.New("init needs an admin, pass one or call with a certificate carrying the " + callerAttr + " attribute")
+			}
+		}
+		admin = strings.ToLower(admin)
+		err = putAdmins(stub, []string{admin})
+		if err != nil {
+			return nil, err
+		}
+		if args[4] != "" {
+			err = putCallerKey(stub, admin, args[4])							//so the admin can sign calls on a peer without caller attributes
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else if args[4] != "" {
+		return nil, errors.New("init only takes an admin_key along with the first admin, set_caller_key registers the others")
+	}
 	
 	return nil, nil
 }
 
+// ============================================================================================================================
+// clearMarbles - delete every marble in the index along with its owner and color index entries,
+//   ownership history is kept
+// ============================================================================================================================
+func clearMarbles(stub ChaincodeStubInterface) error {
+	marblesAsBytes, err := stub.GetState(marbleIndexStr)
+	if err != nil {
+		return errors.New("Failed to get marble index")
+	}
+	var marbleIndex []string
+	err = decodeJSON(marbleIndexStr, marblesAsBytes, &marbleIndex)
+	if err != nil {
+		return err
+	}
+	for _, name := range marbleIndex{
+		res, err := getMarble(stub, name)
+		if _, missing := err.(*MarbleNotFoundError); missing {
+			continue
+		}
+		if err == nil {
+			err = unindexMarble(stub, res)
+			if err != nil {
+				return err
+			}
+		}
+		err = stub.DelState(marbleKey(name))										//one that does not decode goes too
+		if err != nil {
+			return errors.New("Failed to delete marble " + name)
+		}
+	}
+	return nil
+}
+
 // ============================================================================================================================
 // Run - Our entry point
 // ============================================================================================================================
 func (t *SimpleChaincode) Run(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
-	fmt.Println("run is running " + function)
+	return t.run(peerStub{stub}, function, args)
+}
 
-	// Handle different functions
-	if function == "init" {													//initialize the chaincode state, used as reset
-		return t.init(stub, args)
-	} else if function == "delete" {										//deletes an entity from its state
-		return t.Delete(stub, args)
-	} else if function == "write" {											//writes a value to the chaincode state
-		return t.Write(stub, args)
-	} else if function == "init_marble" {									//create a new marble
-		return t.init_marble(stub, args)
-	} else if function == "set_user" {										//change owner of a marble
-		return t.set_user(stub, args)
-	}
-	fmt.Println("run did not find func: " + function)						//error
+// ============================================================================================================================
+// run - dispatch an invocation against any ChaincodeStubInterface
+// ============================================================================================================================
+func (t *SimpleChaincode) run(stub ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	loadLogLevel(stub)
+	logInfo("run is running " + function)
 
-	return nil, errors.New("Received unknown function invocation")
+	handler, ok := invokeFunctions[function]
+	if !ok {
+		logError("run did not find func: " + function)						//error
+		return nil, errors.New("Received unknown function invocation")
+	}
+	stub, args, err := signedCaller(stub, function, args)
+	if err != nil {
+		logError(err.Error())
+		return nil, err
+	}
+	return t.callWithEvent(stub, function, handler, args)
 }
 
 // ============================================================================================================================
 // Query - Our entry point for Queries
 // ============================================================================================================================
 func (t *SimpleChaincode) Query(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
-	fmt.Println("query is running " + function)
+	return t.query(peerStub{stub}, function, args)
+}
+
+// ============================================================================================================================
+// query - dispatch a query against any ChaincodeStubInterface
+// ============================================================================================================================
+func (t *SimpleChaincode) query(stub ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	loadLogLevel(stub)
+	logInfo("query is running " + function)
+
+	handler, ok := queryFunctions[function]
+	if !ok {
+		logError("query did not find func: " + function)						//error
+		return nil, errors.New("Received unknown function query")
+	}
+	return t.call(stub, function, handler, args)
+}
+
+// ============================================================================================================================
+// call - check and convert a function's arguments, given positionally or as one JSON object, and that the caller
+//   may call it, then run it
+// ============================================================================================================================
+func (t *SimpleChaincode) call(stub ChaincodeStubInterface, function string, handler Handler, args []string) ([]byte, error) {
+	args, err := argsFromJSON(function, handler, args)
+	if err == nil {
+		args, err = checkArgs(function, handler, args)
+	}
+	if err == nil && handler.Admin {
+		err = checkAdmin(stub, function)
+	}
+	if err != nil {
+		logError(err.Error())
+		return nil, err
+	}
+	res, err := handler.Fn(t, stub, args)
+	if err == nil && handler.After != nil {
+		err = handler.After(stub)
+	}
+	return res, err
+}
+
+// ============================================================================================================================
+// callWithEvent - call, gathering the events the function raises into the one the transaction sets
+// ============================================================================================================================
+func (t *SimpleChaincode) callWithEvent(stub ChaincodeStubInterface, function string, handler Handler, args []string) ([]byte, error) {
+	pending := &eventStub{ChaincodeStubInterface: stub}
+	res, err := t.call(pending, function, handler, args)
+	if err == nil && pending.name != "" {
+		err = setEvent(stub, pending.name, pending.ev)							//one event for the whole transaction
+	}
+	return res, err
+}
+
+// ============================================================================================================================
+// argsFromJSON - positional arguments from a single JSON object argument with a field per declared argument,
+//   e.g. {"name": "m1", "user": "bob"} for set_user. Any other args are positional and come back unchanged
+// ============================================================================================================================
+func argsFromJSON(function string, handler Handler, args []string) ([]string, error) {
+	if len(args) != 1 || !strings.HasPrefix(strings.TrimSpace(args[0]), "{") {
+		return args, nil
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal([]byte(args[0]), &fields) != nil {
+		return args, nil														//not an object after all, e.g. a name starting with {
+	}
+	
+	if handler.FromJSON != nil {
+		checkedFields, err := handler.FromJSON(fields)							//functions with a variable number of arguments name them their own way
+		if err != nil {
+			return nil, errors.New(function + " " + err.Error())
+		}
+		return checkedFields, nil
+	}
+	
+	positional := make([]string, len(handler.Args))
+	for i, spec := range handler.Args{
+		raw, ok := fields[spec.Name]
+		if !ok {
+			continue															//left empty, checkArgs reports it if it is required
+		}
+		delete(fields, spec.Name)
+		value, err := jsonArg(raw)
+		if err != nil {
+			return nil, errors.New(function + " field " + spec.Name + " " + err.Error())
+		}
+		positional[i] = value
+	}
+	for name := range fields{
+		return nil, errors.New(function + " has no argument named " + name)
+	}
+	return positional, nil
+}
+
+// ============================================================================================================================
+// jsonArg - a JSON string, number or bool field as a positional argument, null is left empty
+// ============================================================================================================================
+func jsonArg(raw json.RawMessage) (string, error) {
+	text := strings.TrimSpace(string(raw))
+	if text == "null" {
+		return "", nil
+	}
+	if text == "true" || text == "false" {
+		return text, nil
+	}
+	if strings.HasPrefix(text, "\"") {
+		var value string
+		err := json.Unmarshal(raw, &value)
+		return value, err
+	}
+	var number json.Number
+	if json.Unmarshal(raw, &number) != nil {
+		return "", errors.New("must be a string or a number")
+	}
+	return number.String(), nil
+}
+
+// ============================================================================================================================
+// checkArgs - check args against the function's declared arguments, optional arguments left off come back empty
+//   and ints come back in canonical form, so the function can index and convert them without checking again
+// ============================================================================================================================
+func checkArgs(function string, handler Handler, args []string) ([]string, error) {
+	if len(args) < requiredArgs(handler) || (len(args) > len(handler.Args) && !handler.MoreArgs) {
+		return nil, errors.New(function + " expects " + argUsage(handler))
+	}
+	
+	checked := make([]string, len(args))
+	copy(checked, args)
+	for i, spec := range handler.Args{
+		if i >= len(checked) {
+			checked = append(checked, "")
+			continue
+		}
+		if checked[i] == "" {
+			if spec.Required {
+				return nil, errors.New(function + " argument " + strconv.Itoa(i + 1) + " (" + spec.Name + ") must be a non-empty string")
+			}
+			continue
+		}
+		if spec.Type == argInt {
+			n, err := strconv.Atoi(strings.TrimSpace(checked[i]))
+			if err != nil {
+				return nil, errors.New(function + " argument " + strconv.Itoa(i + 1) + " (" + spec.Name + ") must be a numeric string")
+			}
+			checked[i] = strconv.Itoa(n)
+		}
+	}
+	return checked, nil
+}
 
-	// Handle different functions
-	if function == "read" {													//read a variable
-		return t.read(stub, args)
+// ============================================================================================================================
+// requiredArgs - how many arguments a function must be given, required arguments come before optional ones
+// ============================================================================================================================
+func requiredArgs(handler Handler) int {
+	required := 0
+	for _, spec := range handler.Args{
+		if spec.Required {
+			required++
+		}
 	}
-	fmt.Println("query did not find func: " + function)						//error
+	return required
+}
 
-	return nil, errors.New("Received unknown function query")
+// ============================================================================================================================
+// argUsage - what a function expects, e.g. "2 arguments: name, user" or "1 to 3 arguments: owner, [bookmark], [limit]"
+// ============================================================================================================================
+func argUsage(handler Handler) string {
+	required := requiredArgs(handler)
+	count := strconv.Itoa(required)
+	if handler.MoreArgs {
+		count = "at least " + count
+	} else if required < len(handler.Args) {
+		count += " to " + strconv.Itoa(len(handler.Args))
+	}
+	
+	var names []string
+	for _, spec := range handler.Args{
+		if spec.Required {
+			names = append(names, spec.Name)
+		} else {
+			names = append(names, "[" + spec.Name + "]")
+		}
+	}
+	if handler.MoreArgs {
+		names = append(names, "...")
+	}
+	usage := count + " arguments"
+	if len(names) > 0 {
+		usage += ": " + strings.Join(names, ", ")
+	}
+	return usage
 }
 
 // ============================================================================================================================
 // Read - read a variable from chaincode state
 // ============================================================================================================================
-func (t *SimpleChaincode) read(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+func (t *SimpleChaincode) read(stub ChaincodeStubInterface, args []string) ([]byte, error) {
 	var name, jsonResp string
 	var err error
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting name of the var to query")
-	}
-
 	name = args[0]
-	valAsbytes, err := stub.GetState(name)									//get the var from chaincode state
+	valAsbytes, err := stub.GetState(marbleKey(name))							//a marble by name
+	if err == nil && len(valAsbytes) == 0 {
+		valAsbytes, err = stub.GetState(name)								//else the var from chaincode state, e.g. an index or what write stored
+	}
 	if err != nil {
 		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
 		return nil, errors.New(jsonResp)
@@ -146,18 +617,157 @@ func (t *SimpleChaincode) read(stub *shim.ChaincodeStub, args []string) ([]byte,
 }
 
 // ============================================================================================================================
-// Delete - remove a key/value pair from state
+// Marbles By Owner - JSON array of the marbles a user owns, in name order
+// ============================================================================================================================
+func (t *SimpleChaincode) marbles_by_owner(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0        1            2
+	// "bob", *"bookmark", "limit"*
+	bookmark, limit, err := pagingArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	
+	owner := strings.ToLower(args[0])
+	names, err := indexedNames(stub, ownerKey(owner))
+	if err != nil {
+		return nil, err
+	}
+	return pageOfMarbles(stub, names, bookmark, limit, func(m Marble) bool {
+		return strings.ToLower(m.User) == owner
+	})
+}
+
+// ============================================================================================================================
+// Marbles By Color - JSON array of the marbles of a color, in name order
+// ============================================================================================================================
+func (t *SimpleChaincode) marbles_by_color(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0         1            2
+	// "blue", *"bookmark", "limit"*
+	bookmark, limit, err := pagingArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	
+	color := strings.ToLower(args[0])
+	names, err := indexedNames(stub, colorKey(color))
+	if err != nil {
+		return nil, err
+	}
+	return pageOfMarbles(stub, names, bookmark, limit, func(m Marble) bool {
+		return strings.ToLower(m.Color) == color
+	})
+}
+
+// ============================================================================================================================
+// Marbles Matching - JSON array of the marbles of a color with a size in [min, max], in name order
+// ============================================================================================================================
+func (t *SimpleChaincode) marbles_matching(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0       1     2         3            4
+	// "blue", "10", "20", *"bookmark", "limit"*
+	minSize, _ := strconv.Atoi(args[1])											//checkArgs made sure both are numbers
+	maxSize, _ := strconv.Atoi(args[2])
+	bookmark, limit, err := pagingArgs(args, 3)
+	if err != nil {
+		return nil, err
+	}
+	
+	color := strings.ToLower(args[0])
+	names, err := indexedNames(stub, colorKey(color))
+	if err != nil {
+		return nil, err
+	}
+	return pageOfMarbles(stub, names, bookmark, limit, func(m Marble) bool {
+		return strings.ToLower(m.Color) == color && m.Size >= minSize && m.Size <= maxSize
+	})
+}
+
+// ============================================================================================================================
+// Marble History - every owner a marble has had, oldest first
+// ============================================================================================================================
+func (t *SimpleChaincode) marble_history(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// "name"
+	history, err := getHistory(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(history)
+}
+
+// ============================================================================================================================
+// pagingArgs - the optional bookmark and limit found at args[i] and args[i+1]
 // ============================================================================================================================
-func (t *SimpleChaincode) Delete(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+func pagingArgs(args []string, i int) (string, int, error) {
+	bookmark := ""
+	limit := defaultPageSize
+	if len(args) > i {
+		bookmark = args[i]
 	}
+	if len(args) > i + 1 && args[i + 1] != "" {
+		limit, _ = strconv.Atoi(args[i + 1])
+		if limit <= 0 {
+			return "", 0, errors.New("limit must be a positive numeric string")
+		}
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	return bookmark, limit, nil
+}
+
+// ============================================================================================================================
+// pageOfMarbles - up to limit marbles from names that keep accepts, sorted by name and starting after bookmark
+//   the bookmark for the next page is the name of the last marble returned, "" starts at the beginning
+// ============================================================================================================================
+func pageOfMarbles(stub ChaincodeStubInterface, names []string, bookmark string, limit int, keep func(Marble) bool) ([]byte, error) {
+	sorted := make([]string, len(names))
+	copy(sorted, names)
+	sort.Strings(sorted)
+	
+	page := []Marble{}
+	for _, name := range sorted{
+		if len(page) >= limit {
+			break
+		}
+		if name <= bookmark {
+			continue
+		}
+		res, err := getMarble(stub, name)
+		if _, missing := err.(*MarbleNotFoundError); missing {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if keep(res) {															//indexes can be stale, check the marble itself
+			page = append(page, res)
+		}
+	}
+	return json.Marshal(page)
+}
+
+// ============================================================================================================================
+// Delete - remove a key/value pair from state
+// ============================================================================================================================
+func (t *SimpleChaincode) Delete(stub ChaincodeStubInterface, args []string) ([]byte, error) {
 	
 	name := args[0]
-	err := stub.DelState(name)													//remove the key from chaincode state
+	err := checkName(name)
+	if err != nil {
+		return nil, err
+	}
+	res, err := getMarble(stub, name)											//only delete marbles that exist
+	if err != nil {
+		return nil, err
+	}
+	err = stub.DelState(marbleKey(name))										//remove the key from chaincode state
 	if err != nil {
 		return nil, errors.New("Failed to delete state")
 	}
+	err = unindexMarble(stub, res)
+	if err != nil {
+		return nil, err
+	}
 
 	//get the marble index
 	marblesAsBytes, err := stub.GetState(marbleIndexStr)
@@ -165,39 +775,46 @@ func (t *SimpleChaincode) Delete(stub *shim.ChaincodeStub, args []string) ([]byt
 		return nil, errors.New("Failed to get marble index")
 	}
 	var marbleIndex []string
-	json.Unmarshal(marblesAsBytes, &marbleIndex)								//un stringify it aka JSON.parse()
+	err = decodeJSON(marbleIndexStr, marblesAsBytes, &marbleIndex)
+	if err != nil {
+		return nil, err
+	}
 	
 	//remove marble from index
 	for i,val := range marbleIndex{
-		fmt.Println(strconv.Itoa(i) + " - looking at " + val + " for " + name)
+		logDebug(strconv.Itoa(i) + " - looking at " + val + " for " + name)
 		if val == name{															//find the correct marble
-			fmt.Println("found marble")
+			logDebug("found marble")
 			marbleIndex = append(marbleIndex[:i], marbleIndex[i+1:]...)			//remove it
 			for x:= range marbleIndex{											//debug prints...
-				fmt.Println(string(x) + " - " + marbleIndex[x])
+				logDebug(strconv.Itoa(x) + " - " + marbleIndex[x])
 			}
 			break
 		}
 	}
 	jsonAsBytes, _ := json.Marshal(marbleIndex)									//save new index
 	err = stub.PutState(marbleIndexStr, jsonAsBytes)
-	return nil, nil
+	if err != nil {
+		return nil, err
+	}
+	err = emitEvent(stub, "marble_deleted", MarbleEvent{Marble: name, OldOwner: res.User})
+	return nil, err
 }
 
 // ============================================================================================================================
 // Write - write variable into chaincode state
 // ============================================================================================================================
-func (t *SimpleChaincode) Write(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+func (t *SimpleChaincode) Write(stub ChaincodeStubInterface, args []string) ([]byte, error) {
 	var name, value string // Entities
 	var err error
-	fmt.Println("running write()")
-
-	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2. name of the variable and value to set")
-	}
+	logDebug("running write()")
 
 	name = args[0]															//rename for funsies
 	value = args[1]
+	err = checkName(name)													//the chaincode's own keys are off limits
+	if err != nil {
+		return nil, err
+	}
 	err = stub.PutState(name, []byte(value))								//write the variable into the chaincode state
 	if err != nil {
 		return nil, err
@@ -206,41 +823,366 @@ func (t *SimpleChaincode) Write(stub *shim.ChaincodeStub, args []string) ([]byte
 }
 
 // ============================================================================================================================
-// Init Marble - create a new marble, store into chaincode state
+// Migrate Keys - one shot move of every marble stored under its bare name into its own key, a second run does nothing
 // ============================================================================================================================
-func (t *SimpleChaincode) init_marble(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
-	var err error
-
-	//   0       1       2     3
-	// "asdf", "blue", "35", "bob"
-	if len(args) != 4 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+func (t *SimpleChaincode) migrate_keys(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	logDebug("- start migrate keys")
+	indexAsBytes, err := stub.GetState(marbleIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get marble index")
 	}
-
-	fmt.Println("- start init marble")
-	if len(args[0]) <= 0 {
-		return nil, errors.New("1st argument must be a non-empty string")
+	var index []string
+	err = decodeJSON(marbleIndexStr, indexAsBytes, &index)
+	if err != nil {
+		return nil, err
+	}
+	
+	for _, name := range index{
+		moved, err := moveKey(stub, name, marbleKey(name))
+		if err != nil {
+			return nil, err
+		}
+		if moved {
+			logInfo("! migrated marble " + name)
+		}
 	}
-	if len(args[1]) <= 0 {
-		return nil, errors.New("2nd argument must be a non-empty string")
+	logDebug("- end migrate keys")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Migrate - upgrade records to schemaVersion, looking at up to limit of them. A ledger too big for one transaction
+//   takes several calls, each carrying on from where the last stopped. Returns the progress, stage "done" once finished
+// ============================================================================================================================
+func (t *SimpleChaincode) migrate(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0
+	// *"limit"*
+	limit := migrateBatchSize
+	if args[0] != "" {
+		limit, _ = strconv.Atoi(args[0])
+		if limit <= 0 {
+			return nil, errors.New("limit must be a positive numeric string")
+		}
 	}
-	if len(args[2]) <= 0 {
-		return nil, errors.New("3rd argument must be a non-empty string")
+	logDebug("- start migrate")
+	progress, err := getMigration(stub)
+	if err != nil {
+		return nil, err
 	}
-	if len(args[3]) <= 0 {
-		return nil, errors.New("4th argument must be a non-empty string")
+	
+	for limit > 0 && progress.Stage != "done" {
+		var n int
+		switch progress.Stage {
+		case "marbles":
+			n, err = migrateMarbles(stub, &progress, limit)
+		case "indexes":
+			n, err = indexMarbles(stub, &progress, limit)
+		default:
+			return nil, errors.New("Unknown migration stage " + progress.Stage)
+		}
+		if err != nil {
+			return nil, err
+		}
+		limit -= n
 	}
 	
-	size, err := strconv.Atoi(args[2])
+	if progress.Stage == "done" {
+		err = stub.PutState(schemaVersionStr, []byte(strconv.Itoa(progress.Version)))
+		if err == nil {
+			err = stub.DelState(migrationStr)											//nothing left to resume
+		}
+	} else {
+		jsonAsBytes, _ := json.Marshal(progress)
+		err = stub.PutState(migrationStr, jsonAsBytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logDebug("- end migrate, stage " + progress.Stage)
+	return json.Marshal(progress)
+}
+
+// ============================================================================================================================
+// getMigration - the progress of an unfinished migrate, or a fresh start unless the ledger is already at schemaVersion
+// ============================================================================================================================
+func getMigration(stub ChaincodeStubInterface) (Migration, error) {
+	progress := Migration{Version: schemaVersion, Stage: "marbles"}
+	progressAsBytes, err := stub.GetState(migrationStr)
+	if err != nil {
+		return progress, errors.New("Failed to get migration")
+	}
+	if len(progressAsBytes) == 0 {
+		versionAsBytes, err := stub.GetState(schemaVersionStr)
+		if err != nil {
+			return progress, errors.New("Failed to get schema version")
+		}
+		version, _ := strconv.Atoi(string(versionAsBytes))
+		if version >= schemaVersion {
+			progress.Stage = "done"												//already migrated, nothing to walk
+		}
+		return progress, nil
+	}
+	err = decodeJSON(migrationStr, progressAsBytes, &progress)
+	return progress, err
+}
+
+// ============================================================================================================================
+// restartIndexes - have migrate rebuild the indexes of a ledger that is already at schemaVersion, an unfinished
+//   migrate is left to carry on and rebuilds them when it gets there
+// ============================================================================================================================
+func restartIndexes(stub ChaincodeStubInterface) error {
+	progress, err := getMigration(stub)
+	if err != nil {
+		return err
+	}
+	if progress.Stage != "done" {
+		return nil
+	}
+	progress.Stage = "indexes"
+	jsonAsBytes, _ := json.Marshal(progress)
+	return stub.PutState(migrationStr, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// sortedIndex - the names or ids in an index, sorted
+// ============================================================================================================================
+func sortedIndex(stub ChaincodeStubInterface, indexStr string) ([]string, error) {
+	indexAsBytes, err := stub.GetState(indexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get " + indexStr)
+	}
+	var index []string
+	err = decodeJSON(indexStr, indexAsBytes, &index)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(index)
+	return index, nil
+}
+
+// ============================================================================================================================
+// migrateMarbles - upgrade up to limit marbles after the bookmark, moving on to the indexes once all are done.
+//   Returns how many it looked at
+// ============================================================================================================================
+func migrateMarbles(stub ChaincodeStubInterface, progress *Migration, limit int) (int, error) {
+	names, err := sortedIndex(stub, marbleIndexStr)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, name := range names{
+		if name <= progress.Bookmark {
+			continue
+		}
+		if n >= limit {
+			return n, nil
+		}
+		n++
+		_, err = moveKey(stub, name, marbleKey(name))								//still under its bare name from before marbles had their own keys
+		if err != nil {
+			return n, err
+		}
+		res, err := getMarble(stub, name)
+		if _, missing := err.(*MarbleNotFoundError); missing {
+			progress.Bookmark = name
+			continue
+		}
+		if err != nil {
+			progress.Broken = append(progress.Broken, name)
+		} else if upgradeMarble(&res) {
+			jsonAsBytes, _ := json.Marshal(res)
+			err = stub.PutState(marbleKey(name), jsonAsBytes)
+			if err != nil {
+				return n, errors.New("Failed to rewrite marble " + name)
+			}
+			progress.Migrated++
+		}
+		progress.Bookmark = name
+	}
+	progress.Stage, progress.Bookmark = "indexes", ""
+	return n, nil
+}
+
+// ============================================================================================================================
+// upgradeMarble - bring a marble up to schemaVersion, false if it already was
+// ============================================================================================================================
+func upgradeMarble(m *Marble) bool {
+	if m.Version >= schemaVersion {
+		return false
+	}
+	m.Color = strings.ToLower(m.Color)											//1 to 2 - colors and users were not always lowercased
+	m.User = strings.ToLower(m.User)
+	m.Version = schemaVersion
+	return true
+}
+
+// ============================================================================================================================
+// indexMarbles - rebuild the owner, color and color/size indexes from up to limit marbles after the bookmark, done once
+//   all are. The first batch empties every index key, so owners left with nothing drop out of them.
+//   Marbles that do not decode are left out and listed as broken. Returns how many it looked at
+// ============================================================================================================================
+func indexMarbles(stub ChaincodeStubInterface, progress *Migration, limit int) (int, error) {
+	if progress.Bookmark == "" {
+		err := clearIndexes(stub)
+		if err != nil {
+			return 0, err
+		}
+	}
+	names, err := sortedIndex(stub, marbleIndexStr)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, name := range names{
+		if name <= progress.Bookmark {
+			continue
+		}
+		if n >= limit {
+			return n, nil
+		}
+		n++
+		res, err := getMarble(stub, name)
+		if _, missing := err.(*MarbleNotFoundError); missing {
+			progress.Bookmark = name
+			continue																//stale name in the marble index
+		}
+		if err != nil {
+			logError("left " + name + " out of the indexes: " + err.Error())
+			if !containsName(progress.Broken, name) {							//the marbles stage may have listed it already
+				progress.Broken = append(progress.Broken, name)
+			}
+		} else {
+			err = indexMarble(stub, res)
+			if err != nil {
+				return n, err
+			}
+		}
+		progress.Bookmark = name
+	}
+	progress.Stage, progress.Bookmark = "done", ""
+	return n, nil
+}
+
+// ============================================================================================================================
+// clearIndexes - empty every owner, color and color/size index key, ready to be rebuilt from the marbles
+// ============================================================================================================================
+func clearIndexes(stub ChaincodeStubInterface) error {
+	keys, err := getNameList(stub, indexKeysStr)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys{
+		err = putNameList(stub, key, []string{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Add Admin - let another user call admin functions
+// ============================================================================================================================
+func (t *SimpleChaincode) add_admin(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// "bob"
+	user := strings.ToLower(args[0])
+	admins, err := getAdmins(stub)
+	if err != nil {
+		return nil, err
+	}
+	if containsName(admins, user) {
+		return nil, nil														//already one
+	}
+	err = putAdmins(stub, append(admins, user))
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Remove Admin - stop a user calling admin functions, the last admin can not be removed
+// ============================================================================================================================
+func (t *SimpleChaincode) remove_admin(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// "bob"
+	user := strings.ToLower(args[0])
+	admins, err := getAdmins(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !containsName(admins, user) {
+		return nil, errors.New(user + " is not an admin")
+	}
+	if len(admins) == 1 {
+		return nil, errors.New("Can not remove the last admin " + user)
+	}
+	err = putAdmins(stub, removeName(admins, user))
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// set_caller_key - register the public key a user signs calls with, an admin can set anyone's and users can replace their own
+// ============================================================================================================================
+func (t *SimpleChaincode) set_caller_key(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0       1
+	// "bob", "MFkw..."
+	user := strings.ToLower(args[0])
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	if caller != user {
+		err = checkAdmin(stub, "set_caller_key")
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = putCallerKey(stub, user, args[1])
+	if err != nil {
+		return nil, err
+	}
+	logInfo("- end set_caller_key " + user)
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Init Marble - create a new marble, store into chaincode state
+// ============================================================================================================================
+func (t *SimpleChaincode) init_marble(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+
+	//   0       1       2     3
+	// "asdf", "blue", "35", "bob"
+
+	logDebug("- start init marble")
+	err = checkName(args[0])
 	if err != nil {
-		return nil, errors.New("3rd argument must be a numeric string")
+		return nil, err
 	}
 	
+	size, _ := strconv.Atoi(args[2])												//checkArgs made sure it is a number
+	
 	color := strings.ToLower(args[1])
 	user := strings.ToLower(args[3])
 
-	str := `{"name": "` + args[0] + `", "color": "` + color + `", "size": ` + strconv.Itoa(size) + `, "user": "` + user + `"}`
-	err = stub.PutState(args[0], []byte(str))								//store marble with id as key
+	//check if marble already exists
+	_, err = getMarble(stub, args[0])
+	if err == nil {
+		logError("This marble arleady exists: " + args[0])
+		return nil, errors.New("This marble arleady exists")				//all stop a marble by this name exists
+	}
+	if _, ok := err.(*MarbleNotFoundError); !ok {
+		return nil, err
+	}
+
+	marble := Marble{Name: args[0], Color: color, Size: size, User: user, Version: schemaVersion}
+	marbleAsBytes, _ := json.Marshal(marble)
+	err = stub.PutState(marbleKey(args[0]), marbleAsBytes)						//store marble with id as key
 	if err != nil {
 		return nil, err
 	}
@@ -251,46 +1193,889 @@ func (t *SimpleChaincode) init_marble(stub *shim.ChaincodeStub, args []string) (
 		return nil, errors.New("Failed to get marble index")
 	}
 	var marbleIndex []string
-	json.Unmarshal(marblesAsBytes, &marbleIndex)							//un stringify it aka JSON.parse()
+	err = decodeJSON(marbleIndexStr, marblesAsBytes, &marbleIndex)
+	if err != nil {
+		return nil, err
+	}
 	
+	if containsName(marbleIndex, args[0]) {									//still under its bare name, migrate_keys has not moved it yet
+		logError("This marble arleady exists: " + args[0])
+		return nil, errors.New("This marble arleady exists")
+	}
+
 	//append
 	marbleIndex = append(marbleIndex, args[0])								//add marble name to index list
-	fmt.Println("! marble index: ", marbleIndex)
+	logDebug("! marble index: ", marbleIndex)
 	jsonAsBytes, _ := json.Marshal(marbleIndex)
 	err = stub.PutState(marbleIndexStr, jsonAsBytes)						//store name of marble
+	if err != nil {
+		return nil, err
+	}
+	err = indexMarble(stub, marble)
+	if err != nil {
+		return nil, err
+	}
+	err = recordTransfer(stub, args[0], "", user, "init_marble")
+	if err != nil {
+		return nil, err
+	}
+	err = emitEvent(stub, "marble_created", MarbleEvent{Marble: args[0], NewOwner: user})
+	if err != nil {
+		return nil, err
+	}
 
-	fmt.Println("- end init marble")
+	logDebug("- end init marble")
 	return nil, nil
 }
 
 // ============================================================================================================================
 // Set User Permission on Marble
 // ============================================================================================================================
-func (t *SimpleChaincode) set_user(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+func (t *SimpleChaincode) set_user(stub ChaincodeStubInterface, args []string) ([]byte, error) {
 	var err error
 	
 	//   0       1
 	// "name", "bob"
-	if len(args) < 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2")
-	}
 	
-	fmt.Println("- start set user")
-	fmt.Println(args[0] + " - " + args[1])
-	marbleAsBytes, err := stub.GetState(args[0])
+	logDebug("- start set user")
+	logDebug(args[0] + " - " + args[1])
+	res, err := getMarble(stub, args[0])
+	if err != nil {
+		logError(err.Error())
+		return nil, err
+	}
+
+	caller, err := getCaller(stub)
 	if err != nil {
-		return nil, errors.New("Failed to get thing")
+		return nil, err
+	}
+	if caller != strings.ToLower(res.User) {									//only the owner can give a marble away
+		msg := caller + " does not own marble " + args[0]
+		logError(msg)
+		return nil, errors.New(msg)
 	}
-	res := Marble{}
-	json.Unmarshal(marbleAsBytes, &res)										//un stringify it aka JSON.parse()
-	res.User = args[1]														//change the user
+	oldUser := res.User
+	res.User = strings.ToLower(args[1])										//change the user
 	
 	jsonAsBytes, _ := json.Marshal(res)
-	err = stub.PutState(args[0], jsonAsBytes)								//rewrite the marble with id as key
+	err = stub.PutState(marbleKey(args[0]), jsonAsBytes)						//rewrite the marble with id as key
+	if err != nil {
+		return nil, err
+	}
+	err = reindexOwner(stub, args[0], oldUser, res.User)
+	if err != nil {
+		return nil, err
+	}
+	err = recordTransfer(stub, args[0], oldUser, res.User, "set_user")
+	if err != nil {
+		return nil, err
+	}
+	err = emitEvent(stub, "marble_transferred", MarbleEvent{Marble: args[0], OldOwner: oldUser, NewOwner: res.User})
 	if err != nil {
 		return nil, err
 	}
 	
-	fmt.Println("- end set user")
+	logDebug("- end set user")
 	return nil, nil
 }
+
+// ============================================================================================================================
+// emitEvent - raise a named chaincode event so clients can subscribe instead of polling read
+//   inside call the event is held back by the eventStub, so a transaction sets a single event when it is done
+// ============================================================================================================================
+func emitEvent(stub ChaincodeStubInterface, name string, ev MarbleEvent) error {
+	if pending, ok := stub.(*eventStub); ok {
+		pending.add(name, ev)
+		return nil
+	}
+	return setEvent(stub, name, ev)
+}
+
+// ============================================================================================================================
+// setEvent - hand an event to the peer
+// ============================================================================================================================
+func setEvent(stub ChaincodeStubInterface, name string, ev MarbleEvent) error {
+	payload, _ := json.Marshal(ev)
+	err := stub.SetEvent(name, payload)
+	if err != nil {
+		return errors.New("Failed to set event " + name)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// eventStub - the stub a function is called with, it collects the events raised along the way because the peer
+//   only delivers the last event set in a transaction
+// ============================================================================================================================
+type eventStub struct{
+	ChaincodeStubInterface
+	name string											//name of the event to set, empty while nothing was raised
+	ev MarbleEvent
+}
+
+// ============================================================================================================================
+// add - merge an event into the one the transaction will set
+// ============================================================================================================================
+func (s *eventStub) add(name string, ev MarbleEvent) {
+	switch {
+	case s.name == "":
+		s.name = name
+		s.ev = ev
+	case name == "trades_pruned":										//pruned trades ride along with the change that caused it
+		s.ev.Trades = append(s.ev.Trades, ev.Trades...)
+	case name == s.name:												//e.g. every cycle match_trades fills
+		s.ev.Transfers = append(s.ev.Transfers, ev.Transfers...)
+		s.ev.Trades = append(s.ev.Trades, ev.Trades...)
+	default:															//the later event names the transaction, keeping what the earlier ones moved and pruned
+		ev.Transfers = append(s.ev.Transfers, ev.Transfers...)
+		ev.Trades = append(s.ev.Trades, ev.Trades...)
+		s.name = name
+		s.ev = ev
+	}
+}
+
+// ============================================================================================================================
+// decodeJSON - unmarshal the value stored under key into v, an empty value leaves v untouched
+//   anything that does not decode is an error naming the key, so a corrupt value is never mistaken for an empty one
+// ============================================================================================================================
+func decodeJSON(key string, valueAsBytes []byte, v interface{}) error {
+	if len(valueAsBytes) == 0 {
+		return nil
+	}
+	err := json.Unmarshal(valueAsBytes, v)
+	if err != nil {
+		return errors.New("Failed to decode " + key + ": " + err.Error())
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// logError, logInfo, logDebug - print a line like fmt.Println, if the log level is at least error, info or debug
+// ============================================================================================================================
+func logError(a ...interface{}) {
+	logAt(0, a...)
+}
+
+func logInfo(a ...interface{}) {
+	logAt(1, a...)
+}
+
+func logDebug(a ...interface{}) {
+	logAt(2, a...)
+}
+
+func logAt(level int, a ...interface{}) {
+	if level <= logLevel {
+		fmt.Println(append([]interface{}{"[" + logLevels[level] + "]"}, a...)...)
+	}
+}
+
+// ============================================================================================================================
+// parseLogLevel - the index in logLevels of a level name
+// ============================================================================================================================
+func parseLogLevel(name string) (int, error) {
+	for i, level := range logLevels{
+		if level == strings.ToLower(name) {
+			return i, nil
+		}
+	}
+	return 0, errors.New("log_level must be one of " + strings.Join(logLevels, ", "))
+}
+
+// ============================================================================================================================
+// loadLogLevel - pick up the level init stored, once after the chaincode starts
+// ============================================================================================================================
+func loadLogLevel(stub ChaincodeStubInterface) {
+	if logLevelLoaded {
+		return
+	}
+	logLevelLoaded = true
+	levelAsBytes, err := stub.GetState(logLevelStr)
+	if err != nil || len(levelAsBytes) == 0 {
+		return
+	}
+	level, err := parseLogLevel(string(levelAsBytes))
+	if err == nil {
+		logLevel = level
+	}
+}
+
+// ============================================================================================================================
+// getCaller - the marble user making this call, read from an attribute of the transaction certificate
+// ============================================================================================================================
+func getCaller(stub ChaincodeStubInterface) (string, error) {
+	userAsBytes, err := stub.ReadCertAttribute(callerAttr)
+	if err != nil {
+		return "", err														//says how to sign for yourself instead
+	}
+	if len(userAsBytes) == 0 {
+		return "", errors.New("Failed to read the " + callerAttr + " attribute of the caller's certificate")
+	}
+	return strings.ToLower(string(userAsBytes)), nil
+}
+
+// ============================================================================================================================
+// signedCaller - for a call whose last argument is a signed caller argument, _caller:{"user": "bob", "nonce": 7,
+//   "signature": "MEUC..."}, a stub that reads the caller from it and the arguments without it. The signature must be
+//   by the key registered for the user and the nonce bigger than any they used before, so a call can not be replayed.
+//   Other calls come back unchanged
+// ============================================================================================================================
+func signedCaller(stub ChaincodeStubInterface, function string, args []string) (ChaincodeStubInterface, []string, error) {
+	if len(args) == 0 || !strings.HasPrefix(args[len(args)-1], signedCallerPrefix) {
+		return stub, args, nil
+	}
+	var signed SignedCaller
+	err := json.Unmarshal([]byte(strings.TrimPrefix(args[len(args)-1], signedCallerPrefix)), &signed)
+	if err != nil {
+		return nil, nil, errors.New("Failed to decode the signed caller argument: " + err.Error())
+	}
+	args = args[:len(args)-1]
+	user := strings.ToLower(signed.User)
+	callerKey, err := getCallerKey(stub, user)
+	if err != nil {
+		return nil, nil, err
+	}
+	if callerKey.Key == "" {
+		return nil, nil, errors.New("no key is registered for " + user + ", an admin sets one with set_caller_key")
+	}
+	if signed.Nonce <= callerKey.Nonce {
+		return nil, nil, errors.New("signed call by " + user + " needs a nonce above " + strconv.FormatInt(callerKey.Nonce, 10))
+	}
+	err = verifySignature(callerKey.Key, callMessage(function, args, signed.Nonce), signed.Signature)
+	if err != nil {
+		return nil, nil, errors.New("signed call by " + user + ": " + err.Error())
+	}
+	
+	callerKey.Nonce = signed.Nonce
+	jsonAsBytes, _ := json.Marshal(callerKey)
+	err = stub.PutState(callerKeyPrefix + user, jsonAsBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return callerStub{stub, user}, args, nil
+}
+
+// ============================================================================================================================
+// callMessage - what a signed caller argument signs, the function, its arguments and the nonce as a JSON array of strings
+// ============================================================================================================================
+func callMessage(function string, args []string, nonce int64) []byte {
+	message := append([]string{function}, args...)
+	messageAsBytes, _ := json.Marshal(append(message, strconv.FormatInt(nonce, 10)))
+	return messageAsBytes
+}
+
+// ============================================================================================================================
+// parseCallerKey - the ECDSA public key in a caller key, base64 of its PKIX encoding
+// ============================================================================================================================
+func parseCallerKey(key string) (*ecdsa.PublicKey, error) {
+	keyAsBytes, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, errors.New("caller key is not base64")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(keyAsBytes)
+	if err != nil {
+		return nil, errors.New("caller key is not a PKIX public key")
+	}
+	ecdsaKey, ok := publicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("caller key is not an ECDSA key")
+	}
+	return ecdsaKey, nil
+}
+
+// ============================================================================================================================
+// verifySignature - error unless signature, base64 of an ASN.1 ECDSA signature, signs the SHA-256 of message with key
+// ============================================================================================================================
+func verifySignature(key string, message []byte, signature string) error {
+	publicKey, err := parseCallerKey(key)
+	if err != nil {
+		return err
+	}
+	sigAsBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.New("signature is not base64")
+	}
+	var sig struct{
+		R, S *big.Int
+	}
+	_, err = asn1.Unmarshal(sigAsBytes, &sig)
+	if err != nil {
+		return errors.New("signature is not an ASN.1 ECDSA signature")
+	}
+	hash := sha256.Sum256(message)
+	if !ecdsa.Verify(publicKey, hash[:], sig.R, sig.S) {
+		return errors.New("signature does not match the call")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// getCallerKey - the key a user signs calls with, empty when none is registered
+// ============================================================================================================================
+func getCallerKey(stub ChaincodeStubInterface, user string) (CallerKey, error) {
+	var callerKey CallerKey
+	keyAsBytes, err := stub.GetState(callerKeyPrefix + user)
+	if err != nil {
+		return callerKey, errors.New("Failed to get caller key of " + user)
+	}
+	if len(keyAsBytes) == 0 {
+		return callerKey, nil
+	}
+	err = json.Unmarshal(keyAsBytes, &callerKey)
+	if err != nil {
+		return callerKey, errors.New("Failed to decode caller key of " + user)
+	}
+	return callerKey, nil
+}
+
+// ============================================================================================================================
+// putCallerKey - register the key user signs calls with, keeping the last nonce so old calls stay spent
+// ============================================================================================================================
+func putCallerKey(stub ChaincodeStubInterface, user string, key string) error {
+	_, err := parseCallerKey(key)
+	if err != nil {
+		return err
+	}
+	callerKey, err := getCallerKey(stub, user)
+	if err != nil {
+		return err
+	}
+	callerKey.Key = key
+	jsonAsBytes, _ := json.Marshal(callerKey)
+	return stub.PutState(callerKeyPrefix + user, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// checkName - error if a user chosen name or key is in the reserved namespace of the chaincode's own keys
+// ============================================================================================================================
+func checkName(name string) error {
+	if strings.HasPrefix(name, reservedPrefix) {
+		return errors.New(name + " is reserved, names and keys can not start with " + reservedPrefix)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Marble Key - the key a marble is stored under, kept apart from the keys write can reach
+// ============================================================================================================================
+func marbleKey(name string) string {
+	return marblePrefix + name
+}
+
+// ============================================================================================================================
+// moveKey - move a value still stored under its old key to key, does nothing once it has moved
+// ============================================================================================================================
+func moveKey(stub ChaincodeStubInterface, oldKey string, key string) (bool, error) {
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return false, errors.New("Failed to get " + key)
+	}
+	if len(existing) != 0 {
+		return false, nil
+	}
+	valueAsBytes, err := stub.GetState(oldKey)
+	if err != nil {
+		return false, errors.New("Failed to get " + oldKey)
+	}
+	if len(valueAsBytes) == 0 {
+		return false, nil
+	}
+	err = stub.PutState(key, valueAsBytes)
+	if err != nil {
+		return false, err
+	}
+	err = stub.DelState(oldKey)
+	if err != nil {
+		return false, errors.New("Failed to delete " + oldKey)
+	}
+	return true, nil
+}
+
+// ============================================================================================================================
+// getAdmins - the users allowed to call admin functions, set up by the first init
+// ============================================================================================================================
+func getAdmins(stub ChaincodeStubInterface) ([]string, error) {
+	adminsAsBytes, err := stub.GetState(adminIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get admins")
+	}
+	var admins []string
+	err = decodeJSON(adminIndexStr, adminsAsBytes, &admins)
+	if err != nil {
+		return nil, err
+	}
+	return admins, nil
+}
+
+// ============================================================================================================================
+// putAdmins - store the users allowed to call admin functions
+// ============================================================================================================================
+func putAdmins(stub ChaincodeStubInterface, admins []string) error {
+	jsonAsBytes, _ := json.Marshal(admins)
+	return stub.PutState(adminIndexStr, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// checkAdmin - error unless the caller is an admin. Until the first init stores an admin there are none and only init
+//   may run
+// ============================================================================================================================
+func checkAdmin(stub ChaincodeStubInterface, function string) error {
+	admins, err := getAdmins(stub)
+	if err != nil {
+		return err
+	}
+	if len(admins) == 0 {
+		if function == "init" {
+			return nil
+		}
+		return errors.New(function + " is restricted to admins and there are none yet, init sets up the first")
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return err
+	}
+	if !containsName(admins, caller) {
+		return errors.New(function + " is restricted to admins, " + caller + " is not one")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// getMarble - read a marble from chaincode state, a missing key is a MarbleNotFoundError
+// ============================================================================================================================
+func getMarble(stub ChaincodeStubInterface, name string) (Marble, error) {
+	var res Marble
+	marbleAsBytes, err := stub.GetState(marbleKey(name))
+	if err != nil {
+		return res, errors.New("Failed to get marble " + name)
+	}
+	if len(marbleAsBytes) == 0 {											//the peer hands back nothing for a missing key
+		return res, &MarbleNotFoundError{name}
+	}
+	err = decodeJSON(name, marbleAsBytes, &res)
+	if err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// ============================================================================================================================
+// Owner Key - the owner index key listing every marble a user owns
+// ============================================================================================================================
+func ownerKey(user string) string {
+	return ownerIndexPrefix + strings.ToLower(user)
+}
+
+// ============================================================================================================================
+// Color Size Key - the color/size index key listing every marble of that color and size
+// ============================================================================================================================
+func colorSizeKey(color string, size int) string {
+	return colorSizeIndexPrefix + strings.ToLower(color) + "_" + strconv.Itoa(size)
+}
+
+// ============================================================================================================================
+// Color Key - the color index key listing every marble of that color
+// ============================================================================================================================
+func colorKey(color string) string {
+	return colorIndexPrefix + strings.ToLower(color)
+}
+
+// ============================================================================================================================
+// getNameList - read a list of marble names, a missing key is an empty list
+// ============================================================================================================================
+func getNameList(stub ChaincodeStubInterface, key string) ([]string, error) {
+	listAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Failed to get index " + key)
+	}
+	var names []string
+	err = decodeJSON(key, listAsBytes, &names)
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// ============================================================================================================================
+// putNameList - rewrite a list of marble names
+// ============================================================================================================================
+func putNameList(stub ChaincodeStubInterface, key string, names []string) error {
+	if names == nil {
+		names = []string{}													//store [] rather than null
+	}
+	jsonAsBytes, _ := json.Marshal(names)
+	return stub.PutState(key, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// addToNameList - add a marble name to a list, once
+// ============================================================================================================================
+func addToNameList(stub ChaincodeStubInterface, key string, name string) error {
+	names, err := getNameList(stub, key)
+	if err != nil {
+		return err
+	}
+	if containsName(names, name) {
+		return nil
+	}
+	return putNameList(stub, key, append(names, name))
+}
+
+// ============================================================================================================================
+// removeFromNameList - take a marble name out of a list
+// ============================================================================================================================
+func removeFromNameList(stub ChaincodeStubInterface, key string, name string) error {
+	names, err := getNameList(stub, key)
+	if err != nil {
+		return err
+	}
+	for i, val := range names{
+		if val == name{
+			return putNameList(stub, key, append(names[:i], names[i+1:]...))
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// containsName - true if name is in the list
+// ============================================================================================================================
+func containsName(names []string, name string) bool {
+	for _, val := range names{
+		if val == name{
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// removeName - names without name
+// ============================================================================================================================
+func removeName(names []string, name string) []string {
+	var kept []string
+	for _, n := range names{
+		if n != name {
+			kept = append(kept, n)
+		}
+	}
+	return kept
+}
+
+// ============================================================================================================================
+// indexKeys - every secondary index key a marble belongs in
+// ============================================================================================================================
+func indexKeys(m Marble) []string {
+	return []string{ownerKey(m.User), colorKey(m.Color), colorSizeKey(m.Color, m.Size)}
+}
+
+// ============================================================================================================================
+// addToIndex - add a marble name to an owner, color or color/size index key, remembering the key for rebuilds
+// ============================================================================================================================
+func addToIndex(stub ChaincodeStubInterface, key string, name string) error {
+	err := addToNameList(stub, indexKeysStr, key)
+	if err != nil {
+		return err
+	}
+	return addToNameList(stub, key, name)
+}
+
+// ============================================================================================================================
+// indexMarble - add a marble to the owner, color and color/size indexes
+// ============================================================================================================================
+func indexMarble(stub ChaincodeStubInterface, m Marble) error {
+	for _, key := range indexKeys(m){
+		err := addToIndex(stub, key, m.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// unindexMarble - take a marble out of the owner, color and color/size indexes
+// ============================================================================================================================
+func unindexMarble(stub ChaincodeStubInterface, m Marble) error {
+	for _, key := range indexKeys(m){
+		err := removeFromNameList(stub, key, m.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// reindexOwner - move a marble from one owner's index to another's
+// ============================================================================================================================
+func reindexOwner(stub ChaincodeStubInterface, name string, from string, to string) error {
+	err := removeFromNameList(stub, ownerKey(from), name)
+	if err != nil {
+		return err
+	}
+	return addToIndex(stub, ownerKey(to), name)
+}
+
+// ============================================================================================================================
+// indexedNames - the names under an index key, or every marble while migrate has yet to rebuild the indexes
+//   callers check each marble they get back against what they are looking for
+// ============================================================================================================================
+func indexedNames(stub ChaincodeStubInterface, key string) ([]string, error) {
+	progress, err := getMigration(stub)
+	if err != nil {
+		return nil, err
+	}
+	if progress.Stage != "done" {
+		return getNameList(stub, marbleIndexStr)
+	}
+	return getNameList(stub, key)
+}
+
+// ============================================================================================================================
+// historyKey - the key holding a marble's ownership history, it outlives the marble so a reused name keeps its past
+// ============================================================================================================================
+func historyKey(name string) string {
+	return historyPrefix + name
+}
+
+// ============================================================================================================================
+// recordTransfer - append an entry to a marble's ownership history, entries are never rewritten
+// ============================================================================================================================
+func recordTransfer(stub ChaincodeStubInterface, name string, from string, to string, reason string) error {
+	now, err := stub.TxTimestamp()
+	if err != nil {
+		return errors.New("Failed to get transaction timestamp")
+	}
+	history, err := getHistory(stub, name)
+	if err != nil {
+		return err
+	}
+	history = append(history, Transfer{From: from, To: to, Reason: reason, Timestamp: now})
+	jsonAsBytes, _ := json.Marshal(history)
+	err = stub.PutState(historyKey(name), jsonAsBytes)
+	if err != nil {
+		return errors.New("Failed to write history of marble " + name)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// getHistory - a marble's ownership history, oldest first, empty if it never had one
+// ============================================================================================================================
+func getHistory(stub ChaincodeStubInterface, name string) ([]Transfer, error) {
+	history := []Transfer{}
+	historyAsBytes, err := stub.GetState(historyKey(name))
+	if err != nil {
+		return nil, errors.New("Failed to get history of marble " + name)
+	}
+	err = decodeJSON(historyKey(name), historyAsBytes, &history)
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// ============================================================================================================================
+// Rebuild Indexes - regenerate the owner, color and color/size indexes from the marble index, for ledgers that predate
+//   them or whose indexes went stale. Marbles that do not decode are left out, the JSON array returned names them
+// ============================================================================================================================
+func (t *SimpleChaincode) rebuild_indexes(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	logDebug("- start rebuild indexes")
+	progress := Migration{Version: schemaVersion, Stage: "indexes", Broken: []string{}}
+	for progress.Stage == "indexes" {											//every batch, in this one transaction
+		_, err := indexMarbles(stub, &progress, migrateBatchSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	logDebug("- end rebuild indexes")
+	return json.Marshal(progress.Broken)
+}
+
+// ============================================================================================================================
+// Scan Records - report every marble in the index whose record does not parse
+// ============================================================================================================================
+func (t *SimpleChaincode) scan_records(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	broken, _, err := brokenMarbles(stub)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(broken)
+}
+
+// ============================================================================================================================
+// Repair Records - rewrite every broken marble record that can be rebuilt, returns what scan_records would have reported
+// ============================================================================================================================
+func (t *SimpleChaincode) repair_records(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	logDebug("- start repair records")
+	broken, repaired, err := brokenMarbles(stub)
+	if err != nil {
+		return nil, err
+	}
+	for _, marble := range repaired{
+		jsonAsBytes, _ := json.Marshal(marble)
+		err = stub.PutState(marbleKey(marble.Name), jsonAsBytes)
+		if err != nil {
+			return nil, errors.New("Failed to rewrite marble " + marble.Name)
+		}
+		logInfo("! repaired marble " + marble.Name)
+	}
+	logDebug("- end repair records")
+	return json.Marshal(broken)
+}
+
+// ============================================================================================================================
+// brokenMarbles - every marble in the index whose record does not parse, plus a rebuilt marble for each one that can be
+// ============================================================================================================================
+func brokenMarbles(stub ChaincodeStubInterface) ([]BrokenRecord, []Marble, error) {
+	marblesAsBytes, err := stub.GetState(marbleIndexStr)
+	if err != nil {
+		return nil, nil, errors.New("Failed to get marble index")
+	}
+	var marbleIndex []string
+	err = decodeJSON(marbleIndexStr, marblesAsBytes, &marbleIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+	
+	broken := []BrokenRecord{}
+	var repaired []Marble
+	for _, name := range marbleIndex{
+		marbleAsBytes, err := stub.GetState(marbleKey(name))
+		if err != nil {
+			return nil, nil, errors.New("Failed to get marble " + name)
+		}
+		if len(marbleAsBytes) == 0 {
+			continue																//deleted, nothing to parse
+		}
+		var res Marble
+		err = json.Unmarshal(marbleAsBytes, &res)
+		if err == nil {
+			continue
+		}
+		marble, ok := parseLegacyMarble(string(marbleAsBytes))
+		ok = ok && marble.Name == name
+		broken = append(broken, BrokenRecord{Key: name, Error: err.Error(), Repairable: ok})
+		if ok {
+			repaired = append(repaired, marble)
+		}
+	}
+	return broken, repaired, nil
+}
+
+// ============================================================================================================================
+// parseLegacyMarble - read a marble written by the old init_marble, which built the JSON by hand
+// ============================================================================================================================
+func parseLegacyMarble(str string) (Marble, bool) {
+	fields, ok := splitLegacy(str, []string{`{"name": "`, `", "color": "`, `", "size": `, `, "user": "`, `"}`})
+	if !ok {
+		return Marble{}, false
+	}
+	size, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return Marble{}, false
+	}
+	return Marble{Name: fields[0], Color: fields[1], Size: size, User: fields[3]}, true
+}
+
+// ============================================================================================================================
+// splitLegacy - the fields between seps in a record built by concatenating strings, as records were before
+//   they were marshalled, seps[0] must start it and the last sep end it
+// ============================================================================================================================
+func splitLegacy(str string, seps []string) ([]string, bool) {
+	first := seps[0]
+	last := seps[len(seps) - 1]
+	if len(str) < len(first) + len(last) || !strings.HasPrefix(str, first) || !strings.HasSuffix(str, last) {
+		return nil, false
+	}
+	rest := str[len(first):len(str) - len(last)]
+	var fields []string
+	for _, sep := range seps[1:len(seps) - 1]{
+		i := strings.Index(rest, sep)
+		if i < 0 {
+			return nil, false
+		}
+		fields = append(fields, rest[:i])
+		rest = rest[i + len(sep):]
+	}
+	return append(fields, rest), true
+}
+
+// ============================================================================================================================
+// Verify State - walk the marble index, every marble and the owner, color and history keys hanging off them,
+//   and report every value that does not decode
+// ============================================================================================================================
+func (t *SimpleChaincode) verify_state(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	problems := []BrokenRecord{}
+	var admins []string
+	problems, _, err := checkState(stub, adminIndexStr, &admins, problems)
+	if err != nil {
+		return nil, err
+	}
+	var marbleIndex []string
+	problems, ok, err := checkState(stub, marbleIndexStr, &marbleIndex, problems)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		broken, _, err := brokenMarbles(stub)										//marble records, with whether repair_records can fix them
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, broken...)
+	}
+	
+	var trackedKeys []string
+	problems, _, err = checkState(stub, indexKeysStr, &trackedKeys, problems)
+	if err != nil {
+		return nil, err
+	}
+	checked := make(map[string]bool)											//marbles share index keys, check each once
+	for _, key := range trackedKeys{
+		checked[key] = true
+		var names []string
+		problems, _, err = checkState(stub, key, &names, problems)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range marbleIndex{
+		res, err := getMarble(stub, name)
+		if err != nil {
+			continue																//deleted, or already reported
+		}
+		for _, key := range indexKeys(res){
+			if checked[key] {
+				continue
+			}
+			checked[key] = true
+			var names []string
+			problems, _, err = checkState(stub, key, &names, problems)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var history []Transfer
+		problems, _, err = checkState(stub, historyKey(name), &history, problems)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(problems)
+}
+
+// ============================================================================================================================
+// checkState - decode the value under key into v, adding a BrokenRecord to problems when it does not decode
+// ============================================================================================================================
+func checkState(stub ChaincodeStubInterface, key string, v interface{}, problems []BrokenRecord) ([]BrokenRecord, bool, error) {
+	valueAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return problems, false, errors.New("Failed to get " + key)
+	}
+	err = decodeJSON(key, valueAsBytes, v)
+	if err != nil {
+		return append(problems, BrokenRecord{Key: key, Error: err.Error()}), false, nil
+	}
+	return problems, true, nil
+}
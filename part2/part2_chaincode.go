@@ -24,8 +24,14 @@ import (
 	"fmt"
 	"strconv"
 	"encoding/json"
-	"time"
 	"strings"
+	"sort"
+	"math/big"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
 
 	"github.com/openblockchain/obc-peer/openchain/chaincode/shim"
 )
@@ -34,14 +40,160 @@ import (
 type SimpleChaincode struct {
 }
 
+// ArgSpec - one positional argument of a chaincode function
+type ArgSpec struct{
+	Name string
+	Type string									//argString or argInt
+	Required bool								//required arguments must be given and non-empty, optional ones may be left off or empty
+}
+
+// Handler - a chaincode function and the arguments it takes, checked before it runs
+type Handler struct{
+	Fn func(*SimpleChaincode, ChaincodeStubInterface, []string) ([]byte, error)
+	Args []ArgSpec
+	MoreArgs bool								//more arguments may follow the declared ones, the function checks those itself
+	Admin bool									//only admins may call it
+	FromJSON func(map[string]json.RawMessage) ([]string, error)	//positional arguments from the fields of a JSON object argument, when they are not just the declared ones
+	After func(ChaincodeStubInterface) error	//runs in the same transaction once the function has succeeded
+}
+
+var argString = "string"
+var argInt = "int"
+
+// ChaincodeStubInterface - the parts of *shim.ChaincodeStub the chaincode functions use, lets an in-memory stub stand in for tests
+type ChaincodeStubInterface interface {
+	GetState(key string) ([]byte, error)
+	PutState(key string, value []byte) error
+	DelState(key string) error
+	ReadCertAttribute(attributeName string) ([]byte, error)
+	SetEvent(name string, payload []byte) error
+	GetTxID() string
+	TxTimestamp() (int64, error)							//in ms, 0 when the peer gives no transaction timestamp
+}
+
+// peerStub - *shim.ChaincodeStub plus the helpers ChaincodeStubInterface expects on top of it, only GetState, PutState and
+// DelState are taken from the obc-peer shim so the rest is filled in here
+type peerStub struct {
+	*shim.ChaincodeStub
+}
+
+// ReadCertAttribute - obc-peer certificates carry no attributes, the caller has to sign for themselves, see signedCaller
+func (s peerStub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	return nil, errors.New("obc-peer certificates have no " + attributeName + " attribute, end the call with a signed caller argument")
+}
+
+// SetEvent - obc-peer has no chaincode events, there is nobody to deliver them to
+func (s peerStub) SetEvent(name string, payload []byte) error {
+	return nil
+}
+
+// GetTxID - obc-peer does not tell the chaincode its transaction id, trades are numbered from a counter on the ledger instead
+func (s peerStub) GetTxID() string {
+	return ""
+}
+
+// TxTimestamp - obc-peer does not tell the chaincode its transaction timestamp, and each peer's own clock would have them
+// disagree, so there is none
+func (s peerStub) TxTimestamp() (int64, error) {
+	return 0, nil
+}
+
+// callerStub - a stub whose caller is the user a signed caller argument was verified for
+type callerStub struct {
+	ChaincodeStubInterface
+	user string
+}
+
+// ReadCertAttribute - the verified user for the caller attribute, anything else is up to the stub underneath
+func (s callerStub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	if attributeName == callerAttr {
+		return []byte(s.user), nil
+	}
+	return s.ChaincodeStubInterface.ReadCertAttribute(attributeName)
+}
+
+var logLevels = []string{"error", "info", "debug"}	//levels init's log_level takes, each prints everything the ones before it do
+var logLevel = 1								//index into logLevels, info leaves out the chatty per-marble and per-trade detail
+var logLevelStr = "_loglevel"					//name for the key/value holding the level init set, so a restarted peer logs the same
+var logLevelLoaded = false						//whether logLevel has been read from the ledger since the chaincode started
+var reservedPrefix = "_"						//keys starting with this are the chaincode's own, write and delete refuse them
+var marblePrefix = "_marble_"					//each marble is stored under this prefix + its name
 var marbleIndexStr = "_marbleindex"				//name for the key/value that will store a list of all known marbles
-var openTradesStr = "_opentrades"				//name for the key/value that will store all open trades
+var adminIndexStr = "_admins"					//name for the key/value that will store a list of all admin users
+var openTradesStr = "_opentrades"				//name for the key/value that stored all open trades before each got its own key
+var tradeIndexStr = "_tradeindex"				//name for the key/value that will store a list of all open trade ids
+var tradePrefix = "_trade_"						//each open trade is stored under this prefix + its id
+var tradeCounterStr = "_tradecounter"			//name for the key/value counting the trades opened without a transaction id
+var maxCycleLength = 4							//most open trades match_trades will chain into one swap
+var ownerIndexPrefix = "_owner_"				//owner index, this prefix + user lists the marbles they own
+var colorSizeIndexPrefix = "_colorsize_"		//color/size index, this prefix + color_size lists the marbles that look like that
+var colorIndexPrefix = "_color_"				//color index, this prefix + color lists the marbles of that color
+var indexKeysStr = "_indexkeys"					//name for the key/value listing every owner, color and color/size index key, so they can be emptied for a rebuild
+var defaultPageSize = 25						//marbles per page of a query when no limit is given
+var maxPageSize = 100							//most marbles a query will return in one page
+var schemaVersion = 2							//version written into every new marble and trade, records without one are version 1
+var schemaVersionStr = "_schemaversion"			//name for the key/value holding the version every record has been migrated to
+var migrationStr = "_migration"					//name for the key/value holding how far an unfinished migrate has got
+var migrateBatchSize = 50						//records migrate looks at per call when no limit is given
+var historyPrefix = "_history_"					//ownership history, this prefix + marble name lists every transfer of it
+var callerAttr = "username"						//transaction certificate attribute holding the caller's marble user name
+var callerKeyPrefix = "_callerkey_"				//key a user signs calls with, this prefix + user, for peers whose certificates have no callerAttr
+var signedCallerPrefix = "_caller:"				//an invoke whose last argument starts with this is signed by the caller it names
+
+// CallerKey - the public key a user signs calls with
+type CallerKey struct{
+	Key string `json:"key"`						//base64 of the PKIX encoded ECDSA public key
+	Nonce int64 `json:"nonce"`					//nonce of the last call the user signed, the next one has to be bigger
+}
+
+// SignedCaller - what follows signedCallerPrefix in a signed caller argument
+type SignedCaller struct{
+	User string `json:"user"`
+	Nonce int64 `json:"nonce"`
+	Signature string `json:"signature"`		//base64 of the ASN.1 ECDSA signature of the SHA-256 of callMessage
+}
 
 type Marble struct{
 	Name string `json:"name"`					//the fieldtags are needed to keep case from bouncing around
 	Color string `json:"color"`
 	Size int `json:"size"`
 	User string `json:"user"`
+	Locked string `json:"locked,omitempty"`		//id of the open trade holding this marble in escrow, empty when free
+	Version int `json:"version,omitempty"`			//schema version the record was written or migrated to, missing for version 1
+}
+
+// Transfer - one entry in a marble's ownership history
+type Transfer struct{
+	From string `json:"from"`						//previous owner, empty when the marble was created
+	To string `json:"to"`							//new owner
+	Reason string `json:"reason"`					//init_marble, set_user or the id of the trade that moved it
+	Timestamp int64 `json:"timestamp,omitempty"`		//utc timestamp of the transaction in ms, left out when the peer gives none
+}
+
+// BrokenRecord - a stored record that does not parse as JSON, found by scan_records and verify_state
+type BrokenRecord struct{
+	Key string `json:"key"`
+	Error string `json:"error"`
+	Repairable bool `json:"repairable"`			//true if the record could be rebuilt from the old string format
+}
+
+// MarbleNotFoundError - returned when a marble name has no record on the ledger
+type MarbleNotFoundError struct{
+	Name string
+}
+
+func (e *MarbleNotFoundError) Error() string {
+	return "marble " + e.Name + " does not exist"
+}
+
+// MarbleEvent - JSON payload of the chaincode events, fields that do not apply to an event are left out
+type MarbleEvent struct{
+	Marble string `json:"marble,omitempty"`			//name of the marble
+	OldOwner string `json:"old_owner,omitempty"`
+	NewOwner string `json:"new_owner,omitempty"`
+	Trade string `json:"trade,omitempty"`				//id of the trade
+	Transfers []MarbleEvent `json:"transfers,omitempty"`	//every marble a trade moved
+	Trades []string `json:"trades,omitempty"`			//ids of every trade pruned
 }
 
 type Description struct{
@@ -50,42 +202,101 @@ type Description struct{
 }
 
 type AnOpenTrade struct{
+	Id string `json:"id"`						//id of the trade, the id of the transaction that opened it or else the next trade counter value
 	User string `json:"user"`					//user who created the open trade order
-	Timestamp int64 `json:"timestamp"`			//utc timestamp of creation
+	Timestamp int64 `json:"timestamp"`			//utc timestamp of creation in ms, 0 without a transaction timestamp, was the id of trades opened before Id existed
+	Expires int64 `json:"expires,omitempty"`		//utc timestamp in ms the trade stops being valid, 0 for never
 	Want Description  `json:"want"`				//description of desired marble
 	Willing []Description `json:"willing"`		//array of marbles willing to trade away
+	WantBundle []Description `json:"want_bundle,omitempty"`		//bundle trades - every marble wanted, replaces Want
+	GiveBundle []Description `json:"give_bundle,omitempty"`		//bundle trades - every marble given, replaces Willing
+	Escrow []string `json:"escrow,omitempty"`	//escrow trades - names of the marbles locked for this trade
+	Version int `json:"version,omitempty"`			//schema version the record was written or migrated to, missing for version 1
 }
 
 type AllTrades struct{
 	OpenTrades []AnOpenTrade `json:"open_trades"`
 }
 
+// TradeError - why an open trade could not be settled, Leg is "closer" or "opener"
+type TradeError struct{
+	Trade string								//id of the open trade
+	Leg string
+	Reason string
+}
+
+func (e *TradeError) Error() string {
+	return "trade " + e.Trade + " failed on the " + e.Leg + " leg: " + e.Reason
+}
+
+// Migration - progress of migrate, kept on the ledger between calls until every record is at schemaVersion
+type Migration struct{
+	Version int `json:"version"`				//schema version being migrated to
+	Stage string `json:"stage"`					//records being migrated, "marbles", "indexes" then "trades", "done" once finished
+	Bookmark string `json:"bookmark"`			//name or id of the last record looked at in this stage, sorted like a page of marbles
+	Migrated int `json:"migrated"`				//records upgraded so far
+	Broken []string `json:"broken,omitempty"`	//records that did not decode and were left for repair_records
+}
+
+// invokeFunctions - every function an invocation can call
+var invokeFunctions = map[string]Handler{
+	"init": {Fn: (*SimpleChaincode).init, Args: []ArgSpec{{"value", argInt, true}, {"admin", argString, false}, {"force", argString, false}, {"log_level", argString, false}, {"admin_key", argString, false}}, Admin: true},		//initialize the chaincode state, used as reset
+	"delete": {Fn: (*SimpleChaincode).Delete, Args: []ArgSpec{{"name", argString, true}}, After: cleanTrades, Admin: true},		//deletes an entity from its state
+	"write": {Fn: (*SimpleChaincode).Write, Args: []ArgSpec{{"name", argString, true}, {"value", argString, false}}, Admin: true},		//writes a value to the chaincode state
+	"add_admin": {Fn: (*SimpleChaincode).add_admin, Args: []ArgSpec{{"user", argString, true}}, Admin: true},		//let another user call admin functions
+	"remove_admin": {Fn: (*SimpleChaincode).remove_admin, Args: []ArgSpec{{"user", argString, true}}, Admin: true},		//stop a user calling admin functions
+	"set_caller_key": {Fn: (*SimpleChaincode).set_caller_key, Args: []ArgSpec{{"user", argString, true}, {"key", argString, true}}},		//register the key a user signs calls with
+	"init_marble": {Fn: (*SimpleChaincode).init_marble, Args: []ArgSpec{{"name", argString, true}, {"color", argString, true}, {"size", argInt, true}, {"user", argString, true}}},		//create a new marble
+	"migrate": {Fn: (*SimpleChaincode).migrate, Args: []ArgSpec{{"limit", argInt, false}}, Admin: true},		//upgrade records to the current schema version, a batch at a time
+	"migrate_keys": {Fn: (*SimpleChaincode).migrate_keys, Admin: true},		//move marbles stored under their bare name into their own keys
+	"rebuild_indexes": {Fn: (*SimpleChaincode).rebuild_indexes, Admin: true},		//regenerate owner, color and color/size indexes
+	"repair_records": {Fn: (*SimpleChaincode).repair_records, Admin: true},		//rewrite marble records that do not parse
+	"set_user": {Fn: (*SimpleChaincode).set_user, Args: []ArgSpec{{"name", argString, true}, {"user", argString, true}}, After: cleanTrades},		//change owner of a marble
+	"open_trade": {Fn: (*SimpleChaincode).open_trade, Args: []ArgSpec{{"user", argString, true}, {"want_color", argString, true}, {"want_size", argInt, true}, {"willing_color", argString, true}, {"willing_size", argInt, true}}, MoreArgs: true, FromJSON: tradeFromJSON},		//create a new trade order
+	"open_escrow_trade": {Fn: (*SimpleChaincode).open_escrow_trade, Args: []ArgSpec{{"user", argString, true}, {"want_color", argString, true}, {"want_size", argInt, true}, {"willing_color", argString, true}, {"willing_size", argInt, true}}, MoreArgs: true, FromJSON: tradeFromJSON},		//create a new trade order that locks the marbles on offer
+	"open_bundle_trade": {Fn: (*SimpleChaincode).open_bundle_trade, Args: []ArgSpec{{"user", argString, true}, {"want_count", argInt, true}, {"want_color", argString, true}, {"want_size", argInt, true}, {"give_color", argString, true}, {"give_size", argInt, true}}, MoreArgs: true, FromJSON: bundleFromJSON},		//create a new trade order for sets of marbles
+	"perform_trade": {Fn: (*SimpleChaincode).perform_trade, Args: []ArgSpec{{"id", argString, true}, {"closer", argString, true}, {"closer_marble", argString, true}}, MoreArgs: true, FromJSON: performFromJSON, After: cleanTrades},		//forfill an open trade order
+	"remove_trade": {Fn: (*SimpleChaincode).remove_trade, Args: []ArgSpec{{"id", argString, true}}},		//cancel an open trade order
+	"match_trades": {Fn: (*SimpleChaincode).match_trades, After: cleanTrades},		//fill open trade orders that line up with each other
+	"expire_trades": {Fn: (*SimpleChaincode).expire_trades},		//remove open trades past their expiry
+	"migrate_trades": {Fn: (*SimpleChaincode).migrate_trades, Admin: true},		//move trades out of the old _opentrades blob
+}
+
+// closeTradeArgs - what perform_trade takes to close a trade that is not a bundle, a bundle is closed with the names
+//   of the closer's marbles instead so the invokeFunctions entry only declares what both have in common
+var closeTradeArgs = Handler{Args: []ArgSpec{{"id", argString, true}, {"closer", argString, true}, {"closer_marble", argString, true}, {"opener", argString, true}, {"color", argString, true}, {"size", argInt, true}}}
+
+// queryFunctions - every function a query can call
+var queryFunctions = map[string]Handler{
+	"read": {Fn: (*SimpleChaincode).read, Args: []ArgSpec{{"name", argString, true}}},		//read a variable
+	"marbles_by_owner": {Fn: (*SimpleChaincode).marbles_by_owner, Args: []ArgSpec{{"owner", argString, true}, {"bookmark", argString, false}, {"limit", argInt, false}}},		//page of marbles owned by a user
+	"marbles_by_color": {Fn: (*SimpleChaincode).marbles_by_color, Args: []ArgSpec{{"color", argString, true}, {"bookmark", argString, false}, {"limit", argInt, false}}},		//page of marbles of a color
+	"marbles_matching": {Fn: (*SimpleChaincode).marbles_matching, Args: []ArgSpec{{"color", argString, true}, {"min_size", argInt, true}, {"max_size", argInt, true}, {"bookmark", argString, false}, {"limit", argInt, false}}},		//page of marbles of a color within a size range
+	"marble_history": {Fn: (*SimpleChaincode).marble_history, Args: []ArgSpec{{"name", argString, true}}},		//every owner a marble has had
+	"scan_records": {Fn: (*SimpleChaincode).scan_records},		//report marble records that do not parse
+	"verify_state": {Fn: (*SimpleChaincode).verify_state},		//report every stored value that does not decode
+	"list_trades": {Fn: (*SimpleChaincode).list_trades, Args: []ArgSpec{{"user", argString, false}, {"want_color", argString, false}, {"want_size", argInt, false}, {"willing_color", argString, false}, {"offset", argInt, false}, {"limit", argInt, false}}},		//page of open trades
+}
+
 // ============================================================================================================================
 // Main
 // ============================================================================================================================
 func main() {
 	err := shim.Start(new(SimpleChaincode))
 	if err != nil {
-		fmt.Printf("Error starting Simple chaincode: %s", err)
+		logError("Error starting Simple chaincode: " + err.Error())
 	}
 }
 
 // ============================================================================================================================
-// Init - reset all the things
+// Init - set up the ledger, one already set up keeps its marbles and has them migrated unless an admin forces a reset
 // ============================================================================================================================
-func (t *SimpleChaincode) init(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+func (t *SimpleChaincode) init(stub ChaincodeStubInterface, args []string) ([]byte, error) {
 	var Aval int
 	var err error
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
-	}
-
 	// Initialize the chaincode
-	Aval, err = strconv.Atoi(args[0])
-	if err != nil {
-		return nil, errors.New("Expecting integer value for asset holding")
-	}
+	Aval, _ = strconv.Atoi(args[0])												//checkArgs made sure it is a number
 
 	// Write the state to the ledger
 	err = stub.PutState("abc", []byte(strconv.Itoa(Aval)))				//making a test var "abc", I find it handy to read/write to it right away to test the network
@@ -93,539 +304,3303 @@ func (t *SimpleChaincode) init(stub *shim.ChaincodeStub, args []string) ([]byte,
 		return nil, err
 	}
 	
-	var empty []string
-	jsonAsBytes, _ := json.Marshal(empty)								//marshal an emtpy array of strings to clear the index
-	err = stub.PutState(marbleIndexStr, jsonAsBytes)
-	if err != nil {
-		return nil, err
+	force := false
+	if args[2] != "" {
+		force, err = strconv.ParseBool(args[2])
+		if err != nil {
+			return nil, errors.New("init's force argument must be true or false")
+		}
 	}
 	
-	var trades AllTrades
-	jsonAsBytes, _ = json.Marshal(trades)								//clear the open trade struct
-	err = stub.PutState(openTradesStr, jsonAsBytes)
+	if args[3] != "" {
+		level, err := parseLogLevel(args[3])
+		if err != nil {
+			return nil, err
+		}
+		err = stub.PutState(logLevelStr, []byte(logLevels[level]))
+		if err != nil {
+			return nil, err
+		}
+		logLevel, logLevelLoaded = level, true
+	}
+	
+	admins, err := getAdmins(stub)
 	if err != nil {
 		return nil, err
 	}
+	indexAsBytes, err := stub.GetState(marbleIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get marble index")
+	}
+	if len(indexAsBytes) != 0 && !force {								//already set up, keep the marbles and bring how they are stored up to date
+		err = restartIndexes(stub)											//the indexes may predate the marbles, or be missing altogether
+		if err != nil {
+			return nil, err
+		}
+		_, err = t.migrate(stub, []string{""})								//the first batch, an admin calls migrate until it is done
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if len(indexAsBytes) != 0 {
+			if len(admins) == 0 {
+				return nil, errors.New("init only wipes existing marbles for an admin")
+			}
+			err = clearMarbles(stub)										//remove them rather than orphan them
+			if err != nil {
+				return nil, err
+			}
+		}
+		var empty []string
+		jsonAsBytes, _ := json.Marshal(empty)							//marshal an emtpy array of strings to clear the index
+		err = stub.PutState(marbleIndexStr, jsonAsBytes)
+		if err != nil {
+			return nil, err
+		}
+		err = putTradeIndex(stub, empty)									//clear the open trade index
+		if err != nil {
+			return nil, err
+		}
+		err = stub.PutState(schemaVersionStr, []byte(strconv.Itoa(schemaVersion)))	//nothing to migrate on an empty ledger
+		if err != nil {
+			return nil, err
+		}
+		err = stub.DelState(migrationStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	
+	if len(admins) == 0 && len(indexAsBytes) != 0 {						//init runs for anyone until there is an admin, so it only names one on an empty ledger
+		if args[1] != "" || args[4] != "" {
+			return nil, errors.New("the first admin can only be named on an empty ledger")
+		}
+	} else if len(admins) == 0 {
+		admin := args[1]
+		if admin == "" {
+			admin, err = getCaller(stub)
+			if err != nil {
+				return nil, errors.New("init needs an admin, pass one or call with a certificate carrying the " + callerAttr + " attribute")
+			}
+		}
+		admin = strings.ToLower(admin)
+		err = putAdmins(stub, []string{admin})
+		if err != nil {
+			return nil, err
+		}
+		if args[4] != "" {
+			err = putCallerKey(stub, admin, args[4])							//so the admin can sign calls on a peer without caller attributes
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else if args[4] != "" {
+		return nil, errors.New("init only takes an admin_key along with the first admin, set_caller_key registers the others")
+	}
 	
 	return nil, nil
 }
 
 // ============================================================================================================================
-// Run - Our entry point for Invokcations
+// clearMarbles - delete every marble in the index along with its owner and color index entries and every open trade,
+//   ownership history is kept
 // ============================================================================================================================
-func (t *SimpleChaincode) Run(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
-	fmt.Println("run is running " + function)
-
-	// Handle different functions
-	if function == "init" {													//initialize the chaincode state, used as reset
-		return t.init(stub, args)
-	} else if function == "delete" {										//deletes an entity from its state
-		res, err := t.Delete(stub, args)
-		cleanTrades(stub)													//lets make sure all open trades are still valid
-		return res, err
-	} else if function == "write" {											//writes a value to the chaincode state
-		return t.Write(stub, args)
-	} else if function == "init_marble" {									//create a new marble
-		return t.init_marble(stub, args)
-	} else if function == "set_user" {										//change owner of a marble
-		res, err := t.set_user(stub, args)
-		cleanTrades(stub)													//lets make sure all open trades are still valid
-		return res, err
-	} else if function == "open_trade" {									//create a new trade order
-		return t.open_trade(stub, args)
-	} else if function == "perform_trade" {									//forfill an open trade order
-		res, err := t.perform_trade(stub, args)
-		cleanTrades(stub)													//lets clean just in case
-		return res, err
-	} else if function == "remove_trade" {									//cancel an open trade order
-		return t.remove_trade(stub, args)
+func clearMarbles(stub ChaincodeStubInterface) error {
+	marblesAsBytes, err := stub.GetState(marbleIndexStr)
+	if err != nil {
+		return errors.New("Failed to get marble index")
 	}
-	fmt.Println("run did not find func: " + function)						//error
-
-	return nil, errors.New("Received unknown function invocation")
+	var marbleIndex []string
+	err = decodeJSON(marbleIndexStr, marblesAsBytes, &marbleIndex)
+	if err != nil {
+		return err
+	}
+	for _, name := range marbleIndex{
+		res, err := getMarble(stub, name)
+		if _, missing := err.(*MarbleNotFoundError); missing {
+			continue
+		}
+		if err == nil {
+			err = unindexMarble(stub, res)
+			if err != nil {
+				return err
+			}
+		}
+		err = stub.DelState(marbleKey(name))										//one that does not decode goes too
+		if err != nil {
+			return errors.New("Failed to delete marble " + name)
+		}
+	}
+	tradeIndex, err := getTradeIndex(stub)
+	if err != nil {
+		return err
+	}
+	for _, id := range tradeIndex{
+		err = stub.DelState(tradeKey(id))
+		if err != nil {
+			return errors.New("Failed to delete open trade " + id)
+		}
+	}
+	err = stub.DelState(openTradesStr)											//and any trades never migrated
+	if err != nil {
+		return errors.New("Failed to delete opentrades")
+	}
+	return nil
 }
 
 // ============================================================================================================================
-// Query - Our entry point for Queries
+// Run - Our entry point for Invokcations
 // ============================================================================================================================
-func (t *SimpleChaincode) Query(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
-	fmt.Println("query is running " + function)
-
-	// Handle different functions
-	if function == "read" {													//read a variable
-		return t.read(stub, args)
-	}
-	fmt.Println("query did not find func: " + function)						//error
-
-	return nil, errors.New("Received unknown function query")
+func (t *SimpleChaincode) Run(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
+	return t.run(peerStub{stub}, function, args)
 }
 
 // ============================================================================================================================
-// Read - read a variable from chaincode state
+// run - dispatch an invocation against any ChaincodeStubInterface
 // ============================================================================================================================
-func (t *SimpleChaincode) read(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
-	var name, jsonResp string
-	var err error
+func (t *SimpleChaincode) run(stub ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	loadLogLevel(stub)
+	logInfo("run is running " + function)
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting name of the var to query")
+	handler, ok := invokeFunctions[function]
+	if !ok {
+		logError("run did not find func: " + function)						//error
+		return nil, errors.New("Received unknown function invocation")
 	}
-
-	name = args[0]
-	valAsbytes, err := stub.GetState(name)									//get the var from chaincode state
+	stub, args, err := signedCaller(stub, function, args)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
-		return nil, errors.New(jsonResp)
+		logError(err.Error())
+		return nil, err
 	}
+	return t.callWithEvent(stub, function, handler, args)
+}
 
-	return valAsbytes, nil													//send it onward
+// ============================================================================================================================
+// Query - Our entry point for Queries
+// ============================================================================================================================
+func (t *SimpleChaincode) Query(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
+	return t.query(peerStub{stub}, function, args)
 }
 
 // ============================================================================================================================
-// Delete - remove a key/value pair from state
+// query - dispatch a query against any ChaincodeStubInterface
 // ============================================================================================================================
-func (t *SimpleChaincode) Delete(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
-	}
-	
-	name := args[0]
-	err := stub.DelState(name)													//remove the key from chaincode state
-	if err != nil {
-		return nil, errors.New("Failed to delete state")
-	}
+func (t *SimpleChaincode) query(stub ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	loadLogLevel(stub)
+	logInfo("query is running " + function)
 
-	//get the marble index
-	marblesAsBytes, err := stub.GetState(marbleIndexStr)
-	if err != nil {
-		return nil, errors.New("Failed to get marble index")
-	}
-	var marbleIndex []string
-	json.Unmarshal(marblesAsBytes, &marbleIndex)								//un stringify it aka JSON.parse()
-	
-	//remove marble from index
-	for i,val := range marbleIndex{
-		fmt.Println(strconv.Itoa(i) + " - looking at " + val + " for " + name)
-		if val == name{															//find the correct marble
-			fmt.Println("found marble")
-			marbleIndex = append(marbleIndex[:i], marbleIndex[i+1:]...)			//remove it
-			for x:= range marbleIndex{											//debug prints...
-				fmt.Println(string(x) + " - " + marbleIndex[x])
-			}
-			break
-		}
+	handler, ok := queryFunctions[function]
+	if !ok {
+		logError("query did not find func: " + function)						//error
+		return nil, errors.New("Received unknown function query")
 	}
-	jsonAsBytes, _ := json.Marshal(marbleIndex)									//save new index
-	err = stub.PutState(marbleIndexStr, jsonAsBytes)
-	return nil, nil
+	return t.call(stub, function, handler, args)
 }
 
 // ============================================================================================================================
-// Write - write variable into chaincode state
+// call - check and convert a function's arguments, given positionally or as one JSON object, and that the caller
+//   may call it, then run it
 // ============================================================================================================================
-func (t *SimpleChaincode) Write(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
-	var name, value string // Entities
-	var err error
-	fmt.Println("running write()")
-
-	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2. name of the variable and value to set")
+func (t *SimpleChaincode) call(stub ChaincodeStubInterface, function string, handler Handler, args []string) ([]byte, error) {
+	args, err := argsFromJSON(function, handler, args)
+	if err == nil {
+		args, err = checkArgs(function, handler, args)
+	}
+	if err == nil && handler.Admin {
+		err = checkAdmin(stub, function)
 	}
-
-	name = args[0]															//rename for funsies
-	value = args[1]
-	err = stub.PutState(name, []byte(value))								//write the variable into the chaincode state
 	if err != nil {
+		logError(err.Error())
 		return nil, err
 	}
-	return nil, nil
+	res, err := handler.Fn(t, stub, args)
+	if err == nil && handler.After != nil {
+		err = handler.After(stub)
+	}
+	return res, err
 }
 
 // ============================================================================================================================
-// Init Marble - create a new marble, store into chaincode state
+// callWithEvent - call, gathering the events the function raises into the one the transaction sets
 // ============================================================================================================================
-func (t *SimpleChaincode) init_marble(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
-	var err error
-
-	//   0       1       2     3
-	// "asdf", "blue", "35", "bob"
-	if len(args) != 4 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 4")
+func (t *SimpleChaincode) callWithEvent(stub ChaincodeStubInterface, function string, handler Handler, args []string) ([]byte, error) {
+	pending := &eventStub{ChaincodeStubInterface: stub}
+	res, err := t.call(pending, function, handler, args)
+	if err == nil && pending.name != "" {
+		err = setEvent(stub, pending.name, pending.ev)							//one event for the whole transaction
 	}
+	return res, err
+}
 
-	fmt.Println("- start init marble")
-	if len(args[0]) <= 0 {
-		return nil, errors.New("1st argument must be a non-empty string")
-	}
-	if len(args[1]) <= 0 {
-		return nil, errors.New("2nd argument must be a non-empty string")
-	}
-	if len(args[2]) <= 0 {
-		return nil, errors.New("3rd argument must be a non-empty string")
+// ============================================================================================================================
+// argsFromJSON - positional arguments from a single JSON object argument with a field per declared argument,
+//   e.g. {"name": "m1", "user": "bob"} for set_user. Any other args are positional and come back unchanged
+// ============================================================================================================================
+func argsFromJSON(function string, handler Handler, args []string) ([]string, error) {
+	if len(args) != 1 || !strings.HasPrefix(strings.TrimSpace(args[0]), "{") {
+		return args, nil
 	}
-	if len(args[3]) <= 0 {
-		return nil, errors.New("4th argument must be a non-empty string")
+	var fields map[string]json.RawMessage
+	if json.Unmarshal([]byte(args[0]), &fields) != nil {
+		return args, nil														//not an object after all, e.g. a name starting with {
 	}
 	
-	size, err := strconv.Atoi(args[2])
-	if err != nil {
-		return nil, errors.New("3rd argument must be a numeric string")
+	if handler.FromJSON != nil {
+		checkedFields, err := handler.FromJSON(fields)							//functions with a variable number of arguments name them their own way
+		if err != nil {
+			return nil, errors.New(function + " " + err.Error())
+		}
+		return checkedFields, nil
 	}
 	
-	color := strings.ToLower(args[1])
-	user := strings.ToLower(args[3])
-
-	str := `{"name": "` + args[0] + `", "color": "` + color + `", "size": ` + strconv.Itoa(size) + `, "user": "` + user + `"}`
-	err = stub.PutState(args[0], []byte(str))								//store marble with id as key
-	if err != nil {
-		return nil, err
+	positional := make([]string, len(handler.Args))
+	for i, spec := range handler.Args{
+		raw, ok := fields[spec.Name]
+		if !ok {
+			continue															//left empty, checkArgs reports it if it is required
+		}
+		delete(fields, spec.Name)
+		value, err := jsonArg(raw)
+		if err != nil {
+			return nil, errors.New(function + " field " + spec.Name + " " + err.Error())
+		}
+		positional[i] = value
 	}
-		
-	//get the marble index
-	marblesAsBytes, err := stub.GetState(marbleIndexStr)
-	if err != nil {
-		return nil, errors.New("Failed to get marble index")
+	for name := range fields{
+		return nil, errors.New(function + " has no argument named " + name)
 	}
-	var marbleIndex []string
-	json.Unmarshal(marblesAsBytes, &marbleIndex)							//un stringify it aka JSON.parse()
-	
-	//append
-	marbleIndex = append(marbleIndex, args[0])								//add marble name to index list
-	fmt.Println("! marble index: ", marbleIndex)
-	jsonAsBytes, _ := json.Marshal(marbleIndex)
-	err = stub.PutState(marbleIndexStr, jsonAsBytes)						//store name of marble
+	return positional, nil
+}
 
-	fmt.Println("- end init marble")
-	return nil, nil
+// ============================================================================================================================
+// jsonArg - a JSON string, number or bool field as a positional argument, null is left empty
+// ============================================================================================================================
+func jsonArg(raw json.RawMessage) (string, error) {
+	text := strings.TrimSpace(string(raw))
+	if text == "null" {
+		return "", nil
+	}
+	if text == "true" || text == "false" {
+		return text, nil
+	}
+	if strings.HasPrefix(text, "\"") {
+		var value string
+		err := json.Unmarshal(raw, &value)
+		return value, err
+	}
+	var number json.Number
+	if json.Unmarshal(raw, &number) != nil {
+		return "", errors.New("must be a string or a number")
+	}
+	return number.String(), nil
 }
 
 // ============================================================================================================================
-// Set User Permission on Marble
+// checkArgs - check args against the function's declared arguments, optional arguments left off come back empty
+//   and ints come back in canonical form, so the function can index and convert them without checking again
 // ============================================================================================================================
-func (t *SimpleChaincode) set_user(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
-	var err error
-	
-	//   0       1
-	// "name", "bob"
-	if len(args) < 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+func checkArgs(function string, handler Handler, args []string) ([]string, error) {
+	if len(args) < requiredArgs(handler) || (len(args) > len(handler.Args) && !handler.MoreArgs) {
+		return nil, errors.New(function + " expects " + argUsage(handler))
 	}
 	
-	fmt.Println("- start set user")
-	fmt.Println(args[0] + " - " + args[1])
-	marbleAsBytes, err := stub.GetState(args[0])
-	if err != nil {
-		return nil, errors.New("Failed to get thing")
+	checked := make([]string, len(args))
+	copy(checked, args)
+	for i, spec := range handler.Args{
+		if i >= len(checked) {
+			checked = append(checked, "")
+			continue
+		}
+		if checked[i] == "" {
+			if spec.Required {
+				return nil, errors.New(function + " argument " + strconv.Itoa(i + 1) + " (" + spec.Name + ") must be a non-empty string")
+			}
+			continue
+		}
+		if spec.Type == argInt {
+			n, err := strconv.Atoi(strings.TrimSpace(checked[i]))
+			if err != nil {
+				return nil, errors.New(function + " argument " + strconv.Itoa(i + 1) + " (" + spec.Name + ") must be a numeric string")
+			}
+			checked[i] = strconv.Itoa(n)
+		}
 	}
-	res := Marble{}
-	json.Unmarshal(marbleAsBytes, &res)										//un stringify it aka JSON.parse()
-	res.User = args[1]														//change the user
-	
-	jsonAsBytes, _ := json.Marshal(res)
-	err = stub.PutState(args[0], jsonAsBytes)								//rewrite the marble with id as key
-	if err != nil {
-		return nil, err
+	return checked, nil
+}
+
+// ============================================================================================================================
+// requiredArgs - how many arguments a function must be given, required arguments come before optional ones
+// ============================================================================================================================
+func requiredArgs(handler Handler) int {
+	required := 0
+	for _, spec := range handler.Args{
+		if spec.Required {
+			required++
+		}
 	}
-	
-	fmt.Println("- end set user")
-	return nil, nil
+	return required
 }
 
 // ============================================================================================================================
-// Open Trade - create an open trade for a marble you want with marbles you have 
+// argUsage - what a function expects, e.g. "2 arguments: name, user" or "1 to 3 arguments: owner, [bookmark], [limit]"
 // ============================================================================================================================
-func (t *SimpleChaincode) open_trade(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
-	var err error
-	var will_size int
-	var trade_away Description
+func argUsage(handler Handler) string {
+	required := requiredArgs(handler)
+	count := strconv.Itoa(required)
+	if handler.MoreArgs {
+		count = "at least " + count
+	} else if required < len(handler.Args) {
+		count += " to " + strconv.Itoa(len(handler.Args))
+	}
 	
-	//	0        1      2     3      4      5       6
-	//["bob", "blue", "16", "red", "16"] *"blue", "35*
-	if len(args) < 5 {
-		return nil, errors.New("Incorrect number of arguments. Expecting like 5?")
+	var names []string
+	for _, spec := range handler.Args{
+		if spec.Required {
+			names = append(names, spec.Name)
+		} else {
+			names = append(names, "[" + spec.Name + "]")
+		}
 	}
-	if len(args)%2 == 0{
-		return nil, errors.New("Incorrect number of arguments. Expecting an odd number")
+	if handler.MoreArgs {
+		names = append(names, "...")
 	}
-
-	size1, err := strconv.Atoi(args[2])
-	if err != nil {
-		return nil, errors.New("3rd argument must be a numeric string")
+	usage := count + " arguments"
+	if len(names) > 0 {
+		usage += ": " + strings.Join(names, ", ")
 	}
+	return usage
+}
 
-	open := AnOpenTrade{}
-	open.User = args[0]
-	open.Timestamp = makeTimestamp()											//use timestamp as an ID
-	open.Want.Color = args[1]
-	open.Want.Size =  size1
-	fmt.Println("- start open trade")
-	jsonAsBytes, _ := json.Marshal(open)
-	err = stub.PutState("_debug1", jsonAsBytes)
-
-	for i:=3; i < len(args); i++ {												//create and append each willing trade
+// ============================================================================================================================
+// checkFields - error naming the first field that is not one of names
+// ============================================================================================================================
+func checkFields(fields map[string]json.RawMessage, names ...string) error {
+	for field := range fields{
+		if !containsName(names, field) {
+			return errors.New("has no argument named " + field)
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// decodeFields - decode the fields of a JSON object argument into v
+// ============================================================================================================================
+func decodeFields(fields map[string]json.RawMessage, v interface{}) error {
+	fieldsAsBytes, _ := json.Marshal(fields)
+	err := json.Unmarshal(fieldsAsBytes, v)
+	if err != nil {
+		return errors.New("has a field of the wrong type: " + err.Error())
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// descriptionArgs - color/size argument pairs for each description
+// ============================================================================================================================
+func descriptionArgs(descriptions []Description) []string {
+	var args []string
+	for _, d := range descriptions{
+		args = append(args, d.Color, strconv.Itoa(d.Size))
+	}
+	return args
+}
+
+// ============================================================================================================================
+// tradeFromJSON - open_trade and open_escrow_trade arguments from
+//   {"user": "bob", "want": {"color": "red", "size": 35}, "willing": [{"color": "blue", "size": 16}], "ttl": 3600}, ttl optional
+// ============================================================================================================================
+func tradeFromJSON(fields map[string]json.RawMessage) ([]string, error) {
+	err := checkFields(fields, "user", "want", "willing", "ttl")
+	if err != nil {
+		return nil, err
+	}
+	var req struct{
+		User string `json:"user"`
+		Want Description `json:"want"`
+		Willing []Description `json:"willing"`
+		TTL int64 `json:"ttl"`
+	}
+	err = decodeFields(fields, &req)
+	if err != nil {
+		return nil, err
+	}
+	
+	args := []string{req.User, req.Want.Color, strconv.Itoa(req.Want.Size)}
+	args = append(args, descriptionArgs(req.Willing)...)
+	if req.TTL != 0 {
+		args = append(args, strconv.FormatInt(req.TTL, 10))
+	}
+	return args, nil
+}
+
+// ============================================================================================================================
+// bundleFromJSON - open_bundle_trade arguments from
+//   {"user": "bob", "want_bundle": [{"color": "red", "size": 35}...], "give_bundle": [{"color": "blue", "size": 16}...], "ttl": 3600}, ttl optional
+// ============================================================================================================================
+func bundleFromJSON(fields map[string]json.RawMessage) ([]string, error) {
+	err := checkFields(fields, "user", "want_bundle", "give_bundle", "ttl")
+	if err != nil {
+		return nil, err
+	}
+	var req struct{
+		User string `json:"user"`
+		WantBundle []Description `json:"want_bundle"`
+		GiveBundle []Description `json:"give_bundle"`
+		TTL int64 `json:"ttl"`
+	}
+	err = decodeFields(fields, &req)
+	if err != nil {
+		return nil, err
+	}
+	
+	args := []string{req.User, strconv.Itoa(len(req.WantBundle))}
+	args = append(args, descriptionArgs(req.WantBundle)...)
+	args = append(args, descriptionArgs(req.GiveBundle)...)
+	if req.TTL != 0 {
+		args = append(args, strconv.FormatInt(req.TTL, 10))
+	}
+	return args, nil
+}
+
+// ============================================================================================================================
+// performFromJSON - perform_trade arguments from
+//   {"id": "tx4", "closer": {"user": "alice", "name": "m2"}, "opener": {"user": "bob", "color": "blue", "size": 16}}
+//   or for a bundle trade {"id": "tx4", "closer": {"user": "alice", "names": ["m2", "m3"]}}
+// ============================================================================================================================
+func performFromJSON(fields map[string]json.RawMessage) ([]string, error) {
+	err := checkFields(fields, "id", "closer", "opener")
+	if err != nil {
+		return nil, err
+	}
+	var req struct{
+		Id string `json:"id"`
+		Closer struct{
+			User string `json:"user"`
+			Name string `json:"name"`
+			Names []string `json:"names"`
+		} `json:"closer"`
+		Opener struct{
+			User string `json:"user"`
+			Color string `json:"color"`
+			Size int `json:"size"`
+		} `json:"opener"`
+	}
+	err = decodeFields(fields, &req)
+	if err != nil {
+		return nil, err
+	}
+	
+	if len(req.Closer.Names) > 0 {
+		return append([]string{req.Id, req.Closer.User}, req.Closer.Names...), nil
+	}
+	return []string{req.Id, req.Closer.User, req.Closer.Name, req.Opener.User, req.Opener.Color, strconv.Itoa(req.Opener.Size)}, nil
+}
+
+// ============================================================================================================================
+// Read - read a variable from chaincode state
+// ============================================================================================================================
+func (t *SimpleChaincode) read(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	var name, jsonResp string
+	var err error
+
+	name = args[0]
+	valAsbytes, err := stub.GetState(marbleKey(name))							//a marble by name
+	if err == nil && len(valAsbytes) == 0 {
+		valAsbytes, err = stub.GetState(name)								//else the var from chaincode state, e.g. an index or what write stored
+	}
+	if err != nil {
+		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
+		return nil, errors.New(jsonResp)
+	}
+
+	return valAsbytes, nil													//send it onward
+}
+
+// ============================================================================================================================
+// Marbles By Owner - JSON array of the marbles a user owns, in name order
+// ============================================================================================================================
+func (t *SimpleChaincode) marbles_by_owner(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0        1            2
+	// "bob", *"bookmark", "limit"*
+	bookmark, limit, err := pagingArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	
+	owner := strings.ToLower(args[0])
+	names, err := indexedNames(stub, ownerKey(owner))
+	if err != nil {
+		return nil, err
+	}
+	return pageOfMarbles(stub, names, bookmark, limit, func(m Marble) bool {
+		return strings.ToLower(m.User) == owner
+	})
+}
+
+// ============================================================================================================================
+// Marbles By Color - JSON array of the marbles of a color, in name order
+// ============================================================================================================================
+func (t *SimpleChaincode) marbles_by_color(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0         1            2
+	// "blue", *"bookmark", "limit"*
+	bookmark, limit, err := pagingArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	
+	color := strings.ToLower(args[0])
+	names, err := indexedNames(stub, colorKey(color))
+	if err != nil {
+		return nil, err
+	}
+	return pageOfMarbles(stub, names, bookmark, limit, func(m Marble) bool {
+		return strings.ToLower(m.Color) == color
+	})
+}
+
+// ============================================================================================================================
+// Marbles Matching - JSON array of the marbles of a color with a size in [min, max], in name order
+// ============================================================================================================================
+func (t *SimpleChaincode) marbles_matching(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0       1     2         3            4
+	// "blue", "10", "20", *"bookmark", "limit"*
+	minSize, _ := strconv.Atoi(args[1])											//checkArgs made sure both are numbers
+	maxSize, _ := strconv.Atoi(args[2])
+	bookmark, limit, err := pagingArgs(args, 3)
+	if err != nil {
+		return nil, err
+	}
+	
+	color := strings.ToLower(args[0])
+	names, err := indexedNames(stub, colorKey(color))
+	if err != nil {
+		return nil, err
+	}
+	return pageOfMarbles(stub, names, bookmark, limit, func(m Marble) bool {
+		return strings.ToLower(m.Color) == color && m.Size >= minSize && m.Size <= maxSize
+	})
+}
+
+// ============================================================================================================================
+// Marble History - every owner a marble has had, oldest first
+// ============================================================================================================================
+func (t *SimpleChaincode) marble_history(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// "name"
+	history, err := getHistory(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(history)
+}
+
+// ============================================================================================================================
+// pagingArgs - the optional bookmark and limit found at args[i] and args[i+1]
+// ============================================================================================================================
+func pagingArgs(args []string, i int) (string, int, error) {
+	bookmark := ""
+	limit := defaultPageSize
+	if len(args) > i {
+		bookmark = args[i]
+	}
+	if len(args) > i + 1 && args[i + 1] != "" {
+		limit, _ = strconv.Atoi(args[i + 1])
+		if limit <= 0 {
+			return "", 0, errors.New("limit must be a positive numeric string")
+		}
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	return bookmark, limit, nil
+}
+
+// ============================================================================================================================
+// pageOfMarbles - up to limit marbles from names that keep accepts, sorted by name and starting after bookmark
+//   the bookmark for the next page is the name of the last marble returned, "" starts at the beginning
+// ============================================================================================================================
+func pageOfMarbles(stub ChaincodeStubInterface, names []string, bookmark string, limit int, keep func(Marble) bool) ([]byte, error) {
+	sorted := make([]string, len(names))
+	copy(sorted, names)
+	sort.Strings(sorted)
+	
+	page := []Marble{}
+	for _, name := range sorted{
+		if len(page) >= limit {
+			break
+		}
+		if name <= bookmark {
+			continue
+		}
+		res, err := getMarble(stub, name)
+		if _, missing := err.(*MarbleNotFoundError); missing {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if keep(res) {															//indexes can be stale, check the marble itself
+			page = append(page, res)
+		}
+	}
+	return json.Marshal(page)
+}
+
+// ============================================================================================================================
+// Delete - remove a key/value pair from state
+// ============================================================================================================================
+func (t *SimpleChaincode) Delete(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	
+	name := args[0]
+	err := checkName(name)
+	if err != nil {
+		return nil, err
+	}
+	res, err := getMarble(stub, name)											//only delete marbles that exist
+	if err != nil {
+		return nil, err
+	}
+	if res.Locked != "" {
+		return nil, errors.New("marble " + name + " is locked in escrow by trade " + res.Locked)
+	}
+	err = stub.DelState(marbleKey(name))										//remove the key from chaincode state
+	if err != nil {
+		return nil, errors.New("Failed to delete state")
+	}
+	err = unindexMarble(stub, res)
+	if err != nil {
+		return nil, err
+	}
+
+	//get the marble index
+	marblesAsBytes, err := stub.GetState(marbleIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get marble index")
+	}
+	var marbleIndex []string
+	err = decodeJSON(marbleIndexStr, marblesAsBytes, &marbleIndex)
+	if err != nil {
+		return nil, err
+	}
+	
+	//remove marble from index
+	for i,val := range marbleIndex{
+		logDebug(strconv.Itoa(i) + " - looking at " + val + " for " + name)
+		if val == name{															//find the correct marble
+			logDebug("found marble")
+			marbleIndex = append(marbleIndex[:i], marbleIndex[i+1:]...)			//remove it
+			for x:= range marbleIndex{											//debug prints...
+				logDebug(strconv.Itoa(x) + " - " + marbleIndex[x])
+			}
+			break
+		}
+	}
+	jsonAsBytes, _ := json.Marshal(marbleIndex)									//save new index
+	err = stub.PutState(marbleIndexStr, jsonAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	err = emitEvent(stub, "marble_deleted", MarbleEvent{Marble: name, OldOwner: res.User})
+	return nil, err
+}
+
+// ============================================================================================================================
+// Write - write variable into chaincode state
+// ============================================================================================================================
+func (t *SimpleChaincode) Write(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	var name, value string // Entities
+	var err error
+	logDebug("running write()")
+
+	name = args[0]															//rename for funsies
+	value = args[1]
+	err = checkName(name)													//the chaincode's own keys are off limits
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(name, []byte(value))								//write the variable into the chaincode state
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Add Admin - let another user call admin functions
+// ============================================================================================================================
+func (t *SimpleChaincode) add_admin(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// "bob"
+	user := strings.ToLower(args[0])
+	admins, err := getAdmins(stub)
+	if err != nil {
+		return nil, err
+	}
+	if containsName(admins, user) {
+		return nil, nil														//already one
+	}
+	err = putAdmins(stub, append(admins, user))
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Remove Admin - stop a user calling admin functions, the last admin can not be removed
+// ============================================================================================================================
+func (t *SimpleChaincode) remove_admin(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0
+	// "bob"
+	user := strings.ToLower(args[0])
+	admins, err := getAdmins(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !containsName(admins, user) {
+		return nil, errors.New(user + " is not an admin")
+	}
+	if len(admins) == 1 {
+		return nil, errors.New("Can not remove the last admin " + user)
+	}
+	err = putAdmins(stub, removeName(admins, user))
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// ============================================================================================================================
+// set_caller_key - register the public key a user signs calls with, an admin can set anyone's and users can replace their own
+// ============================================================================================================================
+func (t *SimpleChaincode) set_caller_key(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	//   0       1
+	// "bob", "MFkw..."
+	user := strings.ToLower(args[0])
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	if caller != user {
+		err = checkAdmin(stub, "set_caller_key")
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = putCallerKey(stub, user, args[1])
+	if err != nil {
+		return nil, err
+	}
+	logInfo("- end set_caller_key " + user)
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Init Marble - create a new marble, store into chaincode state
+// ============================================================================================================================
+func (t *SimpleChaincode) init_marble(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+
+	//   0       1       2     3
+	// "asdf", "blue", "35", "bob"
+
+	logDebug("- start init marble")
+	err = checkName(args[0])
+	if err != nil {
+		return nil, err
+	}
+	
+	size, _ := strconv.Atoi(args[2])												//checkArgs made sure it is a number
+	
+	color := strings.ToLower(args[1])
+	user := strings.ToLower(args[3])
+
+	//check if marble already exists
+	_, err = getMarble(stub, args[0])
+	if err == nil {
+		logError("This marble arleady exists: " + args[0])
+		return nil, errors.New("This marble arleady exists")				//all stop a marble by this name exists
+	}
+	if _, ok := err.(*MarbleNotFoundError); !ok {
+		return nil, err
+	}
+
+	marble := Marble{Name: args[0], Color: color, Size: size, User: user, Version: schemaVersion}
+	marbleAsBytes, _ := json.Marshal(marble)
+	err = stub.PutState(marbleKey(args[0]), marbleAsBytes)						//store marble with id as key
+	if err != nil {
+		return nil, err
+	}
+		
+	//get the marble index
+	marblesAsBytes, err := stub.GetState(marbleIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get marble index")
+	}
+	var marbleIndex []string
+	err = decodeJSON(marbleIndexStr, marblesAsBytes, &marbleIndex)
+	if err != nil {
+		return nil, err
+	}
+	
+	if containsName(marbleIndex, args[0]) {									//still under its bare name, migrate_keys has not moved it yet
+		logError("This marble arleady exists: " + args[0])
+		return nil, errors.New("This marble arleady exists")
+	}
+
+	//append
+	marbleIndex = append(marbleIndex, args[0])								//add marble name to index list
+	logDebug("! marble index: ", marbleIndex)
+	jsonAsBytes, _ := json.Marshal(marbleIndex)
+	err = stub.PutState(marbleIndexStr, jsonAsBytes)						//store name of marble
+	if err != nil {
+		return nil, err
+	}
+	err = indexMarble(stub, marble)
+	if err != nil {
+		return nil, err
+	}
+	err = recordTransfer(stub, args[0], "", user, "init_marble")
+	if err != nil {
+		return nil, err
+	}
+	err = emitEvent(stub, "marble_created", MarbleEvent{Marble: args[0], NewOwner: user})
+	if err != nil {
+		return nil, err
+	}
+
+	logDebug("- end init marble")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Set User Permission on Marble
+// ============================================================================================================================
+func (t *SimpleChaincode) set_user(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+	
+	//   0       1
+	// "name", "bob"
+	
+	logDebug("- start set user")
+	logDebug(args[0] + " - " + args[1])
+	res, err := getMarble(stub, args[0])
+	if err != nil {
+		logError(err.Error())
+		return nil, err
+	}
+
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	if caller != strings.ToLower(res.User) {									//only the owner can give a marble away
+		msg := caller + " does not own marble " + args[0]
+		logError(msg)
+		return nil, errors.New(msg)
+	}
+	if res.Locked != "" {
+		msg := "marble " + args[0] + " is locked in escrow by trade " + res.Locked
+		logError(msg)
+		return nil, errors.New(msg)
+	}
+	oldUser := res.User
+	res.User = strings.ToLower(args[1])										//change the user
+	
+	jsonAsBytes, _ := json.Marshal(res)
+	err = stub.PutState(marbleKey(args[0]), jsonAsBytes)						//rewrite the marble with id as key
+	if err != nil {
+		return nil, err
+	}
+	err = reindexOwner(stub, args[0], oldUser, res.User)
+	if err != nil {
+		return nil, err
+	}
+	err = recordTransfer(stub, args[0], oldUser, res.User, "set_user")
+	if err != nil {
+		return nil, err
+	}
+	err = emitEvent(stub, "marble_transferred", MarbleEvent{Marble: args[0], OldOwner: oldUser, NewOwner: res.User})
+	if err != nil {
+		return nil, err
+	}
+	
+	logDebug("- end set user")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// emitEvent - raise a named chaincode event so clients can subscribe instead of polling read
+//   inside call the event is held back by the eventStub, so a transaction sets a single event when it is done
+// ============================================================================================================================
+func emitEvent(stub ChaincodeStubInterface, name string, ev MarbleEvent) error {
+	if pending, ok := stub.(*eventStub); ok {
+		pending.add(name, ev)
+		return nil
+	}
+	return setEvent(stub, name, ev)
+}
+
+// ============================================================================================================================
+// setEvent - hand an event to the peer
+// ============================================================================================================================
+func setEvent(stub ChaincodeStubInterface, name string, ev MarbleEvent) error {
+	payload, _ := json.Marshal(ev)
+	err := stub.SetEvent(name, payload)
+	if err != nil {
+		return errors.New("Failed to set event " + name)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// eventStub - the stub a function is called with, it collects the events raised along the way because the peer
+//   only delivers the last event set in a transaction
+// ============================================================================================================================
+type eventStub struct{
+	ChaincodeStubInterface
+	name string											//name of the event to set, empty while nothing was raised
+	ev MarbleEvent
+}
+
+// ============================================================================================================================
+// add - merge an event into the one the transaction will set
+// ============================================================================================================================
+func (s *eventStub) add(name string, ev MarbleEvent) {
+	switch {
+	case s.name == "":
+		s.name = name
+		s.ev = ev
+	case name == "trades_pruned":										//pruned trades ride along with the change that caused it
+		s.ev.Trades = append(s.ev.Trades, ev.Trades...)
+	case name == s.name:												//e.g. every cycle match_trades fills
+		s.ev.Transfers = append(s.ev.Transfers, ev.Transfers...)
+		s.ev.Trades = append(s.ev.Trades, ev.Trades...)
+	default:															//the later event names the transaction, keeping what the earlier ones moved and pruned
+		ev.Transfers = append(s.ev.Transfers, ev.Transfers...)
+		ev.Trades = append(s.ev.Trades, ev.Trades...)
+		s.name = name
+		s.ev = ev
+	}
+}
+
+// ============================================================================================================================
+// decodeJSON - unmarshal the value stored under key into v, an empty value leaves v untouched
+//   anything that does not decode is an error naming the key, so a corrupt value is never mistaken for an empty one
+// ============================================================================================================================
+func decodeJSON(key string, valueAsBytes []byte, v interface{}) error {
+	if len(valueAsBytes) == 0 {
+		return nil
+	}
+	err := json.Unmarshal(valueAsBytes, v)
+	if err != nil {
+		return errors.New("Failed to decode " + key + ": " + err.Error())
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// logError, logInfo, logDebug - print a line like fmt.Println, if the log level is at least error, info or debug
+// ============================================================================================================================
+func logError(a ...interface{}) {
+	logAt(0, a...)
+}
+
+func logInfo(a ...interface{}) {
+	logAt(1, a...)
+}
+
+func logDebug(a ...interface{}) {
+	logAt(2, a...)
+}
+
+func logAt(level int, a ...interface{}) {
+	if level <= logLevel {
+		fmt.Println(append([]interface{}{"[" + logLevels[level] + "]"}, a...)...)
+	}
+}
+
+// ============================================================================================================================
+// parseLogLevel - the index in logLevels of a level name
+// ============================================================================================================================
+func parseLogLevel(name string) (int, error) {
+	for i, level := range logLevels{
+		if level == strings.ToLower(name) {
+			return i, nil
+		}
+	}
+	return 0, errors.New("log_level must be one of " + strings.Join(logLevels, ", "))
+}
+
+// ============================================================================================================================
+// loadLogLevel - pick up the level init stored, once after the chaincode starts
+// ============================================================================================================================
+func loadLogLevel(stub ChaincodeStubInterface) {
+	if logLevelLoaded {
+		return
+	}
+	logLevelLoaded = true
+	levelAsBytes, err := stub.GetState(logLevelStr)
+	if err != nil || len(levelAsBytes) == 0 {
+		return
+	}
+	level, err := parseLogLevel(string(levelAsBytes))
+	if err == nil {
+		logLevel = level
+	}
+}
+
+// ============================================================================================================================
+// getCaller - the marble user making this call, read from an attribute of the transaction certificate
+// ============================================================================================================================
+func getCaller(stub ChaincodeStubInterface) (string, error) {
+	userAsBytes, err := stub.ReadCertAttribute(callerAttr)
+	if err != nil {
+		return "", err														//says how to sign for yourself instead
+	}
+	if len(userAsBytes) == 0 {
+		return "", errors.New("Failed to read the " + callerAttr + " attribute of the caller's certificate")
+	}
+	return strings.ToLower(string(userAsBytes)), nil
+}
+
+// ============================================================================================================================
+// signedCaller - for a call whose last argument is a signed caller argument, _caller:{"user": "bob", "nonce": 7,
+//   "signature": "MEUC..."}, a stub that reads the caller from it and the arguments without it. The signature must be
+//   by the key registered for the user and the nonce bigger than any they used before, so a call can not be replayed.
+//   Other calls come back unchanged
+// ============================================================================================================================
+func signedCaller(stub ChaincodeStubInterface, function string, args []string) (ChaincodeStubInterface, []string, error) {
+	if len(args) == 0 || !strings.HasPrefix(args[len(args)-1], signedCallerPrefix) {
+		return stub, args, nil
+	}
+	var signed SignedCaller
+	err := json.Unmarshal([]byte(strings.TrimPrefix(args[len(args)-1], signedCallerPrefix)), &signed)
+	if err != nil {
+		return nil, nil, errors.New("Failed to decode the signed caller argument: " + err.Error())
+	}
+	args = args[:len(args)-1]
+	user := strings.ToLower(signed.User)
+	callerKey, err := getCallerKey(stub, user)
+	if err != nil {
+		return nil, nil, err
+	}
+	if callerKey.Key == "" {
+		return nil, nil, errors.New("no key is registered for " + user + ", an admin sets one with set_caller_key")
+	}
+	if signed.Nonce <= callerKey.Nonce {
+		return nil, nil, errors.New("signed call by " + user + " needs a nonce above " + strconv.FormatInt(callerKey.Nonce, 10))
+	}
+	err = verifySignature(callerKey.Key, callMessage(function, args, signed.Nonce), signed.Signature)
+	if err != nil {
+		return nil, nil, errors.New("signed call by " + user + ": " + err.Error())
+	}
+	
+	callerKey.Nonce = signed.Nonce
+	jsonAsBytes, _ := json.Marshal(callerKey)
+	err = stub.PutState(callerKeyPrefix + user, jsonAsBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return callerStub{stub, user}, args, nil
+}
+
+// ============================================================================================================================
+// callMessage - what a signed caller argument signs, the function, its arguments and the nonce as a JSON array of strings
+// ============================================================================================================================
+func callMessage(function string, args []string, nonce int64) []byte {
+	message := append([]string{function}, args...)
+	messageAsBytes, _ := json.Marshal(append(message, strconv.FormatInt(nonce, 10)))
+	return messageAsBytes
+}
+
+// ============================================================================================================================
+// parseCallerKey - the ECDSA public key in a caller key, base64 of its PKIX encoding
+// ============================================================================================================================
+func parseCallerKey(key string) (*ecdsa.PublicKey, error) {
+	keyAsBytes, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, errors.New("caller key is not base64")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(keyAsBytes)
+	if err != nil {
+		return nil, errors.New("caller key is not a PKIX public key")
+	}
+	ecdsaKey, ok := publicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("caller key is not an ECDSA key")
+	}
+	return ecdsaKey, nil
+}
+
+// ============================================================================================================================
+// verifySignature - error unless signature, base64 of an ASN.1 ECDSA signature, signs the SHA-256 of message with key
+// ============================================================================================================================
+func verifySignature(key string, message []byte, signature string) error {
+	publicKey, err := parseCallerKey(key)
+	if err != nil {
+		return err
+	}
+	sigAsBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.New("signature is not base64")
+	}
+	var sig struct{
+		R, S *big.Int
+	}
+	_, err = asn1.Unmarshal(sigAsBytes, &sig)
+	if err != nil {
+		return errors.New("signature is not an ASN.1 ECDSA signature")
+	}
+	hash := sha256.Sum256(message)
+	if !ecdsa.Verify(publicKey, hash[:], sig.R, sig.S) {
+		return errors.New("signature does not match the call")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// getCallerKey - the key a user signs calls with, empty when none is registered
+// ============================================================================================================================
+func getCallerKey(stub ChaincodeStubInterface, user string) (CallerKey, error) {
+	var callerKey CallerKey
+	keyAsBytes, err := stub.GetState(callerKeyPrefix + user)
+	if err != nil {
+		return callerKey, errors.New("Failed to get caller key of " + user)
+	}
+	if len(keyAsBytes) == 0 {
+		return callerKey, nil
+	}
+	err = json.Unmarshal(keyAsBytes, &callerKey)
+	if err != nil {
+		return callerKey, errors.New("Failed to decode caller key of " + user)
+	}
+	return callerKey, nil
+}
+
+// ============================================================================================================================
+// putCallerKey - register the key user signs calls with, keeping the last nonce so old calls stay spent
+// ============================================================================================================================
+func putCallerKey(stub ChaincodeStubInterface, user string, key string) error {
+	_, err := parseCallerKey(key)
+	if err != nil {
+		return err
+	}
+	callerKey, err := getCallerKey(stub, user)
+	if err != nil {
+		return err
+	}
+	callerKey.Key = key
+	jsonAsBytes, _ := json.Marshal(callerKey)
+	return stub.PutState(callerKeyPrefix + user, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// checkName - error if a user chosen name or key is in the reserved namespace of the chaincode's own keys
+// ============================================================================================================================
+func checkName(name string) error {
+	if strings.HasPrefix(name, reservedPrefix) {
+		return errors.New(name + " is reserved, names and keys can not start with " + reservedPrefix)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// Marble Key - the key a marble is stored under, kept apart from the keys write can reach
+// ============================================================================================================================
+func marbleKey(name string) string {
+	return marblePrefix + name
+}
+
+// ============================================================================================================================
+// moveKey - move a value still stored under its old key to key, does nothing once it has moved
+// ============================================================================================================================
+func moveKey(stub ChaincodeStubInterface, oldKey string, key string) (bool, error) {
+	existing, err := stub.GetState(key)
+	if err != nil {
+		return false, errors.New("Failed to get " + key)
+	}
+	if len(existing) != 0 {
+		return false, nil
+	}
+	valueAsBytes, err := stub.GetState(oldKey)
+	if err != nil {
+		return false, errors.New("Failed to get " + oldKey)
+	}
+	if len(valueAsBytes) == 0 {
+		return false, nil
+	}
+	err = stub.PutState(key, valueAsBytes)
+	if err != nil {
+		return false, err
+	}
+	err = stub.DelState(oldKey)
+	if err != nil {
+		return false, errors.New("Failed to delete " + oldKey)
+	}
+	return true, nil
+}
+
+// ============================================================================================================================
+// getAdmins - the users allowed to call admin functions, set up by the first init
+// ============================================================================================================================
+func getAdmins(stub ChaincodeStubInterface) ([]string, error) {
+	adminsAsBytes, err := stub.GetState(adminIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get admins")
+	}
+	var admins []string
+	err = decodeJSON(adminIndexStr, adminsAsBytes, &admins)
+	if err != nil {
+		return nil, err
+	}
+	return admins, nil
+}
+
+// ============================================================================================================================
+// putAdmins - store the users allowed to call admin functions
+// ============================================================================================================================
+func putAdmins(stub ChaincodeStubInterface, admins []string) error {
+	jsonAsBytes, _ := json.Marshal(admins)
+	return stub.PutState(adminIndexStr, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// checkAdmin - error unless the caller is an admin. Until the first init stores an admin there are none and only init
+//   may run
+// ============================================================================================================================
+func checkAdmin(stub ChaincodeStubInterface, function string) error {
+	admins, err := getAdmins(stub)
+	if err != nil {
+		return err
+	}
+	if len(admins) == 0 {
+		if function == "init" {
+			return nil
+		}
+		return errors.New(function + " is restricted to admins and there are none yet, init sets up the first")
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return err
+	}
+	if !containsName(admins, caller) {
+		return errors.New(function + " is restricted to admins, " + caller + " is not one")
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// getMarble - read a marble from chaincode state, a missing key is a MarbleNotFoundError
+// ============================================================================================================================
+func getMarble(stub ChaincodeStubInterface, name string) (Marble, error) {
+	var res Marble
+	marbleAsBytes, err := stub.GetState(marbleKey(name))
+	if err != nil {
+		return res, errors.New("Failed to get marble " + name)
+	}
+	if len(marbleAsBytes) == 0 {											//the peer hands back nothing for a missing key
+		return res, &MarbleNotFoundError{name}
+	}
+	err = decodeJSON(name, marbleAsBytes, &res)
+	if err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// ============================================================================================================================
+// Owner Key - the owner index key listing every marble a user owns
+// ============================================================================================================================
+func ownerKey(user string) string {
+	return ownerIndexPrefix + strings.ToLower(user)
+}
+
+// ============================================================================================================================
+// Color Size Key - the color/size index key listing every marble of that color and size
+// ============================================================================================================================
+func colorSizeKey(color string, size int) string {
+	return colorSizeIndexPrefix + strings.ToLower(color) + "_" + strconv.Itoa(size)
+}
+
+// ============================================================================================================================
+// Color Key - the color index key listing every marble of that color
+// ============================================================================================================================
+func colorKey(color string) string {
+	return colorIndexPrefix + strings.ToLower(color)
+}
+
+// ============================================================================================================================
+// getNameList - read a list of marble names, a missing key is an empty list
+// ============================================================================================================================
+func getNameList(stub ChaincodeStubInterface, key string) ([]string, error) {
+	listAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Failed to get index " + key)
+	}
+	var names []string
+	err = decodeJSON(key, listAsBytes, &names)
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// ============================================================================================================================
+// putNameList - rewrite a list of marble names
+// ============================================================================================================================
+func putNameList(stub ChaincodeStubInterface, key string, names []string) error {
+	if names == nil {
+		names = []string{}													//store [] rather than null
+	}
+	jsonAsBytes, _ := json.Marshal(names)
+	return stub.PutState(key, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// addToNameList - add a marble name to a list, once
+// ============================================================================================================================
+func addToNameList(stub ChaincodeStubInterface, key string, name string) error {
+	names, err := getNameList(stub, key)
+	if err != nil {
+		return err
+	}
+	if containsName(names, name) {
+		return nil
+	}
+	return putNameList(stub, key, append(names, name))
+}
+
+// ============================================================================================================================
+// removeFromNameList - take a marble name out of a list
+// ============================================================================================================================
+func removeFromNameList(stub ChaincodeStubInterface, key string, name string) error {
+	names, err := getNameList(stub, key)
+	if err != nil {
+		return err
+	}
+	for i, val := range names{
+		if val == name{
+			return putNameList(stub, key, append(names[:i], names[i+1:]...))
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// containsName - true if name is in the list
+// ============================================================================================================================
+func containsName(names []string, name string) bool {
+	for _, val := range names{
+		if val == name{
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// removeName - names without name
+// ============================================================================================================================
+func removeName(names []string, name string) []string {
+	var kept []string
+	for _, n := range names{
+		if n != name {
+			kept = append(kept, n)
+		}
+	}
+	return kept
+}
+
+// ============================================================================================================================
+// indexKeys - every secondary index key a marble belongs in
+// ============================================================================================================================
+func indexKeys(m Marble) []string {
+	return []string{ownerKey(m.User), colorKey(m.Color), colorSizeKey(m.Color, m.Size)}
+}
+
+// ============================================================================================================================
+// addToIndex - add a marble name to an owner, color or color/size index key, remembering the key for rebuilds
+// ============================================================================================================================
+func addToIndex(stub ChaincodeStubInterface, key string, name string) error {
+	err := addToNameList(stub, indexKeysStr, key)
+	if err != nil {
+		return err
+	}
+	return addToNameList(stub, key, name)
+}
+
+// ============================================================================================================================
+// indexMarble - add a marble to the owner, color and color/size indexes
+// ============================================================================================================================
+func indexMarble(stub ChaincodeStubInterface, m Marble) error {
+	for _, key := range indexKeys(m){
+		err := addToIndex(stub, key, m.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// unindexMarble - take a marble out of the owner, color and color/size indexes
+// ============================================================================================================================
+func unindexMarble(stub ChaincodeStubInterface, m Marble) error {
+	for _, key := range indexKeys(m){
+		err := removeFromNameList(stub, key, m.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// reindexOwner - move a marble from one owner's index to another's
+// ============================================================================================================================
+func reindexOwner(stub ChaincodeStubInterface, name string, from string, to string) error {
+	err := removeFromNameList(stub, ownerKey(from), name)
+	if err != nil {
+		return err
+	}
+	return addToIndex(stub, ownerKey(to), name)
+}
+
+// ============================================================================================================================
+// indexedNames - the names under an index key, or every marble while migrate has yet to rebuild the indexes
+//   callers check each marble they get back against what they are looking for
+// ============================================================================================================================
+func indexedNames(stub ChaincodeStubInterface, key string) ([]string, error) {
+	progress, err := getMigration(stub)
+	if err != nil {
+		return nil, err
+	}
+	if progress.Stage != "done" {
+		return getNameList(stub, marbleIndexStr)
+	}
+	return getNameList(stub, key)
+}
+
+// ============================================================================================================================
+// historyKey - the key holding a marble's ownership history, it outlives the marble so a reused name keeps its past
+// ============================================================================================================================
+func historyKey(name string) string {
+	return historyPrefix + name
+}
+
+// ============================================================================================================================
+// recordTransfer - append an entry to a marble's ownership history, entries are never rewritten
+// ============================================================================================================================
+func recordTransfer(stub ChaincodeStubInterface, name string, from string, to string, reason string) error {
+	now, err := stub.TxTimestamp()
+	if err != nil {
+		return errors.New("Failed to get transaction timestamp")
+	}
+	history, err := getHistory(stub, name)
+	if err != nil {
+		return err
+	}
+	history = append(history, Transfer{From: from, To: to, Reason: reason, Timestamp: now})
+	jsonAsBytes, _ := json.Marshal(history)
+	err = stub.PutState(historyKey(name), jsonAsBytes)
+	if err != nil {
+		return errors.New("Failed to write history of marble " + name)
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// getHistory - a marble's ownership history, oldest first, empty if it never had one
+// ============================================================================================================================
+func getHistory(stub ChaincodeStubInterface, name string) ([]Transfer, error) {
+	history := []Transfer{}
+	historyAsBytes, err := stub.GetState(historyKey(name))
+	if err != nil {
+		return nil, errors.New("Failed to get history of marble " + name)
+	}
+	err = decodeJSON(historyKey(name), historyAsBytes, &history)
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// ============================================================================================================================
+// Rebuild Indexes - regenerate the owner, color and color/size indexes from the marble index, for ledgers that predate
+//   them or whose indexes went stale. Marbles that do not decode are left out, the JSON array returned names them
+// ============================================================================================================================
+func (t *SimpleChaincode) rebuild_indexes(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	logDebug("- start rebuild indexes")
+	progress := Migration{Version: schemaVersion, Stage: "indexes", Broken: []string{}}
+	for progress.Stage == "indexes" {											//every batch, in this one transaction
+		_, err := indexMarbles(stub, &progress, migrateBatchSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	logDebug("- end rebuild indexes")
+	return json.Marshal(progress.Broken)
+}
+
+// ============================================================================================================================
+// Scan Records - report every marble in the index whose record does not parse
+// ============================================================================================================================
+func (t *SimpleChaincode) scan_records(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	broken, _, err := brokenMarbles(stub)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(broken)
+}
+
+// ============================================================================================================================
+// Repair Records - rewrite every broken marble record that can be rebuilt, returns what scan_records would have reported
+// ============================================================================================================================
+func (t *SimpleChaincode) repair_records(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	logDebug("- start repair records")
+	broken, repaired, err := brokenMarbles(stub)
+	if err != nil {
+		return nil, err
+	}
+	for _, marble := range repaired{
+		jsonAsBytes, _ := json.Marshal(marble)
+		err = stub.PutState(marbleKey(marble.Name), jsonAsBytes)
+		if err != nil {
+			return nil, errors.New("Failed to rewrite marble " + marble.Name)
+		}
+		logInfo("! repaired marble " + marble.Name)
+	}
+	logDebug("- end repair records")
+	return json.Marshal(broken)
+}
+
+// ============================================================================================================================
+// brokenMarbles - every marble in the index whose record does not parse, plus a rebuilt marble for each one that can be
+// ============================================================================================================================
+func brokenMarbles(stub ChaincodeStubInterface) ([]BrokenRecord, []Marble, error) {
+	marblesAsBytes, err := stub.GetState(marbleIndexStr)
+	if err != nil {
+		return nil, nil, errors.New("Failed to get marble index")
+	}
+	var marbleIndex []string
+	err = decodeJSON(marbleIndexStr, marblesAsBytes, &marbleIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+	
+	broken := []BrokenRecord{}
+	var repaired []Marble
+	for _, name := range marbleIndex{
+		marbleAsBytes, err := stub.GetState(marbleKey(name))
+		if err != nil {
+			return nil, nil, errors.New("Failed to get marble " + name)
+		}
+		if len(marbleAsBytes) == 0 {
+			continue																//deleted, nothing to parse
+		}
+		var res Marble
+		err = json.Unmarshal(marbleAsBytes, &res)
+		if err == nil {
+			continue
+		}
+		marble, ok := parseLegacyMarble(string(marbleAsBytes))
+		ok = ok && marble.Name == name
+		broken = append(broken, BrokenRecord{Key: name, Error: err.Error(), Repairable: ok})
+		if ok {
+			repaired = append(repaired, marble)
+		}
+	}
+	return broken, repaired, nil
+}
+
+// ============================================================================================================================
+// parseLegacyMarble - read a marble written by the old init_marble, which built the JSON by hand
+// ============================================================================================================================
+func parseLegacyMarble(str string) (Marble, bool) {
+	fields, ok := splitLegacy(str, []string{`{"name": "`, `", "color": "`, `", "size": `, `, "user": "`, `"}`})
+	if !ok {
+		return Marble{}, false
+	}
+	size, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return Marble{}, false
+	}
+	return Marble{Name: fields[0], Color: fields[1], Size: size, User: fields[3]}, true
+}
+
+// ============================================================================================================================
+// splitLegacy - the fields between seps in a record built by concatenating strings, as records were before
+//   they were marshalled, seps[0] must start it and the last sep end it
+// ============================================================================================================================
+func splitLegacy(str string, seps []string) ([]string, bool) {
+	first := seps[0]
+	last := seps[len(seps) - 1]
+	if len(str) < len(first) + len(last) || !strings.HasPrefix(str, first) || !strings.HasSuffix(str, last) {
+		return nil, false
+	}
+	rest := str[len(first):len(str) - len(last)]
+	var fields []string
+	for _, sep := range seps[1:len(seps) - 1]{
+		i := strings.Index(rest, sep)
+		if i < 0 {
+			return nil, false
+		}
+		fields = append(fields, rest[:i])
+		rest = rest[i + len(sep):]
+	}
+	return append(fields, rest), true
+}
+
+// ============================================================================================================================
+// Verify State - walk the marble index, every marble and the owner, color and history keys hanging off them, then
+//   the open trades, and report every value that does not decode
+// ============================================================================================================================
+func (t *SimpleChaincode) verify_state(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	problems := []BrokenRecord{}
+	var admins []string
+	problems, _, err := checkState(stub, adminIndexStr, &admins, problems)
+	if err != nil {
+		return nil, err
+	}
+	var marbleIndex []string
+	problems, ok, err := checkState(stub, marbleIndexStr, &marbleIndex, problems)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		broken, _, err := brokenMarbles(stub)										//marble records, with whether repair_records can fix them
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, broken...)
+	}
+	
+	var trackedKeys []string
+	problems, _, err = checkState(stub, indexKeysStr, &trackedKeys, problems)
+	if err != nil {
+		return nil, err
+	}
+	checked := make(map[string]bool)											//marbles share index keys, check each once
+	for _, key := range trackedKeys{
+		checked[key] = true
+		var names []string
+		problems, _, err = checkState(stub, key, &names, problems)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range marbleIndex{
+		res, err := getMarble(stub, name)
+		if err != nil {
+			continue																//deleted, or already reported
+		}
+		for _, key := range indexKeys(res){
+			if checked[key] {
+				continue
+			}
+			checked[key] = true
+			var names []string
+			problems, _, err = checkState(stub, key, &names, problems)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var history []Transfer
+		problems, _, err = checkState(stub, historyKey(name), &history, problems)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//open trades, and the old blob until migrate_trades has run
+	var tradeIndex []string
+	problems, _, err = checkState(stub, tradeIndexStr, &tradeIndex, problems)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range tradeIndex{
+		var trade AnOpenTrade
+		problems, _, err = checkState(stub, tradeKey(id), &trade, problems)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var trades AllTrades
+	problems, _, err = checkState(stub, openTradesStr, &trades, problems)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(problems)
+}
+
+// ============================================================================================================================
+// checkState - decode the value under key into v, adding a BrokenRecord to problems when it does not decode
+// ============================================================================================================================
+func checkState(stub ChaincodeStubInterface, key string, v interface{}, problems []BrokenRecord) ([]BrokenRecord, bool, error) {
+	valueAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return problems, false, errors.New("Failed to get " + key)
+	}
+	err = decodeJSON(key, valueAsBytes, v)
+	if err != nil {
+		return append(problems, BrokenRecord{Key: key, Error: err.Error()}), false, nil
+	}
+	return problems, true, nil
+}
+
+// ============================================================================================================================
+// Open Trade - create an open trade for a marble you want with marbles you have, returns the id of the trade
+// ============================================================================================================================
+func (t *SimpleChaincode) open_trade(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+	var will_size int
+	var trade_away Description
+	
+	//	0        1      2     3      4      5       6
+	//["bob", "blue", "16", "red", "16"] *"blue", "35*  *"3600"*
+	// an even number of arguments means the last one is how many seconds the trade stays open
+	var ttl int64
+	if len(args)%2 == 0 && len(args) > 0 {
+		ttl, err = parseTTL(args[len(args) - 1])
+		if err != nil {
+			return nil, err
+		}
+		args = args[:len(args) - 1]
+	}
+	size1, _ := strconv.Atoi(args[2])											//checkArgs made sure the first pair is there and numeric
+
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	if caller != strings.ToLower(args[0]) {										//only offer your own marbles
+		return nil, errors.New(caller + " cannot open a trade for " + args[0])
+	}
+
+	open := AnOpenTrade{Version: schemaVersion}
+	open.Id, err = newTradeId(stub)												//same on every peer, unlike the wall clock
+	if err != nil {
+		return nil, err
+	}
+	open.User = strings.ToLower(args[0])
+	open.Timestamp, open.Expires, err = tradeTimes(stub, ttl)
+	if err != nil {
+		return nil, err
+	}
+	open.Want.Color = strings.ToLower(args[1])
+	open.Want.Size =  size1
+	logDebug("- start open trade")
+
+	for i:=3; i < len(args); i++ {												//create and append each willing trade
 		will_size, err = strconv.Atoi(args[i + 1])
 		if err != nil {
-			msg := "is not a numeric string " + args[i + 1]
-			fmt.Println(msg)
-			return nil, errors.New(msg)
+			msg := "is not a numeric string " + args[i + 1]
+			logError(msg)
+			return nil, errors.New(msg)
+		}
+		
+		trade_away = Description{}
+		trade_away.Color = strings.ToLower(args[i])
+		trade_away.Size =  will_size
+		logDebug("! created trade_away: " + args[i])
+		
+		open.Willing = append(open.Willing, trade_away)
+		logDebug("! appended willing to open")
+		i++;
+	}
+	
+	err = addTrade(stub, open)													//store it under its own key
+	if err != nil {
+		return nil, err
+	}
+	err = emitEvent(stub, "trade_opened", MarbleEvent{Trade: open.Id, OldOwner: open.User})
+	if err != nil {
+		return nil, err
+	}
+	logInfo("! stored open trade " + open.Id)
+	logDebug("- end open trade")
+	return []byte(open.Id), nil
+}
+
+// ============================================================================================================================
+// Open Escrow Trade - open_trade that also locks one of the opener's marbles for every willing option, so the
+//   marbles on offer can not be given away or deleted until the trade is performed or removed
+// ============================================================================================================================
+func (t *SimpleChaincode) open_escrow_trade(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	idAsBytes, err := t.open_trade(stub, args)									//same arguments as open_trade
+	if err != nil {
+		return nil, err
+	}
+	
+	logDebug("- start escrow")
+	trade, err := getTrade(stub, string(idAsBytes))
+	if err != nil {
+		return nil, err
+	}
+	for _, will := range trade.Willing{
+		marble, err := findMarble4Trade(stub, trade.User, will.Color, will.Size)	//skips locked marbles, so every option locks a different one
+		if err != nil {
+			return nil, errors.New(trade.User + " has no free " + will.Color + " size " + strconv.Itoa(will.Size) + " marble to put in escrow")
+		}
+		marble.Locked = trade.Id
+		jsonAsBytes, _ := json.Marshal(marble)
+		err = stub.PutState(marbleKey(marble.Name), jsonAsBytes)
+		if err != nil {
+			return nil, errors.New("Failed to lock marble " + marble.Name)
+		}
+		trade.Escrow = append(trade.Escrow, marble.Name)
+		logInfo("! locked marble " + marble.Name)
+	}
+	err = putTrade(stub, trade)
+	if err != nil {
+		return nil, err
+	}
+	logDebug("- end escrow")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Open Bundle Trade - create an open trade for a set of marbles you want, paid with a set of marbles you have, returns
+//   the id of the trade
+// ============================================================================================================================
+func (t *SimpleChaincode) open_bundle_trade(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+	
+	//	0       1       2      3      4      5      6      7       8      9
+	//["bob", "3", "blue", "16", "blue", "16", "red", "35", "green", "5"]
+	// user, # of wanted marbles, then color/size of each wanted marble, then color/size of each marble given
+	// an odd number of arguments means the last one is how many seconds the trade stays open
+	var ttl int64
+	if len(args)%2 == 1 {
+		ttl, err = parseTTL(args[len(args) - 1])
+		if err != nil {
+			return nil, err
+		}
+		args = args[:len(args) - 1]
+	}
+	wantCount, _ := strconv.Atoi(args[1])										//checkArgs made sure it is a number
+	if wantCount < 1 {
+		return nil, errors.New("want_count must be a positive numeric string")
+	}
+	pairs, err := descriptionPairs(args[2:])
+	if err != nil {
+		return nil, err
+	}
+	if wantCount >= len(pairs) {
+		return nil, errors.New("A bundle trade must give at least one marble")
+	}
+
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	if caller != strings.ToLower(args[0]) {										//only offer your own marbles
+		return nil, errors.New(caller + " cannot open a trade for " + args[0])
+	}
+	
+	logDebug("- start open bundle trade")
+	open := AnOpenTrade{Version: schemaVersion}
+	open.Id, err = newTradeId(stub)
+	if err != nil {
+		return nil, err
+	}
+	open.User = strings.ToLower(args[0])
+	open.Timestamp, open.Expires, err = tradeTimes(stub, ttl)
+	if err != nil {
+		return nil, err
+	}
+	open.WantBundle = pairs[:wantCount]
+	open.GiveBundle = pairs[wantCount:]
+	
+	_, err = findMarbles4Bundle(stub, open.User, open.GiveBundle)				//must own the whole bundle today
+	if err != nil {
+		return nil, err
+	}
+	err = addTrade(stub, open)
+	if err != nil {
+		return nil, err
+	}
+	err = emitEvent(stub, "trade_opened", MarbleEvent{Trade: open.Id, OldOwner: open.User})
+	if err != nil {
+		return nil, err
+	}
+	logDebug("- end open bundle trade")
+	return []byte(open.Id), nil
+}
+
+// ============================================================================================================================
+// descriptionPairs - parse a flat list of color, size, color, size... into descriptions
+// ============================================================================================================================
+func descriptionPairs(args []string) ([]Description, error) {
+	var pairs []Description
+	for i := 0; i + 1 < len(args); i += 2 {
+		size, err := strconv.Atoi(args[i + 1])
+		if err != nil {
+			return nil, errors.New("is not a numeric string " + args[i + 1])
+		}
+		pairs = append(pairs, Description{Color: strings.ToLower(args[i]), Size: size})
+	}
+	return pairs, nil
+}
+
+// ============================================================================================================================
+// parseTTL - a trade's time to live, a positive number of seconds
+// ============================================================================================================================
+func parseTTL(arg string) (int64, error) {
+	ttl, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || ttl <= 0 {
+		return 0, errors.New("time to live must be a positive number of seconds, got " + arg)
+	}
+	return ttl, nil
+}
+
+// ============================================================================================================================
+// tradeTimes - creation time and expiry of a trade opened in this transaction that stays open ttl seconds, 0 ttl never expires.
+//   Without a transaction timestamp both are 0 and trades can not be given a ttl
+// ============================================================================================================================
+func tradeTimes(stub ChaincodeStubInterface, ttl int64) (int64, int64, error) {
+	now, err := stub.TxTimestamp()
+	if err != nil {
+		return 0, 0, errors.New("Failed to get transaction timestamp")
+	}
+	if now == 0 && ttl != 0 {
+		return 0, 0, errors.New("this peer gives no transaction timestamp, so trades can not expire, open it without a ttl")
+	}
+	if ttl == 0 {
+		return now, 0, nil
+	}
+	return now, now + ttl * 1000, nil
+}
+
+// ============================================================================================================================
+// isExpired - true if the trade has an expiry and now is at or past it, or now is 0 because the peer gives no transaction
+//   timestamp and there is no telling
+// ============================================================================================================================
+func isExpired(trade AnOpenTrade, now int64) bool {
+	return trade.Expires != 0 && (now == 0 || now >= trade.Expires)
+}
+
+// ============================================================================================================================
+// Perform Trade - close an open trade and move ownership
+// ============================================================================================================================
+func (t *SimpleChaincode) perform_trade(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+	
+	//	0		1					2					3				4					5
+	//[data.id, data.closer.user, data.closer.name, data.opener.user, data.opener.color, data.opener.size]
+	//bundle trades name one closer marble per wanted marble instead
+	//[data.id, data.closer.user, data.closer.names...]
+	
+	logDebug("- start close trade")
+
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	if caller != strings.ToLower(args[1]) {										//only the closer can hand over their marble
+		return nil, errors.New(caller + " cannot close a trade for " + args[1])
+	}
+	
+	trade, err := getTrade(stub, args[0])											//look for the trade
+	if err != nil {
+		logError(err.Error())
+		return nil, err
+	}
+	logDebug("found the trade")
+	now, err := stub.TxTimestamp()
+	if err != nil {
+		return nil, errors.New("Failed to get transaction timestamp")
+	}
+	if isExpired(trade, now) {
+		msg := "Trade " + trade.Id + " has expired"
+		logError(msg)
+		return nil, errors.New(msg)
+	}
+	if isBundle(trade) {
+		err = settleBundle(stub, trade, args[1], args[2:])
+	} else {
+		args, err = checkArgs("perform_trade", closeTradeArgs, args)
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(args[5])
+		err = settleTrade(stub, trade, args[1], args[2], args[4], size)
+	}
+	if err != nil {
+		logError(err.Error())
+		return nil, err
+	}
+	logDebug("- end close trade")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// settleTrade - check both legs of an open trade, then swap the marbles and drop the trade
+//   nothing is written until both legs check out, and a failed write fails the invocation so the peer discards all of it
+// ============================================================================================================================
+func settleTrade(stub ChaincodeStubInterface, trade AnOpenTrade, closer string, closersName string, color string, size int) error {
+	tradeId := trade.Id
+
+	//closer leg - the closer must still own a marble that is what the opener wants
+	closersMarble, err := getMarble(stub, closersName)
+	if err != nil {
+		return err																				//a missing marble stays a MarbleNotFoundError
+	}
+	if strings.ToLower(closersMarble.User) != strings.ToLower(closer) {
+		return &TradeError{tradeId, "closer", closer + " does not own marble " + closersName}
+	}
+	if closersMarble.Locked != "" {
+		return &TradeError{tradeId, "closer", "marble " + closersName + " is locked in escrow by trade " + closersMarble.Locked}
+	}
+	if strings.ToLower(closersMarble.Color) != strings.ToLower(trade.Want.Color) || closersMarble.Size != trade.Want.Size {
+		return &TradeError{tradeId, "closer", "marble " + closersName + " does not meet trade requirements"}
+	}
+
+	//opener leg - the requested marble must be on offer and the opener must still own one
+	if !willingToGive(trade, Description{Color: color, Size: size}) {
+		return &TradeError{tradeId, "opener", "trade does not offer a " + color + " size " + strconv.Itoa(size) + " marble"}
+	}
+	openersMarble, err := offeredMarble(stub, trade, Description{Color: color, Size: size})
+	if err != nil {
+		return &TradeError{tradeId, "opener", err.Error()}
+	}
+
+	//both legs are good, build every write before touching the ledger
+	closersOldUser := closersMarble.User
+	openersOldUser := openersMarble.User
+	closersMarble.User = strings.ToLower(trade.User)											//closer -> opener
+	openersMarble.User = strings.ToLower(closer)												//opener -> closer
+	openersMarble.Locked = ""																	//leaves escrow with the trade
+	closersAsBytes, _ := json.Marshal(closersMarble)
+	openersAsBytes, _ := json.Marshal(openersMarble)
+
+	err = stub.PutState(marbleKey(closersName), closersAsBytes)
+	if err != nil {
+		return &TradeError{tradeId, "closer", "failed to write marble " + closersName}
+	}
+	err = stub.PutState(marbleKey(openersMarble.Name), openersAsBytes)
+	if err != nil {
+		return &TradeError{tradeId, "opener", "failed to write marble " + openersMarble.Name}
+	}
+	err = reindexOwner(stub, closersName, closersOldUser, closersMarble.User)
+	if err != nil {
+		return err
+	}
+	err = reindexOwner(stub, openersMarble.Name, openersOldUser, openersMarble.User)
+	if err != nil {
+		return err
+	}
+	err = recordTransfer(stub, closersName, closersOldUser, closersMarble.User, tradeId)
+	if err != nil {
+		return err
+	}
+	err = recordTransfer(stub, openersMarble.Name, openersOldUser, openersMarble.User, tradeId)
+	if err != nil {
+		return err
+	}
+	err = emitEvent(stub, "trade_performed", MarbleEvent{Trade: tradeId, Transfers: []MarbleEvent{
+		{Marble: closersName, OldOwner: closersOldUser, NewOwner: closersMarble.User},
+		{Marble: openersMarble.Name, OldOwner: openersOldUser, NewOwner: openersMarble.User},
+	}})
+	if err != nil {
+		return err
+	}
+	return removeTrade(stub, tradeId)															//remove trade
+}
+
+// ============================================================================================================================
+// Match Trades - fill every group of open trades whose wants and willings line up, pairs first then longer cycles
+//   returns a JSON array holding the ids of each group of trades that was filled
+// ============================================================================================================================
+func (t *SimpleChaincode) match_trades(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	logDebug("- start match trades")
+	
+	now, err := stub.TxTimestamp()
+	if err != nil {
+		return nil, errors.New("Failed to get transaction timestamp")
+	}
+	
+	filled := [][]string{}
+	for {																			//every fill removes trades, so this ends
+		all, err := getOpenTrades(stub)
+		if err != nil {
+			return nil, err
+		}
+		var trades []AnOpenTrade
+		for _, trade := range all{
+			if !isExpired(trade, now) {
+				trades = append(trades, trade)
+			}
+		}
+		cycle, marbles, err := findTradeCycle(stub, trades)
+		if err != nil {
+			return nil, err
+		}
+		if cycle == nil {
+			break
+		}
+		
+		err = settleCycle(stub, cycle, marbles)
+		if err != nil {
+			return nil, err
+		}
+		var ids []string
+		for _, trade := range cycle{
+			ids = append(ids, trade.Id)
+		}
+		logInfo("! filled trades " + strings.Join(ids, ", "))
+		filled = append(filled, ids)
+	}
+	
+	logDebug("- end match trades")
+	return json.Marshal(filled)
+}
+
+// ============================================================================================================================
+// findTradeCycle - shortest chain of open trades where each opener can give the next one what they want, closing on the first
+//   marbles[i] is the marble the opener of cycle[i] hands to the opener of the next trade, nil when nothing lines up
+// ============================================================================================================================
+func findTradeCycle(stub ChaincodeStubInterface, trades []AnOpenTrade) ([]AnOpenTrade, []Marble, error) {
+	//gives[i][j] - a marble the opener of trade i owns and is willing to trade away that the opener of trade j wants
+	gives := make([]map[int]Marble, len(trades))
+	for i := range trades{
+		gives[i] = make(map[int]Marble)
+		for j := range trades{
+			if isBundle(trades[i]) || isBundle(trades[j]) {
+				continue																//bundles are only filled by perform_trade
+			}
+			if strings.ToLower(trades[i].User) == strings.ToLower(trades[j].User) || !willingToGive(trades[i], trades[j].Want) {
+				continue
+			}
+			marble, e := offeredMarble(stub, trades[i], trades[j].Want)
+			if e == nil {
+				gives[i][j] = marble
+			}
+		}
+	}
+	
+	for length := 2; length <= maxCycleLength; length++ {
+		for start := range trades{
+			path := cyclePath(gives, trades, []int{start}, length)
+			if path == nil {
+				continue
+			}
+			var cycle []AnOpenTrade
+			var marbles []Marble
+			for i, p := range path{
+				cycle = append(cycle, trades[p])
+				marbles = append(marbles, gives[p][path[(i + 1) % len(path)]])
+			}
+			return cycle, marbles, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// ============================================================================================================================
+// cyclePath - grow path to length trades that close back on path[0], or nil
+//   later trades must come after path[0] so each cycle is only found from its first trade, and every opener must be different
+// ============================================================================================================================
+func cyclePath(gives []map[int]Marble, trades []AnOpenTrade, path []int, length int) []int {
+	last := path[len(path) - 1]
+	if len(path) == length {
+		if _, ok := gives[last][path[0]]; ok {
+			return path
+		}
+		return nil
+	}
+	
+	for next := path[0] + 1; next < len(trades); next++ {
+		if _, ok := gives[last][next]; !ok {
+			continue
+		}
+		repeat := false
+		for _, p := range path{
+			if strings.ToLower(trades[p].User) == strings.ToLower(trades[next].User) {
+				repeat = true
+				break
+			}
+		}
+		if repeat {
+			continue
+		}
+		grown := append(append([]int{}, path...), next)
+		if found := cyclePath(gives, trades, grown, length); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// settleCycle - hand each marble to the opener of the next trade in the cycle and remove the filled trades
+//   every opener in a cycle is different so no marble moves twice, a failed write fails the whole invocation
+// ============================================================================================================================
+func settleCycle(stub ChaincodeStubInterface, cycle []AnOpenTrade, marbles []Marble) error {
+	var moved []MarbleEvent
+	for i := range cycle{
+		marble := marbles[i]
+		oldUser := marble.User
+		marble.User = strings.ToLower(cycle[(i + 1) % len(cycle)].User)						//opener i -> opener i+1
+		marble.Locked = ""																		//leaves escrow with the trade
+		jsonAsBytes, _ := json.Marshal(marble)
+		err := stub.PutState(marbleKey(marble.Name), jsonAsBytes)
+		if err != nil {
+			return &TradeError{cycle[i].Id, "opener", "failed to write marble " + marble.Name}
+		}
+		err = reindexOwner(stub, marble.Name, oldUser, marble.User)
+		if err != nil {
+			return err
+		}
+		err = recordTransfer(stub, marble.Name, oldUser, marble.User, cycle[i].Id)
+		if err != nil {
+			return err
+		}
+		moved = append(moved, MarbleEvent{Marble: marble.Name, OldOwner: oldUser, NewOwner: marble.User, Trade: cycle[i].Id})
+	}
+	for _, trade := range cycle{
+		err := removeTrade(stub, trade.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return emitEvent(stub, "trades_matched", MarbleEvent{Transfers: moved})
+}
+
+// ============================================================================================================================
+// isBundle - true for trades opened with open_bundle_trade
+// ============================================================================================================================
+func isBundle(trade AnOpenTrade) bool {
+	return len(trade.GiveBundle) > 0
+}
+
+// ============================================================================================================================
+// settleBundle - check every marble of both bundles, then move them all and drop the trade
+//   nothing is written until both legs check out, and a failed write fails the invocation so the peer discards all of it
+// ============================================================================================================================
+func settleBundle(stub ChaincodeStubInterface, trade AnOpenTrade, closer string, closersNames []string) error {
+	tradeId := trade.Id
+
+	//closer leg - one distinct marble the closer owns for every wanted marble
+	if len(closersNames) != len(trade.WantBundle) {
+		return &TradeError{tradeId, "closer", "expected " + strconv.Itoa(len(trade.WantBundle)) + " marbles, got " + strconv.Itoa(len(closersNames))}
+	}
+	var closersMarbles []Marble
+	for _, name := range closersNames{
+		if containsName(marbleNames(closersMarbles), name) {
+			return &TradeError{tradeId, "closer", "marble " + name + " was named twice"}
+		}
+		res, err := getMarble(stub, name)
+		if err != nil {
+			return err																	//a missing marble stays a MarbleNotFoundError
+		}
+		if strings.ToLower(res.User) != strings.ToLower(closer) {
+			return &TradeError{tradeId, "closer", closer + " does not own marble " + name}
+		}
+		if res.Locked != "" {
+			return &TradeError{tradeId, "closer", "marble " + name + " is locked in escrow by trade " + res.Locked}
+		}
+		closersMarbles = append(closersMarbles, res)
+	}
+	if !coversBundle(closersMarbles, trade.WantBundle) {
+		return &TradeError{tradeId, "closer", "marbles do not meet trade requirements"}
+	}
+
+	//opener leg - the opener must still own the whole bundle they offered
+	openersMarbles, err := findMarbles4Bundle(stub, trade.User, trade.GiveBundle)
+	if err != nil {
+		return &TradeError{tradeId, "opener", err.Error()}
+	}
+
+	//both legs are good, move every marble
+	moved := append(transfers(closersMarbles, trade.User), transfers(openersMarbles, closer)...)
+	err = moveMarbles(stub, closersMarbles, trade.User, tradeId)									//closer -> opener
+	if err != nil {
+		return &TradeError{tradeId, "closer", err.Error()}
+	}
+	err = moveMarbles(stub, openersMarbles, closer, tradeId)										//opener -> closer
+	if err != nil {
+		return &TradeError{tradeId, "opener", err.Error()}
+	}
+	err = emitEvent(stub, "trade_performed", MarbleEvent{Trade: tradeId, Transfers: moved})
+	if err != nil {
+		return err
+	}
+	return removeTrade(stub, tradeId)													//remove trade
+}
+
+// ============================================================================================================================
+// moveMarbles - hand every marble to a new owner for a trade, keeping the owner index and history in step
+// ============================================================================================================================
+func moveMarbles(stub ChaincodeStubInterface, marbles []Marble, to string, tradeId string) error {
+	to = strings.ToLower(to)
+	for _, marble := range marbles{
+		oldUser := marble.User
+		marble.User = to
+		jsonAsBytes, _ := json.Marshal(marble)
+		err := stub.PutState(marbleKey(marble.Name), jsonAsBytes)
+		if err != nil {
+			return errors.New("failed to write marble " + marble.Name)
+		}
+		err = reindexOwner(stub, marble.Name, oldUser, to)
+		if err != nil {
+			return err
+		}
+		err = recordTransfer(stub, marble.Name, oldUser, to, tradeId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// transfers - event entries for marbles about to be handed to a new owner
+// ============================================================================================================================
+func transfers(marbles []Marble, to string) []MarbleEvent {
+	var moved []MarbleEvent
+	for _, marble := range marbles{
+		moved = append(moved, MarbleEvent{Marble: marble.Name, OldOwner: marble.User, NewOwner: to})
+	}
+	return moved
+}
+
+// ============================================================================================================================
+// findMarbles4Bundle - one distinct marble this user owns for every description in the bundle
+// ============================================================================================================================
+func findMarbles4Bundle(stub ChaincodeStubInterface, user string, bundle []Description) ([]Marble, error) {
+	owned, err := indexedNames(stub, ownerKey(user))
+	if err != nil {
+		return nil, err
+	}
+	
+	var found []Marble
+	for _, want := range bundle{
+		matching, err := indexedNames(stub, colorSizeKey(want.Color, want.Size))
+		if err != nil {
+			return nil, err
+		}
+		picked := false
+		for _, name := range owned{
+			if !containsName(matching, name) || containsName(marbleNames(found), name) {
+				continue
+			}
+			res, err := getMarble(stub, name)
+			if _, missing := err.(*MarbleNotFoundError); missing {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if res.Locked == "" && strings.ToLower(res.User) == strings.ToLower(user) && strings.ToLower(res.Color) == strings.ToLower(want.Color) && res.Size == want.Size {
+				found = append(found, res)
+				picked = true
+				break
+			}
+		}
+		if !picked {
+			return nil, errors.New(user + " does not own enough " + want.Color + " size " + strconv.Itoa(want.Size) + " marbles for this bundle")
+		}
+	}
+	return found, nil
+}
+
+// ============================================================================================================================
+// coversBundle - true if the marbles fit the bundle exactly, one marble per description
+// ============================================================================================================================
+func coversBundle(marbles []Marble, bundle []Description) bool {
+	if len(marbles) != len(bundle) {
+		return false
+	}
+	used := make([]bool, len(marbles))
+	for _, want := range bundle{
+		picked := false
+		for i, m := range marbles{
+			if !used[i] && strings.ToLower(m.Color) == strings.ToLower(want.Color) && m.Size == want.Size {
+				used[i] = true
+				picked = true
+				break
+			}
+		}
+		if !picked {
+			return false
+		}
+	}
+	return true
+}
+
+// ============================================================================================================================
+// marbleNames - the names of a list of marbles
+// ============================================================================================================================
+func marbleNames(marbles []Marble) []string {
+	var names []string
+	for _, m := range marbles{
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+// ============================================================================================================================
+// willingToGive - true if the trade offers a marble that fits this description
+// ============================================================================================================================
+func willingToGive(trade AnOpenTrade, want Description) bool {
+	for _, will := range trade.Willing{
+		if strings.ToLower(will.Color) == strings.ToLower(want.Color) && will.Size == want.Size {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// findMarble4Trade - look for a matching marble that this user owns and return it
+// ============================================================================================================================
+func findMarble4Trade(stub ChaincodeStubInterface, user string, color string, size int )(m Marble, err error){
+	var fail Marble;
+	logDebug("- start find marble 4 trade")
+	logDebug("looking for " + user + ", " + color + ", " + strconv.Itoa(size))
+
+	//marbles this user owns that also have this color and size
+	owned, err := indexedNames(stub, ownerKey(user))
+	if err != nil {
+		return fail, err
+	}
+	matching, err := indexedNames(stub, colorSizeKey(color, size))
+	if err != nil {
+		return fail, err
+	}
+	
+	for _, name := range owned{
+		if !containsName(matching, name) {
+			continue
+		}
+		res, err := getMarble(stub, name)										//grab this marble
+		if _, missing := err.(*MarbleNotFoundError); missing {
+			continue
+		}
+		if err != nil {
+			return fail, err
+		}
+		
+		//check for user && color && size, an index written before a fix could be stale, and skip marbles locked in escrow
+		if res.Locked == "" && strings.ToLower(res.User) == strings.ToLower(user) && strings.ToLower(res.Color) == strings.ToLower(color) && res.Size == size{
+			logDebug("found a marble: " + res.Name)
+			logDebug("! end find marble 4 trade")
+			return res, nil
+		}
+	}
+	
+	logDebug("- end find marble 4 trade - error")
+	return fail, errors.New("Did not find marble to use in this trade")
+}
+
+// ============================================================================================================================
+// offeredMarble - the marble the opener of a trade hands over for want, one of the escrowed marbles for escrow trades
+// ============================================================================================================================
+func offeredMarble(stub ChaincodeStubInterface, trade AnOpenTrade, want Description) (Marble, error) {
+	if len(trade.Escrow) == 0 {
+		return findMarble4Trade(stub, trade.User, want.Color, want.Size)
+	}
+	for _, name := range trade.Escrow{
+		res, err := getMarble(stub, name)
+		if _, missing := err.(*MarbleNotFoundError); missing {
+			continue
+		}
+		if err != nil {
+			return Marble{}, err
+		}
+		if res.Locked == trade.Id && strings.ToLower(res.User) == strings.ToLower(trade.User) && strings.ToLower(res.Color) == strings.ToLower(want.Color) && res.Size == want.Size {
+			return res, nil
+		}
+	}
+	return Marble{}, errors.New("Did not find an escrowed marble to use in this trade")
+}
+
+// ============================================================================================================================
+// Remove Open Trade - close an open trade
+// ============================================================================================================================
+func (t *SimpleChaincode) remove_trade(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
+	
+	//	0
+	//[data.id]
+	
+	logDebug("- start remove trade")
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	admins, err := getAdmins(stub)
+	if err != nil {
+		return nil, err
+	}
+	if !containsName(admins, caller) {														//admins may remove any trade, even a broken one
+		trade, err := getTrade(stub, args[0])
+		if err != nil {
+			return nil, err
+		}
+		if caller != strings.ToLower(trade.User) {											//everyone else only their own
+			return nil, errors.New(caller + " cannot remove trade " + trade.Id + " opened by " + trade.User)
+		}
+	}
+	err = removeTrade(stub, args[0])																//drop the trade and its index entry
+	if err != nil {
+		return nil, err
+	}
+	err = emitEvent(stub, "trade_removed", MarbleEvent{Trade: args[0]})
+	if err != nil {
+		return nil, err
+	}
+	
+	logDebug("- end remove trade")
+	return nil, nil
+}
+
+// ============================================================================================================================
+// Clean Up Open Trades - make sure open trades are still possible, remove choices that are no longer possible, remove trades that have no valid choices
+// ============================================================================================================================
+func cleanTrades(stub ChaincodeStubInterface)(err error){
+	logDebug("- start clean trades")
+	
+	trades, err := getOpenTrades(stub)
+	if err != nil {
+		return err
+	}
+	
+	var pruned []string																							//ids of trades removed or cut down
+	logDebug("# trades " + strconv.Itoa(len(trades)))
+	for i := range trades{																						//iter over all the known open trades
+		logDebug(strconv.Itoa(i) + ": looking at trade " + trades[i].Id)
+		
+		if len(trades[i].Escrow) > 0 {
+			continue																							//escrowed marbles can not leave the opener
+		}
+		if isBundle(trades[i]) {																				//a bundle is all or nothing
+			_, e := findMarbles4Bundle(stub, trades[i].User, trades[i].GiveBundle)
+			if e != nil {
+				logDebug("! opener no longer owns the bundle, removing trade")
+				err = removeTrade(stub, trades[i].Id)
+				if err != nil {
+					return err
+				}
+				pruned = append(pruned, trades[i].Id)
+			}
+			continue
+		}
+		
+		logDebug("# options " + strconv.Itoa(len(trades[i].Willing)))
+		var willing []Description
+		for x := range trades[i].Willing{																		//find a marble that is suitable
+			logDebug("! on next option " + strconv.Itoa(i) + ":" + strconv.Itoa(x))
+			_, e := findMarble4Trade(stub, trades[i].User, trades[i].Willing[x].Color, trades[i].Willing[x].Size)
+			if(e != nil){
+				logDebug("! errors with this option, removing option")
+			}else{
+				logDebug("! this option is fine")
+				willing = append(willing, trades[i].Willing[x])
+			}
+		}
+		
+		if len(willing) == len(trades[i].Willing) {
+			continue																							//untouched trades are not rewritten
+		}
+		if len(willing) == 0 {
+			logDebug("! no more options for this trade, removing trade")
+			err = removeTrade(stub, trades[i].Id)
+		}else{
+			logDebug("! saving open trade changes")
+			trades[i].Willing = willing
+			err = putTrade(stub, trades[i])
+		}
+		if err != nil {
+			return err
+		}
+		pruned = append(pruned, trades[i].Id)
+	}
+	
+	if len(pruned) > 0 {
+		err = emitEvent(stub, "trades_pruned", MarbleEvent{Trades: pruned})
+		if err != nil {
+			return err
+		}
+	}
+
+	logDebug("- end clean trades")
+	return nil
+}
+
+// ============================================================================================================================
+// Trade Key - the key an open trade is stored under
+// ============================================================================================================================
+func tradeKey(id string) string {
+	return tradePrefix + id
+}
+
+// ============================================================================================================================
+// getTradeIndex - ids of all open trades, oldest first
+// ============================================================================================================================
+func getTradeIndex(stub ChaincodeStubInterface) ([]string, error) {
+	indexAsBytes, err := stub.GetState(tradeIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get trade index")
+	}
+	var tradeIndex []string
+	err = decodeJSON(tradeIndexStr, indexAsBytes, &tradeIndex)
+	if err != nil {
+		return nil, err
+	}
+	return tradeIndex, nil
+}
+
+// ============================================================================================================================
+// putTradeIndex - rewrite the list of open trade ids
+// ============================================================================================================================
+func putTradeIndex(stub ChaincodeStubInterface, tradeIndex []string) error {
+	jsonAsBytes, _ := json.Marshal(tradeIndex)
+	return stub.PutState(tradeIndexStr, jsonAsBytes)
+}
+
+// ============================================================================================================================
+// getTrade - read one open trade by id
+// ============================================================================================================================
+func getTrade(stub ChaincodeStubInterface, id string) (AnOpenTrade, error) {
+	var trade AnOpenTrade
+	tradeAsBytes, err := stub.GetState(tradeKey(id))
+	if err != nil {
+		return trade, errors.New("Failed to get open trade " + id)
+	}
+	if len(tradeAsBytes) == 0 {
+		return trade, errors.New("Did not find open trade " + id)
+	}
+	err = decodeJSON(tradeKey(id), tradeAsBytes, &trade)
+	if err != nil {
+		return trade, err
+	}
+	return trade, nil
+}
+
+// ============================================================================================================================
+// putTrade - rewrite one open trade, its index entry is left alone
+// ============================================================================================================================
+func putTrade(stub ChaincodeStubInterface, trade AnOpenTrade) error {
+	jsonAsBytes, _ := json.Marshal(trade)
+	return stub.PutState(tradeKey(trade.Id), jsonAsBytes)
+}
+
+// ============================================================================================================================
+// newTradeId - id for the trade this transaction opens, its transaction id when the peer gives one. Otherwise the next
+//   number from a counter kept on the ledger, which every peer agrees on just the same
+// ============================================================================================================================
+func newTradeId(stub ChaincodeStubInterface) (string, error) {
+	id := stub.GetTxID()
+	if id != "" {
+		return id, nil
+	}
+	count := 0
+	countAsBytes, err := stub.GetState(tradeCounterStr)
+	if err != nil {
+		return "", errors.New("Failed to get trade counter")
+	}
+	if len(countAsBytes) != 0 {
+		count, err = strconv.Atoi(string(countAsBytes))
+		if err != nil {
+			return "", errors.New("Failed to decode trade counter")
+		}
+	}
+	count++
+	err = stub.PutState(tradeCounterStr, []byte(strconv.Itoa(count)))
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(count), nil
+}
+
+// ============================================================================================================================
+// addTrade - store a new open trade and add it to the trade index
+// ============================================================================================================================
+func addTrade(stub ChaincodeStubInterface, trade AnOpenTrade) error {
+	tradeAsBytes, err := stub.GetState(tradeKey(trade.Id))
+	if err != nil {
+		return errors.New("Failed to get open trade " + trade.Id)
+	}
+	if len(tradeAsBytes) != 0 {
+		return errors.New("Trade " + trade.Id + " already exists")
+	}
+	tradeIndex, err := getTradeIndex(stub)
+	if err != nil {
+		return err
+	}
+	
+	err = putTrade(stub, trade)
+	if err != nil {
+		return err
+	}
+	tradeIndex = append(tradeIndex, trade.Id)											//add trade id to index list
+	return putTradeIndex(stub, tradeIndex)
+}
+
+// ============================================================================================================================
+// removeTrade - delete an open trade and its trade index entry, a missing trade is not an error
+// ============================================================================================================================
+func removeTrade(stub ChaincodeStubInterface, id string) error {
+	trade, err := getTrade(stub, id)
+	if err == nil {
+		err = releaseEscrow(stub, trade)														//hand back any marbles still locked
+		if err != nil {
+			return err
 		}
-		
-		trade_away = Description{}
-		trade_away.Color = args[i]
-		trade_away.Size =  will_size
-		fmt.Println("! created trade_away: " + args[i])
-		jsonAsBytes, _ = json.Marshal(trade_away)
-		err = stub.PutState("_debug2", jsonAsBytes)
-		
-		open.Willing = append(open.Willing, trade_away)
-		fmt.Println("! appended willing to open")
-		i++;
 	}
-	
-	//get the open trade struct
-	tradesAsBytes, err := stub.GetState(openTradesStr)
+	err = stub.DelState(tradeKey(id))
 	if err != nil {
-		return nil, errors.New("Failed to get opentrades")
+		return errors.New("Failed to delete open trade " + id)
 	}
-	var trades AllTrades
-	json.Unmarshal(tradesAsBytes, &trades)										//un stringify it aka JSON.parse()
-	
-	trades.OpenTrades = append(trades.OpenTrades, open);						//append to open trades
-	fmt.Println("! appended open to trades")
-	jsonAsBytes, _ = json.Marshal(trades)
-	err = stub.PutState(openTradesStr, jsonAsBytes)								//rewrite open orders
+	tradeIndex, err := getTradeIndex(stub)
+	if err != nil {
+		return err
+	}
+	for i, val := range tradeIndex{
+		if val == id{
+			tradeIndex = append(tradeIndex[:i], tradeIndex[i+1:]...)					//remove it
+			return putTradeIndex(stub, tradeIndex)
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// releaseEscrow - unlock the marbles a trade still holds in escrow
+// ============================================================================================================================
+func releaseEscrow(stub ChaincodeStubInterface, trade AnOpenTrade) error {
+	for _, name := range trade.Escrow{
+		res, err := getMarble(stub, name)
+		if _, missing := err.(*MarbleNotFoundError); missing {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if res.Locked != trade.Id {
+			continue																		//already handed over by this trade
+		}
+		res.Locked = ""
+		jsonAsBytes, _ := json.Marshal(res)
+		err = stub.PutState(marbleKey(name), jsonAsBytes)
+		if err != nil {
+			return errors.New("Failed to unlock marble " + name)
+		}
+	}
+	return nil
+}
+
+// ============================================================================================================================
+// getOpenTrades - read every open trade, oldest first
+// ============================================================================================================================
+func getOpenTrades(stub ChaincodeStubInterface) ([]AnOpenTrade, error) {
+	tradeIndex, err := getTradeIndex(stub)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Println("- end open trade")
-	return nil, nil
+	var trades []AnOpenTrade
+	for _, id := range tradeIndex{
+		trade, err := getTrade(stub, id)
+		if err != nil {
+			return nil, err
+		}
+		trades = append(trades, trade)
+	}
+	return trades, nil
 }
 
 // ============================================================================================================================
-// Perform Trade - close an open trade and move ownership
+// Expire Trades - remove every open trade past its expiry, returns a JSON array of the removed trade ids
 // ============================================================================================================================
-func (t *SimpleChaincode) perform_trade(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
-	var err error
+func (t *SimpleChaincode) expire_trades(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	logDebug("- start expire trades")
+	now, err := stub.TxTimestamp()
+	if err != nil {
+		return nil, errors.New("Failed to get transaction timestamp")
+	}
+	trades, err := getOpenTrades(stub)
+	if err != nil {
+		return nil, err
+	}
 	
-	//	0		1					2					3				4					5
-	//[data.id, data.closer.user, data.closer.name, data.opener.user, data.opener.color, data.opener.size]
-	if len(args) < 6 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 6")
+	expired := []string{}
+	for _, trade := range trades{
+		if !isExpired(trade, now) {
+			continue
+		}
+		err = removeTrade(stub, trade.Id)
+		if err != nil {
+			return nil, err
+		}
+		logInfo("! expired trade " + trade.Id)
+		expired = append(expired, trade.Id)
 	}
+	logDebug("- end expire trades")
+	return json.Marshal(expired)
+}
+
+// ============================================================================================================================
+// List Trades - JSON array of open trades oldest first, filtered by opener, wanted color/size and willing color
+// ============================================================================================================================
+func (t *SimpleChaincode) list_trades(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	var err error
 	
-	fmt.Println("- start close trade")
-	timestamp, err := strconv.ParseInt(args[0], 10, 64)
-	if err != nil {
-		return nil, errors.New("1st argument must be a numeric string")
+	//	  0		   1			2			3				4		  5
+	//[*"user", "want color", "want size", "willing color", "offset", "limit"*]  "" matches anything
+	
+	wantSize := -1																//checkArgs made sure the sizes, offset and limit are numbers
+	if args[2] != "" {
+		wantSize, _ = strconv.Atoi(args[2])
+	}
+	offset := 0
+	if args[4] != "" {
+		offset, _ = strconv.Atoi(args[4])
+		if offset < 0 {
+			return nil, errors.New("offset must be a non-negative numeric string")
+		}
+	}
+	limit := defaultPageSize
+	if args[5] != "" {
+		limit, _ = strconv.Atoi(args[5])
+		if limit <= 0 {
+			return nil, errors.New("limit must be a positive numeric string")
+		}
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
 	}
 	
-	size, err := strconv.Atoi(args[5])
+	trades, err := getOpenTrades(stub)
 	if err != nil {
-		return nil, errors.New("6th argument must be a numeric string")
+		return nil, err
 	}
+	sort.Stable(tradesByTime(trades))
 	
-	//get the open trade struct
+	page := []AnOpenTrade{}
+	skipped := 0
+	for _, trade := range trades{
+		if args[0] != "" && strings.ToLower(trade.User) != strings.ToLower(args[0]) {
+			continue
+		}
+		if (args[1] != "" || wantSize >= 0) && !wantsLike(trade, args[1], wantSize) {
+			continue
+		}
+		if args[3] != "" && !willingColor(trade, args[3]) {
+			continue
+		}
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		page = append(page, trade)
+		if len(page) >= limit {
+			break
+		}
+	}
+	return json.Marshal(page)
+}
+
+// ============================================================================================================================
+// wantsLike - true if the trade wants a marble of this color and size, "" and -1 match anything
+// ============================================================================================================================
+func wantsLike(trade AnOpenTrade, color string, size int) bool {
+	wants := []Description{trade.Want}
+	if isBundle(trade) {
+		wants = trade.WantBundle
+	}
+	for _, want := range wants{
+		if (color == "" || strings.ToLower(want.Color) == strings.ToLower(color)) && (size < 0 || want.Size == size) {
+			return true
+		}
+	}
+	return false
+}
+
+// ============================================================================================================================
+// willingColor - true if the trade offers a marble of this color
+// ============================================================================================================================
+func willingColor(trade AnOpenTrade, color string) bool {
+	offers := trade.Willing
+	if isBundle(trade) {
+		offers = trade.GiveBundle
+	}
+	for _, will := range offers{
+		if strings.ToLower(will.Color) == strings.ToLower(color) {
+			return true
+		}
+	}
+	return false
+}
+
+// tradesByTime - sorts open trades by creation time
+type tradesByTime []AnOpenTrade
+
+func (a tradesByTime) Len() int           { return len(a) }
+func (a tradesByTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a tradesByTime) Less(i, j int) bool { return a[i].Timestamp < a[j].Timestamp }
+
+// ============================================================================================================================
+// Migrate Trades - one shot split of the old _opentrades blob into one key per trade, a second run does nothing
+// ============================================================================================================================
+func (t *SimpleChaincode) migrate_trades(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	logDebug("- start migrate trades")
 	tradesAsBytes, err := stub.GetState(openTradesStr)
 	if err != nil {
 		return nil, errors.New("Failed to get opentrades")
 	}
+	if len(tradesAsBytes) == 0 {
+		logDebug("- end migrate trades, nothing to migrate")
+		return nil, nil
+	}
 	var trades AllTrades
-	json.Unmarshal(tradesAsBytes, &trades)															//un stringify it aka JSON.parse()
-	
-	for i := range trades.OpenTrades{																//look for the trade
-		fmt.Println("looking at " + strconv.FormatInt(trades.OpenTrades[i].Timestamp, 10) + " for " + strconv.FormatInt(timestamp, 10))
-		if trades.OpenTrades[i].Timestamp == timestamp{
-			fmt.Println("found the trade");
-			
-			
-			marbleAsBytes, err := stub.GetState(args[2])
-			if err != nil {
-				return nil, errors.New("Failed to get thing")
-			}
-			closersMarble := Marble{}
-			json.Unmarshal(marbleAsBytes, &closersMarble)											//un stringify it aka JSON.parse()
-			
-			//verify if marble meets trade requirements
-			if closersMarble.Color != trades.OpenTrades[i].Want.Color || closersMarble.Size != trades.OpenTrades[i].Want.Size {
-				msg := "marble in input does not meet trade requriements"
-				fmt.Println(msg)
-				return nil, errors.New(msg)
-			}
-			
-			marble, e := findMarble4Trade(stub, trades.OpenTrades[i].User, args[4], size)			//find a marble that is suitable from opener
-			if(e == nil){
-				fmt.Println("! no errors, proceeding")
-
-				t.set_user(stub, []string{args[2], trades.OpenTrades[i].User})						//change owner of selected marble, closer -> opener
-				t.set_user(stub, []string{marble.Name, args[1]})									//change owner of selected marble, opener -> closer
-			
-				trades.OpenTrades = append(trades.OpenTrades[:i], trades.OpenTrades[i+1:]...)		//remove trade
-				jsonAsBytes, _ := json.Marshal(trades)
-				err = stub.PutState(openTradesStr, jsonAsBytes)										//rewrite open orders
-				if err != nil {
-					return nil, err
-				}
-			}
+	err = decodeJSON(openTradesStr, tradesAsBytes, &trades)
+	if err != nil {
+		return nil, err
+	}
+	
+	for i, trade := range trades.OpenTrades{
+		if trade.Id == "" {
+			trade.Id = strconv.FormatInt(trade.Timestamp, 10)							//older trades were known by their timestamp
+		}
+		existing, err := stub.GetState(tradeKey(trade.Id))
+		if err != nil {
+			return nil, errors.New("Failed to get open trade " + trade.Id)
+		}
+		if len(existing) != 0 {
+			trade.Id = trade.Id + "-" + strconv.Itoa(i)									//two trades opened in the same ms, keep both
+		}
+		err = addTrade(stub, trade)
+		if err != nil {
+			return nil, err
 		}
+		logInfo("! migrated trade " + trade.Id)
 	}
-	fmt.Println("- end close trade")
+	
+	err = stub.DelState(openTradesStr)													//nothing left to migrate
+	if err != nil {
+		return nil, errors.New("Failed to delete opentrades")
+	}
+	logDebug("- end migrate trades")
 	return nil, nil
 }
 
 // ============================================================================================================================
-// findMarble4Trade - look for a matching marble that this user owns and return it
+// Migrate Keys - one shot move of every marble stored under its bare name into its own key, a second run does nothing
 // ============================================================================================================================
-func findMarble4Trade(stub *shim.ChaincodeStub, user string, color string, size int )(m Marble, err error){
-	var fail Marble;
-	fmt.Println("- start find marble 4 trade")
-	fmt.Println("looking for " + user + ", " + color + ", " + strconv.Itoa(size));
+func (t *SimpleChaincode) migrate_keys(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	logDebug("- start migrate keys")
+	indexAsBytes, err := stub.GetState(marbleIndexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get marble index")
+	}
+	var index []string
+	err = decodeJSON(marbleIndexStr, indexAsBytes, &index)
+	if err != nil {
+		return nil, err
+	}
+	
+	for _, name := range index{
+		moved, err := moveKey(stub, name, marbleKey(name))
+		if err != nil {
+			return nil, err
+		}
+		if moved {
+			logInfo("! migrated marble " + name)
+		}
+	}
+	logDebug("- end migrate keys")
+	return nil, nil
+}
 
-	//get the marble index
-	marblesAsBytes, err := stub.GetState(marbleIndexStr)
+// ============================================================================================================================
+// Migrate - upgrade records to schemaVersion, looking at up to limit of them. A ledger too big for one transaction
+//   takes several calls, each carrying on from where the last stopped. Returns the progress, stage "done" once finished
+// ============================================================================================================================
+func (t *SimpleChaincode) migrate(stub ChaincodeStubInterface, args []string) ([]byte, error) {
+	//      0
+	// *"limit"*
+	limit := migrateBatchSize
+	if args[0] != "" {
+		limit, _ = strconv.Atoi(args[0])
+		if limit <= 0 {
+			return nil, errors.New("limit must be a positive numeric string")
+		}
+	}
+	logDebug("- start migrate")
+	progress, err := getMigration(stub)
 	if err != nil {
-		return fail, errors.New("Failed to get marble index")
+		return nil, err
+	}
+	
+	for limit > 0 && progress.Stage != "done" {
+		var n int
+		switch progress.Stage {
+		case "marbles":
+			n, err = migrateMarbles(stub, &progress, limit)
+		case "indexes":
+			n, err = indexMarbles(stub, &progress, limit)
+		case "trades":
+			if progress.Bookmark == "" {
+				_, err = t.migrate_trades(stub, nil)									//trades from before each had its own key first
+				if err != nil {
+					return nil, err
+				}
+			}
+			n, err = migrateTrades(stub, &progress, limit)
+		default:
+			return nil, errors.New("Unknown migration stage " + progress.Stage)
+		}
+		if err != nil {
+			return nil, err
+		}
+		limit -= n
 	}
-	var marbleIndex []string
-	json.Unmarshal(marblesAsBytes, &marbleIndex)								//un stringify it aka JSON.parse()
 	
-	for i:= range marbleIndex{													//iter through all the marbles
-		//fmt.Println("looking @ marble name: " + marbleIndex[i]);
+	if progress.Stage == "done" {
+		err = stub.PutState(schemaVersionStr, []byte(strconv.Itoa(progress.Version)))
+		if err == nil {
+			err = stub.DelState(migrationStr)											//nothing left to resume
+		}
+	} else {
+		jsonAsBytes, _ := json.Marshal(progress)
+		err = stub.PutState(migrationStr, jsonAsBytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logDebug("- end migrate, stage " + progress.Stage)
+	return json.Marshal(progress)
+}
 
-		marbleAsBytes, err := stub.GetState(marbleIndex[i])						//grab this marble
+// ============================================================================================================================
+// getMigration - the progress of an unfinished migrate, or a fresh start unless the ledger is already at schemaVersion
+// ============================================================================================================================
+func getMigration(stub ChaincodeStubInterface) (Migration, error) {
+	progress := Migration{Version: schemaVersion, Stage: "marbles"}
+	progressAsBytes, err := stub.GetState(migrationStr)
+	if err != nil {
+		return progress, errors.New("Failed to get migration")
+	}
+	if len(progressAsBytes) == 0 {
+		versionAsBytes, err := stub.GetState(schemaVersionStr)
 		if err != nil {
-			return fail, errors.New("Failed to get marble")
+			return progress, errors.New("Failed to get schema version")
 		}
-		res := Marble{}
-		json.Unmarshal(marbleAsBytes, &res)										//un stringify it aka JSON.parse()
-		//fmt.Println("looking @ " + res.User + ", " + res.Color + ", " + strconv.Itoa(res.Size));
-		
-		//check for user && color && size
-		if strings.ToLower(res.User) == strings.ToLower(user) && strings.ToLower(res.Color) == strings.ToLower(color) && res.Size == size{
-			fmt.Println("found a marble: " + res.Name)
-			fmt.Println("! end find marble 4 trade")
-			return res, nil
+		version, _ := strconv.Atoi(string(versionAsBytes))
+		if version >= schemaVersion {
+			progress.Stage = "done"												//already migrated, nothing to walk
 		}
+		return progress, nil
 	}
-	
-	fmt.Println("- end find marble 4 trade - error")
-	return fail, errors.New("Did not find marble to use in this trade")
+	err = decodeJSON(migrationStr, progressAsBytes, &progress)
+	return progress, err
 }
 
 // ============================================================================================================================
-// Make Timestamp - create a timestamp in ms
+// restartIndexes - have migrate rebuild the indexes of a ledger that is already at schemaVersion, an unfinished
+//   migrate is left to carry on and rebuilds them when it gets there
 // ============================================================================================================================
-func makeTimestamp() int64 {
-    return time.Now().UnixNano() / (int64(time.Millisecond)/int64(time.Nanosecond))
+func restartIndexes(stub ChaincodeStubInterface) error {
+	progress, err := getMigration(stub)
+	if err != nil {
+		return err
+	}
+	if progress.Stage != "done" {
+		return nil
+	}
+	progress.Stage = "indexes"
+	jsonAsBytes, _ := json.Marshal(progress)
+	return stub.PutState(migrationStr, jsonAsBytes)
 }
 
 // ============================================================================================================================
-// Remove Open Trade - close an open trade
+// sortedIndex - the names or ids in an index, sorted
 // ============================================================================================================================
-func (t *SimpleChaincode) remove_trade(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
-	var err error
-	
-	//	0
-	//[data.id]
-	if len(args) < 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+func sortedIndex(stub ChaincodeStubInterface, indexStr string) ([]string, error) {
+	indexAsBytes, err := stub.GetState(indexStr)
+	if err != nil {
+		return nil, errors.New("Failed to get " + indexStr)
 	}
-	
-	fmt.Println("- start remove trade")
-	timestamp, err := strconv.ParseInt(args[0], 10, 64)
+	var index []string
+	err = decodeJSON(indexStr, indexAsBytes, &index)
 	if err != nil {
-		return nil, errors.New("1st argument must be a numeric string")
+		return nil, err
 	}
-	
-	//get the open trade struct
-	tradesAsBytes, err := stub.GetState(openTradesStr)
+	sort.Strings(index)
+	return index, nil
+}
+
+// ============================================================================================================================
+// migrateMarbles - upgrade up to limit marbles after the bookmark, moving on to the indexes once all are done.
+//   Returns how many it looked at
+// ============================================================================================================================
+func migrateMarbles(stub ChaincodeStubInterface, progress *Migration, limit int) (int, error) {
+	names, err := sortedIndex(stub, marbleIndexStr)
 	if err != nil {
-		return nil, errors.New("Failed to get opentrades")
+		return 0, err
 	}
-	var trades AllTrades
-	json.Unmarshal(tradesAsBytes, &trades)																//un stringify it aka JSON.parse()
-	
-	for i := range trades.OpenTrades{																	//look for the trade
-		//fmt.Println("looking at " + strconv.FormatInt(trades.OpenTrades[i].Timestamp, 10) + " for " + strconv.FormatInt(timestamp, 10))
-		if trades.OpenTrades[i].Timestamp == timestamp{
-			fmt.Println("found the trade");
-			trades.OpenTrades = append(trades.OpenTrades[:i], trades.OpenTrades[i+1:]...)				//remove this trade
-			jsonAsBytes, _ := json.Marshal(trades)
-			err = stub.PutState(openTradesStr, jsonAsBytes)												//rewrite open orders
+	n := 0
+	for _, name := range names{
+		if name <= progress.Bookmark {
+			continue
+		}
+		if n >= limit {
+			return n, nil
+		}
+		n++
+		_, err = moveKey(stub, name, marbleKey(name))								//still under its bare name from before marbles had their own keys
+		if err != nil {
+			return n, err
+		}
+		res, err := getMarble(stub, name)
+		if _, missing := err.(*MarbleNotFoundError); missing {
+			progress.Bookmark = name
+			continue
+		}
+		if err != nil {
+			progress.Broken = append(progress.Broken, name)
+		} else if upgradeMarble(&res) {
+			jsonAsBytes, _ := json.Marshal(res)
+			err = stub.PutState(marbleKey(name), jsonAsBytes)
 			if err != nil {
-				return nil, err
+				return n, errors.New("Failed to rewrite marble " + name)
 			}
-			break
+			progress.Migrated++
 		}
+		progress.Bookmark = name
 	}
-	
-	fmt.Println("- end remove trade")
-	return nil, nil
+	progress.Stage, progress.Bookmark = "indexes", ""
+	return n, nil
 }
 
 // ============================================================================================================================
-// Clean Up Open Trades - make sure open trades are still possible, remove choices that are no longer possible, remove trades that have no valid choices
+// upgradeMarble - bring a marble up to schemaVersion, false if it already was
 // ============================================================================================================================
-func cleanTrades(stub *shim.ChaincodeStub)(err error){
-	var didWork = false
-	fmt.Println("- start clean trades")
-	
-	//get the open trade struct
-	tradesAsBytes, err := stub.GetState(openTradesStr)
+func upgradeMarble(m *Marble) bool {
+	if m.Version >= schemaVersion {
+		return false
+	}
+	m.Color = strings.ToLower(m.Color)											//1 to 2 - colors and users were not always lowercased
+	m.User = strings.ToLower(m.User)
+	m.Version = schemaVersion
+	return true
+}
+
+// ============================================================================================================================
+// indexMarbles - rebuild the owner, color and color/size indexes from up to limit marbles after the bookmark, moving on
+//   to open trades once all are done. The first batch empties every index key, so owners left with nothing drop out of them.
+//   Marbles that do not decode are left out and listed as broken. Returns how many it looked at
+// ============================================================================================================================
+func indexMarbles(stub ChaincodeStubInterface, progress *Migration, limit int) (int, error) {
+	if progress.Bookmark == "" {
+		err := clearIndexes(stub)
+		if err != nil {
+			return 0, err
+		}
+	}
+	names, err := sortedIndex(stub, marbleIndexStr)
 	if err != nil {
-		return errors.New("Failed to get opentrades")
+		return 0, err
 	}
-	var trades AllTrades
-	json.Unmarshal(tradesAsBytes, &trades)																		//un stringify it aka JSON.parse()
-	
-	fmt.Println("# trades " + strconv.Itoa(len(trades.OpenTrades)))
-	for i:=0; i<len(trades.OpenTrades); {																		//iter over all the known open trades
-		fmt.Println(strconv.Itoa(i) + ": looking at trade " + strconv.FormatInt(trades.OpenTrades[i].Timestamp, 10))
-		
-		fmt.Println("# options " + strconv.Itoa(len(trades.OpenTrades[i].Willing)))
-		for x:=0; x<len(trades.OpenTrades[i].Willing); {														//find a marble that is suitable
-			fmt.Println("! on next option " + strconv.Itoa(i) + ":" + strconv.Itoa(x))
-			_, e := findMarble4Trade(stub, trades.OpenTrades[i].User, trades.OpenTrades[i].Willing[x].Color, trades.OpenTrades[i].Willing[x].Size)
-			if(e != nil){
-				fmt.Println("! errors with this option, removing option")
-				didWork = true
-				trades.OpenTrades[i].Willing = append(trades.OpenTrades[i].Willing[:x], trades.OpenTrades[i].Willing[x+1:]...)	//remove this option
-				x--;
-			}else{
-				fmt.Println("! this option is fine")
-			}
-			
-			x++
-			fmt.Println("! x:" + strconv.Itoa(x))
-			if x >= len(trades.OpenTrades[i].Willing) {														//things might have shifted, recalcuate
-				break
-			}
+	n := 0
+	for _, name := range names{
+		if name <= progress.Bookmark {
+			continue
 		}
-		
-		if len(trades.OpenTrades[i].Willing) == 0 {
-			fmt.Println("! no more options for this trade, removing trade")
-			didWork = true
-			trades.OpenTrades = append(trades.OpenTrades[:i], trades.OpenTrades[i+1:]...)					//remove this trade
-			i--;
+		if n >= limit {
+			return n, nil
 		}
-		
-		i++
-		fmt.Println("! i:" + strconv.Itoa(i))
-		if i >= len(trades.OpenTrades) {																	//things might have shifted, recalcuate
-			break
+		n++
+		res, err := getMarble(stub, name)
+		if _, missing := err.(*MarbleNotFoundError); missing {
+			progress.Bookmark = name
+			continue																//stale name in the marble index
 		}
+		if err != nil {
+			logError("left " + name + " out of the indexes: " + err.Error())
+			if !containsName(progress.Broken, name) {							//the marbles stage may have listed it already
+				progress.Broken = append(progress.Broken, name)
+			}
+		} else {
+			err = indexMarble(stub, res)
+			if err != nil {
+				return n, err
+			}
+		}
+		progress.Bookmark = name
 	}
+	progress.Stage, progress.Bookmark = "trades", ""
+	return n, nil
+}
 
-	if(didWork){
-		fmt.Println("! saving open trade changes")
-		jsonAsBytes, _ := json.Marshal(trades)
-		err = stub.PutState(openTradesStr, jsonAsBytes)														//rewrite open orders
+// ============================================================================================================================
+// clearIndexes - empty every owner, color and color/size index key, ready to be rebuilt from the marbles
+// ============================================================================================================================
+func clearIndexes(stub ChaincodeStubInterface) error {
+	keys, err := getNameList(stub, indexKeysStr)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys{
+		err = putNameList(stub, key, []string{})
 		if err != nil {
 			return err
 		}
-	}else{
-		fmt.Println("! all open trades are fine")
 	}
-
-	fmt.Println("- end clean trades")
 	return nil
-}
\ No newline at end of file
+}
+
+// ============================================================================================================================
+// migrateTrades - upgrade up to limit open trades after the bookmark, done once all are. Returns how many it looked at
+// ============================================================================================================================
+func migrateTrades(stub ChaincodeStubInterface, progress *Migration, limit int) (int, error) {
+	ids, err := sortedIndex(stub, tradeIndexStr)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, id := range ids{
+		if id <= progress.Bookmark {
+			continue
+		}
+		if n >= limit {
+			return n, nil
+		}
+		n++
+		trade, err := getTrade(stub, id)
+		if err != nil {
+			progress.Broken = append(progress.Broken, tradeKey(id))
+		} else if upgradeTrade(&trade) {
+			err = putTrade(stub, trade)
+			if err != nil {
+				return n, err
+			}
+			progress.Migrated++
+		}
+		progress.Bookmark = id
+	}
+	progress.Stage, progress.Bookmark = "done", ""
+	return n, nil
+}
+
+// ============================================================================================================================
+// upgradeTrade - bring an open trade up to schemaVersion, false if it already was
+// ============================================================================================================================
+func upgradeTrade(trade *AnOpenTrade) bool {
+	if trade.Version >= schemaVersion {
+		return false
+	}
+	trade.User = strings.ToLower(trade.User)										//1 to 2 - users and colors were not always lowercased
+	trade.Want.Color = strings.ToLower(trade.Want.Color)
+	for _, descriptions := range [][]Description{trade.Willing, trade.WantBundle, trade.GiveBundle}{
+		for i := range descriptions{
+			descriptions[i].Color = strings.ToLower(descriptions[i].Color)
+		}
+	}
+	trade.Version = schemaVersion
+	return true
+}